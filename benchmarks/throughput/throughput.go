@@ -108,7 +108,10 @@ func main() {
 func prepareBytes(agent conpass.Initiator) []byte {
 	newsegset := agent.Filter.Filter(agent.InitialSegset)
 	oldsegs := []segment.Segment{}
-	bytes, _ := segment.EncodeSegments(newsegset.Segments, oldsegs, newsegset.SrcIA, newsegset.DstIA)
+	bytes, _, err := segment.EncodeSegments(newsegset.Segments, oldsegs, newsegset.SrcIA, newsegset.DstIA)
+	if err != nil {
+		panic(err)
+	}
 	return bytes
 
 }
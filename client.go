@@ -0,0 +1,236 @@
+package conpass
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// Client negotiates path segments with a CONPASS server over a connection.
+type Client struct {
+	// MaxResponseBytes, if not zero, is the maximum size in bytes of the
+	// response that the Client accepts. It is advertised to the server, which
+	// trims its response accordingly.
+	MaxResponseBytes int
+	// ReplayProtection makes the Client attach a fresh nonce to its offers,
+	// which servers with a ReplayGuard require.
+	ReplayProtection bool
+	// Retry is the policy by which the Client retries offers over datagram
+	// connections, i.e., connections that implement net.PacketConn.
+	Retry RetryPolicy
+	// Logger, if not nil, receives the events of the Client.
+	Logger Logger
+	conn   net.Conn
+}
+
+// DefaultBackoff is the default value for RetryPolicy.Backoff.
+const DefaultBackoff = 500 * time.Millisecond
+
+// maxDatagramSize is the size of the buffer for responses over datagram
+// connections, which suffices for every UDP datagram.
+const maxDatagramSize = 1 << 16
+
+// RetryPolicy determines how often and when a Client sends an offer again if
+// it receives no response, as datagrams may be lost.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times that the offer is sent
+	// (default: 1, i.e., no retries).
+	MaxAttempts int
+	// Backoff is the time that the Client waits for the response to the
+	// first attempt. It doubles with every further attempt (default:
+	// DefaultBackoff).
+	Backoff time.Duration
+}
+
+// NewClient creates a new Client that negotiates over the given connection.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn}
+}
+
+// Close closes the connection of the Client.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Negotiate offers segments between the source and destination ISD-AS to the
+// server and returns the subset of segments that the server accepted.
+//
+// The deadline and cancellation of the context are applied to the connection.
+// If the context is done before the server replies, Negotiate returns the
+// error of the context.
+//
+// Over a datagram connection, every message must fit into one datagram. The
+// offer carries a random request id, which the server echoes, and responses
+// with another request id are discarded. If no response arrives, the offer
+// is sent again according to the retry policy of the Client, and once all
+// attempts are exhausted, Negotiate returns an error that wraps
+// context.DeadlineExceeded.
+func (c *Client) Negotiate(ctx context.Context, offered []segment.Segment, srcIA, dstIA addr.IA) ([]segment.Segment, error) {
+	defer watchContext(ctx, c.conn)()
+	logger := loggerOrNop(c.Logger)
+	logger.Debug("sending offer", "src", srcIA, "dst", dstIA, "offered", len(offered))
+	var accsegs []segment.Segment
+	var err error
+	if _, ok := c.conn.(net.PacketConn); ok {
+		accsegs, err = c.negotiateDatagram(ctx, offered, srcIA, dstIA)
+	} else {
+		accsegs, err = c.negotiateStream(ctx, offered, srcIA, dstIA)
+	}
+	if err != nil {
+		logger.Warn("negotiation failed", "src", srcIA, "dst", dstIA, "error", err)
+		return nil, err
+	}
+	logger.Info("segments accepted", "src", srcIA, "dst", dstIA, "offered", len(offered), "accepted", len(accsegs))
+	return accsegs, nil
+}
+
+func (c *Client) negotiateStream(ctx context.Context, offered []segment.Segment, srcIA, dstIA addr.IA) ([]segment.Segment, error) {
+	oldsegs := []segment.Segment{}
+	encoder := segment.NewEncoder(c.conn)
+	encoder.MaxResponseBytes = c.MaxResponseBytes
+	encoder.ReplayProtection = c.ReplayProtection
+	sentsegs, err := encoder.Encode(offered, oldsegs, srcIA, dstIA)
+	if err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to send offer: %s", err.Error()))
+	}
+	_, accsegs, _, _, err := segment.NewDecoder(c.conn).Decode(sentsegs)
+	if err != nil {
+		return nil, contextError(ctx, fmt.Errorf("failed to decode server response: %s", err.Error()))
+	}
+	return accsegs, nil
+}
+
+func (c *Client) negotiateDatagram(ctx context.Context, offered []segment.Segment, srcIA, dstIA addr.IA) ([]segment.Segment, error) {
+	var idbytes [8]byte
+	if _, err := rand.Read(idbytes[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate request id: %s", err.Error())
+	}
+	requestID := binary.BigEndian.Uint64(idbytes[:])
+	response := make([]byte, maxDatagramSize)
+	backoff := c.Retry.backoff()
+	for attempt := 0; attempt < c.Retry.maxAttempts(); attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// The offer is encoded for every attempt, since a server with a
+		// ReplayGuard rejects an offer with a nonce that it has seen before.
+		var offer bytes.Buffer
+		encoder := segment.NewEncoder(&offer)
+		encoder.MaxResponseBytes = c.MaxResponseBytes
+		encoder.ReplayProtection = c.ReplayProtection
+		encoder.RequestID = requestID
+		sentsegs, err := encoder.Encode(offered, []segment.Segment{}, srcIA, dstIA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode offer: %s", err.Error())
+		}
+		if _, err := c.conn.Write(offer.Bytes()); err != nil {
+			return nil, contextError(ctx, fmt.Errorf("failed to send offer: %s", err.Error()))
+		}
+		deadline := time.Now().Add(backoff)
+		if ctxdeadline, ok := ctx.Deadline(); ok && ctxdeadline.Before(deadline) {
+			deadline = ctxdeadline
+		}
+		c.conn.SetReadDeadline(deadline)
+		// The read deadline may have replaced the deadline in the past
+		// by which watchContext interrupts reads once ctx is done.
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		accsegs, err := c.receiveDatagram(response, sentsegs, requestID)
+		if err == nil {
+			return accsegs, nil
+		}
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, contextError(ctx, err)
+		}
+		loggerOrNop(c.Logger).Debug("no response to offer", "src", srcIA, "dst", dstIA, "attempt", attempt+1, "timeout", backoff)
+		backoff *= 2
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: no response after %d attempts", context.DeadlineExceeded, c.Retry.maxAttempts())
+}
+
+// receiveDatagram reads datagrams into the buffer until it receives the
+// response with the given request id. Datagrams that cannot be decoded, e.g.,
+// corrupted or truncated ones, are skipped like stray responses to other
+// requests, so that a lost response is retried instead of failing the
+// negotiation.
+func (c *Client) receiveDatagram(buffer []byte, sentsegs []segment.Segment, requestID uint64) ([]segment.Segment, error) {
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		decoder := segment.NewDecoder(bytes.NewReader(buffer[:n]))
+		_, accsegs, _, _, err := decoder.Decode(sentsegs)
+		if err != nil {
+			loggerOrNop(c.Logger).Debug("skipping undecodable datagram", "error", err)
+			continue
+		}
+		if decoder.RequestID() != requestID {
+			continue
+		}
+		return accsegs, nil
+	}
+}
+
+func (p RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p RetryPolicy) backoff() time.Duration {
+	if p.Backoff == 0 {
+		return DefaultBackoff
+	}
+	return p.Backoff
+}
+
+// watchContext applies the deadline of a context to a connection and
+// interrupts pending reads and writes once the context is done. The returned
+// function must be called to stop watching and to clear the deadline.
+func watchContext(ctx context.Context, conn interface{ SetDeadline(time.Time) error }) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0)) // unblock pending I/O
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// contextError returns the error of the context if it is done, and the given
+// error otherwise. The connection deadline may expire slightly before the
+// context notices its own deadline, so an expired deadline counts as done.
+func contextError(ctx context.Context, err error) error {
+	if ctxerr := ctx.Err(); ctxerr != nil {
+		return ctxerr
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package conpass
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+func TestClientNegotiate(t *testing.T) {
+	segments := []segment.Segment{
+		segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		segment.FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+		segment.FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108"),
+	}
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	go func() {
+		defer sconn.Close()
+		segsin, accsegs, srcIA, dstIA, err := segment.ReadSegments(sconn, []segment.Segment{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		segment.WriteSegments(sconn, accsegs[1:], segsin, srcIA, dstIA)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	accepted, err := NewClient(cconn).Negotiate(ctx, segments, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(accepted, segments[1:], t)
+}
+
+func TestClientNegotiateContext(t *testing.T) {
+	segments := []segment.Segment{segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	srcIA, dstIA := segments[0].SrcIA(), segments[0].DstIA()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	go segment.ReadSegments(sconn, []segment.Segment{}) // never replies
+	_, err := NewClient(cconn).Negotiate(ctx, segments, srcIA, dstIA)
+	if err != context.DeadlineExceeded {
+		t.Error("want", context.DeadlineExceeded, "have", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = NewClient(cconn).Negotiate(ctx, segments, srcIA, dstIA)
+	if err != context.Canceled {
+		t.Error("want", context.Canceled, "have", err)
+	}
+}
+
+// flakyConn is a fake datagram connection to a server that accepts all
+// offered segments, but whose first drop responses are lost. Every response is
+// preceded by a stray response with another request id and, if garbage is set,
+// by a corrupted and a truncated copy of the response.
+type flakyConn struct {
+	net.Conn
+	drop      int
+	garbage   bool
+	mutex     sync.Mutex
+	attempts  int
+	deadline  time.Time
+	responses chan []byte
+}
+
+func newFlakyConn(drop int) *flakyConn {
+	return &flakyConn{drop: drop, responses: make(chan []byte, 16)}
+}
+
+func (c *flakyConn) Write(offer []byte) (int, error) {
+	decoder := segment.NewDecoder(bytes.NewReader(offer))
+	segsin, accsegs, srcIA, dstIA, err := decoder.Decode([]segment.Segment{})
+	if err != nil {
+		return 0, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.attempts++
+	if c.attempts <= c.drop {
+		return len(offer), nil
+	}
+	for _, requestID := range []uint64{decoder.RequestID() + 1, decoder.RequestID()} {
+		var response bytes.Buffer
+		encoder := segment.NewEncoder(&response)
+		encoder.RequestID = requestID
+		if _, err := encoder.Encode(accsegs, segsin, srcIA, dstIA); err != nil {
+			return 0, err
+		}
+		if c.garbage {
+			corrupted := append([]byte(nil), response.Bytes()...)
+			corrupted[len(corrupted)-1] ^= 0xff
+			c.responses <- corrupted
+			c.responses <- response.Bytes()[:response.Len()/2]
+		}
+		c.responses <- response.Bytes()
+	}
+	return len(offer), nil
+}
+
+func (c *flakyConn) Read(buffer []byte) (int, error) {
+	c.mutex.Lock()
+	deadline := c.deadline
+	c.mutex.Unlock()
+	timeout := make(<-chan time.Time)
+	if !deadline.IsZero() {
+		timeout = time.After(time.Until(deadline))
+	}
+	select {
+	case response := <-c.responses:
+		return copy(buffer, response), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *flakyConn) SetDeadline(deadline time.Time) error {
+	return c.SetReadDeadline(deadline)
+}
+
+func (c *flakyConn) SetReadDeadline(deadline time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.deadline = deadline
+	return nil
+}
+
+func (c *flakyConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	n, err := c.Read(buffer)
+	return n, nil, err
+}
+
+func (c *flakyConn) WriteTo(buffer []byte, _ net.Addr) (int, error) {
+	return c.Write(buffer)
+}
+
+func TestClientRetry(t *testing.T) {
+	segments := []segment.Segment{
+		segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		segment.FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+	}
+	srcIA, dstIA := segments[0].SrcIA(), segments[1].DstIA()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn := newFlakyConn(2)
+	client := NewClient(conn)
+	client.Retry = RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond}
+	accepted, err := client.Negotiate(ctx, segments, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(accepted, segments, t)
+	if conn.attempts != 3 {
+		t.Error("want 3 attempts, have", conn.attempts)
+	}
+
+	conn = newFlakyConn(3)
+	client = NewClient(conn)
+	client.Retry = RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond}
+	if _, err := client.Negotiate(ctx, segments, srcIA, dstIA); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("want", context.DeadlineExceeded, "after exhausting retries, have", err)
+	}
+	if conn.attempts != 3 {
+		t.Error("want 3 attempts, have", conn.attempts)
+	}
+
+	conn = newFlakyConn(0)
+	conn.garbage = true
+	client = NewClient(conn)
+	client.Retry = RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond}
+	accepted, err = client.Negotiate(ctx, segments, srcIA, dstIA)
+	if err != nil {
+		t.Fatal("garbage datagrams:", err)
+	}
+	assertEqual(accepted, segments, t)
+	if conn.attempts != 1 {
+		t.Error("garbage datagrams: want 1 attempt, have", conn.attempts)
+	}
+}
@@ -1,8 +1,11 @@
 package filter
 
 import (
+	"fmt"
+
 	"github.com/mblarer/conpass/path"
 	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/pathpol"
 	"github.com/scionproto/scion/go/lib/snet"
 )
@@ -27,3 +30,51 @@ func (af aclFilter) Filter(segset segment.SegmentSet) segment.SegmentSet {
 		return accept
 	}).Filter(segset)
 }
+
+// ACL is a segment.Filter that rejects path segments traversing any of the
+// denied ISD-ASes. Denied ISD-ASes may be wildcards, see segment.MatchIA.
+type ACL struct {
+	Deny []addr.IA
+}
+
+// Apply returns the segments that do not traverse a denied ISD-AS, preserving
+// their order. Segment compositions are evaluated on their flattened path.
+func (acl ACL) Apply(segments []segment.Segment) []segment.Segment {
+	filtered := make([]segment.Segment, 0)
+	for _, segment := range segments {
+		if acl.allows(segment) {
+			filtered = append(filtered, segment)
+		}
+	}
+	return filtered
+}
+
+func (acl ACL) Filter(segset segment.SegmentSet) segment.SegmentSet {
+	return FromPredicate(acl.allows).Filter(segset)
+}
+
+// Explain returns the denied ISD-AS that the segment traverses.
+func (acl ACL) Explain(segment segment.Segment) string {
+	if ia, pattern, denied := acl.denied(segment); denied {
+		return fmt.Sprintf("traverses %s, which matches denied %s", ia, pattern)
+	}
+	return ""
+}
+
+func (acl ACL) allows(segment segment.Segment) bool {
+	_, _, denied := acl.denied(segment)
+	return !denied
+}
+
+// denied returns the first ISD-AS of the segment that matches a denied ISD-AS,
+// as well as the denied ISD-AS that it matches.
+func (acl ACL) denied(seg segment.Segment) (addr.IA, addr.IA, bool) {
+	for _, iface := range seg.PathInterfaces() {
+		for _, denied := range acl.Deny {
+			if segment.MatchIA(denied, iface.IA) {
+				return iface.IA, denied, true
+			}
+		}
+	}
+	return addr.IA{}, addr.IA{}, false
+}
@@ -0,0 +1,60 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+var (
+	seg12 = segment.FromString("1-ff00:0:1 1>2 1-ff00:0:2")
+	seg23 = segment.FromString("1-ff00:0:2 3>4 2-ff00:0:3")
+	seg13 = segment.FromString("1-ff00:0:1 5>6 1-ff00:0:3")
+)
+
+func TestACL(t *testing.T) {
+	segments := []segment.Segment{seg12, seg23, seg13, segment.FromSegments(seg12, seg23)}
+	tests := []struct {
+		name string
+		deny []addr.IA
+		want []segment.Segment
+	}{
+		{"empty", nil, segments},
+		{"deny by IA", []addr.IA{mustIA(t, "1-ff00:0:2")}, []segment.Segment{seg13}},
+		{"deny ISD", []addr.IA{{I: 2}}, []segment.Segment{seg12, seg13}},
+		{"deny AS in any ISD", []addr.IA{{A: mustIA(t, "1-ff00:0:3").A}}, []segment.Segment{seg12}},
+	}
+	for _, test := range tests {
+		acl := ACL{Deny: test.deny}
+		have := acl.Apply(segments)
+		if !equalSegments(have, test.want) {
+			t.Errorf("%s: want %v, have %v", test.name, test.want, have)
+		}
+		segset := acl.Filter(segment.SegmentSet{Segments: segments})
+		if !equalSegments(segset.Segments, test.want) {
+			t.Errorf("%s: Filter: want %v, have %v", test.name, test.want, segset.Segments)
+		}
+	}
+}
+
+func mustIA(t *testing.T, s string) addr.IA {
+	t.Helper()
+	ia, err := addr.IAFromString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ia
+}
+
+func equalSegments(a, b []segment.Segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -18,3 +18,60 @@ func (fc filterComposition) Filter(segset segment.SegmentSet) segment.SegmentSet
 	}
 	return segset
 }
+
+// And returns a segment.Filter that keeps the path segments that pass all of
+// the given filters. It is equivalent to FromFilters.
+func And(filters ...segment.Filter) segment.Filter {
+	return FromFilters(filters...)
+}
+
+// Or returns a segment.Filter that keeps the path segments that pass any of
+// the given filters. Every filter is applied to the original segments and the
+// results are united in the order of the filters, where segments with the
+// same fingerprint are only kept once.
+func Or(filters ...segment.Filter) segment.Filter {
+	return filterUnion{filters: filters}
+}
+
+type filterUnion struct {
+	filters []segment.Filter
+}
+
+func (fu filterUnion) Filter(segset segment.SegmentSet) segment.SegmentSet {
+	united := make([]segment.Segment, 0)
+	seen := make(map[string]bool)
+	for _, filter := range fu.filters {
+		for _, segment := range filter.Filter(segset).Segments {
+			if !seen[segment.Fingerprint()] {
+				seen[segment.Fingerprint()] = true
+				united = append(united, segment)
+			}
+		}
+	}
+	return segment.SegmentSet{
+		Segments: united,
+		SrcIA:    segset.SrcIA,
+		DstIA:    segset.DstIA,
+	}
+}
+
+// Not returns a segment.Filter that keeps the path segments that do not pass
+// the given filter, i.e., the segments whose fingerprint does not occur in the
+// result of the filter.
+func Not(filter segment.Filter) segment.Filter {
+	return filterComplement{filter: filter}
+}
+
+type filterComplement struct {
+	filter segment.Filter
+}
+
+func (fc filterComplement) Filter(segset segment.SegmentSet) segment.SegmentSet {
+	passed := make(map[string]bool)
+	for _, segment := range fc.filter.Filter(segset).Segments {
+		passed[segment.Fingerprint()] = true
+	}
+	return FromPredicate(func(segment segment.Segment) bool {
+		return !passed[segment.Fingerprint()]
+	}).Filter(segset)
+}
@@ -0,0 +1,35 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+func TestCombinators(t *testing.T) {
+	seg123 := segment.FromSegments(seg12, seg23)
+	segments := []segment.Segment{seg12, seg23, seg13, seg123}
+	isd1 := ACL{Deny: []addr.IA{{I: 2}}}                      // within ISD 1
+	as2 := Not(ACL{Deny: []addr.IA{mustIA(t, "1-ff00:0:2")}}) // through 1-ff00:0:2
+	tests := []struct {
+		name   string
+		filter segment.Filter
+		want   []segment.Segment
+	}{
+		{"and", And(isd1, as2), []segment.Segment{seg12}},
+		{"and none", And(), segments},
+		{"or", Or(as2, isd1), []segment.Segment{seg12, seg23, seg123, seg13}},
+		{"or none", Or(), []segment.Segment{}},
+		{"not", Not(isd1), []segment.Segment{seg23, seg123}},
+		{"nested", And(isd1, Not(as2)), []segment.Segment{seg13}},
+		{"double negation", Not(Not(isd1)), []segment.Segment{seg12, seg13}},
+		{"or of and", Or(And(isd1, as2), Not(Or(isd1, as2))), []segment.Segment{seg12}},
+	}
+	for _, test := range tests {
+		have := test.filter.Filter(segment.SegmentSet{Segments: segments}).Segments
+		if !equalSegments(have, test.want) {
+			t.Errorf("%s: want %v, have %v", test.name, test.want, have)
+		}
+	}
+}
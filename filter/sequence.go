@@ -8,7 +8,9 @@ import (
 )
 
 // FromSequence returns a segment.Filter that filters path segments according
-// to a given pathpol.Sequence policy.
+// to a given pathpol.Sequence policy. The sequence is matched against the
+// flattened path interfaces of a segment, so segment compositions are matched
+// as a whole, including the ISD-ASes where their subsegments are joined.
 func FromSequence(sequence pathpol.Sequence) segment.Filter {
 	return sequenceFilter{sequence: sequence}
 }
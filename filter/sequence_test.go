@@ -0,0 +1,73 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/pathpol"
+)
+
+func TestSequence(t *testing.T) {
+	segments := []segment.Segment{seg12, seg23, seg13, segment.FromSegments(seg12, seg23)}
+	tests := []struct {
+		pattern string
+		want    []segment.Segment
+	}{
+		{"1-ff00:0:1 1-ff00:0:2", []segment.Segment{seg12}},
+		{"1-ff00:0:1 0*", []segment.Segment{seg12, seg13, segments[3]}},
+		{"1-0+ 2-0", []segment.Segment{seg23, segments[3]}},
+		{"1-ff00:0:1#1 1-ff00:0:2#2,3 2-ff00:0:3#4", []segment.Segment{segments[3]}},
+		{"2-0 0*", []segment.Segment{}},
+	}
+	for _, test := range tests {
+		sequence, err := pathpol.NewSequence(test.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segset := FromSequence(*sequence).Filter(segment.SegmentSet{Segments: segments})
+		if !equalSegments(segset.Segments, test.want) {
+			t.Errorf("%q: want %v, have %v", test.pattern, test.want, segset.Segments)
+		}
+	}
+}
+
+func TestToPathPolicy(t *testing.T) {
+	segseg := segment.FromSegments(seg12, seg23)
+	segments := []segment.Segment{seg12, seg23, seg13, segseg}
+	tests := []struct {
+		accepted []segment.Segment
+		want     []segment.Segment
+	}{
+		{[]segment.Segment{seg12}, []segment.Segment{seg12}},
+		{[]segment.Segment{seg13, seg12}, []segment.Segment{seg12, seg13}},
+		{[]segment.Segment{segseg, seg23}, []segment.Segment{seg23, segseg}},
+		{[]segment.Segment{seg13, seg13}, []segment.Segment{seg13}},
+	}
+	for _, test := range tests {
+		policy, err := segment.ToPathPolicy(test.accepted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sequence, err := pathpol.NewSequence(policy)
+		if err != nil {
+			t.Fatalf("%q: %s", policy, err)
+		}
+		segset := FromSequence(*sequence).Filter(segment.SegmentSet{Segments: segments})
+		if !equalSegments(segset.Segments, test.want) {
+			t.Errorf("%q: want %v, have %v", policy, test.want, segset.Segments)
+		}
+	}
+	if policy, _ := segment.ToPathPolicy([]segment.Segment{seg12, seg12}); policy != "(1-ff00:0:1 1-ff00:0:2)" {
+		t.Errorf("want a single clause, have %q", policy)
+	}
+	seg121 := segment.FromSegments(seg12, segment.FromString("1-ff00:0:2 7>8 1-ff00:0:1"))
+	if policy, _ := segment.ToPathPolicy([]segment.Segment{seg121}); policy != "(1-ff00:0:1 1-ff00:0:2 1-ff00:0:1)" {
+		t.Errorf("want the revisited AS in the clause, have %q", policy)
+	}
+	if policy, err := segment.ToPathPolicy([]segment.Segment{}); err == nil {
+		t.Errorf("no segments: want an error, have %q", policy)
+	}
+	if policy, err := segment.ToPathPolicy([]segment.Segment{segment.FromInterfaces()}); err == nil {
+		t.Errorf("segment without interfaces: want an error, have %q", policy)
+	}
+}
@@ -0,0 +1,40 @@
+package filter
+
+import (
+	"sort"
+
+	"github.com/mblarer/conpass/segment"
+)
+
+// TopK returns a segment.Filter that keeps the k path segments with the
+// fewest hops, sorted by their number of hops. Ties are broken by fingerprint
+// to make the result deterministic.
+func TopK(k int) segment.Filter {
+	return topKFilter{k: k}
+}
+
+type topKFilter struct {
+	k int
+}
+
+func (tf topKFilter) Filter(segset segment.SegmentSet) segment.SegmentSet {
+	sorted := append([]segment.Segment(nil), segset.Segments...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Len() != sorted[j].Len() {
+			return sorted[i].Len() < sorted[j].Len()
+		}
+		return sorted[i].Fingerprint() < sorted[j].Fingerprint()
+	})
+	k := tf.k
+	if k < 0 {
+		k = 0
+	}
+	if k < len(sorted) {
+		sorted = sorted[:k]
+	}
+	return segment.SegmentSet{
+		Segments: sorted,
+		SrcIA:    segset.SrcIA,
+		DstIA:    segset.DstIA,
+	}
+}
@@ -0,0 +1,41 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/mblarer/conpass/segment"
+)
+
+func TestTopK(t *testing.T) {
+	seg123 := segment.FromSegments(seg12, seg23)
+	segments := []segment.Segment{seg123, seg23, seg12, seg13}
+	// seg12, seg23, and seg13 all have one hop, so they are ordered by
+	// fingerprint.
+	ties := []segment.Segment{seg12, seg23, seg13}
+	sortByFingerprint(ties)
+	tests := []struct {
+		k    int
+		want []segment.Segment
+	}{
+		{0, []segment.Segment{}},
+		{2, ties[:2]},
+		{3, ties},
+		{10, append(ties, seg123)},
+	}
+	for _, test := range tests {
+		have := TopK(test.k).Filter(segment.SegmentSet{Segments: segments}).Segments
+		if !equalSegments(have, test.want) {
+			t.Errorf("k=%d: want %v, have %v", test.k, test.want, have)
+		}
+	}
+}
+
+func sortByFingerprint(segments []segment.Segment) {
+	for i := range segments {
+		for j := i + 1; j < len(segments); j++ {
+			if segments[j].Fingerprint() < segments[i].Fingerprint() {
+				segments[i], segments[j] = segments[j], segments[i]
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package filter
+
+import "github.com/mblarer/conpass/segment"
+
+// Trace records the decisions of traced filters, e.g., to debug why a segment
+// was or was not accepted. A Trace is not safe for concurrent use.
+type Trace struct {
+	// Entries are the recorded decisions in the order in which they were
+	// made.
+	Entries []TraceEntry
+}
+
+// TraceEntry is the decision of a traced filter about one path segment.
+type TraceEntry struct {
+	// Filter is the name of the traced filter.
+	Filter string
+	// Segment is the path segment that the filter decided about.
+	Segment segment.Segment
+	// Accepted is true if the segment passed the filter.
+	Accepted bool
+	// Reason explains why the segment was rejected, if the filter implements
+	// Explainer.
+	Reason string
+}
+
+// Explainer is implemented by filters that can explain why they reject a
+// path segment.
+type Explainer interface {
+	// Explain returns the reason why the filter rejects the segment.
+	Explain(segment.Segment) string
+}
+
+// Traced returns a segment.Filter that applies the given filter and records in
+// the trace, for each of the input segments, whether it passed the filter.
+// Tracing is opt-in: filters that are not wrapped by Traced record nothing.
+func Traced(name string, filter segment.Filter, trace *Trace) segment.Filter {
+	return tracedFilter{name: name, filter: filter, trace: trace}
+}
+
+type tracedFilter struct {
+	name   string
+	filter segment.Filter
+	trace  *Trace
+}
+
+func (tf tracedFilter) Filter(segset segment.SegmentSet) segment.SegmentSet {
+	result := tf.filter.Filter(segset)
+	passed := make(map[string]bool, len(result.Segments))
+	for _, segment := range result.Segments {
+		passed[segment.Fingerprint()] = true
+	}
+	explainer, explains := tf.filter.(Explainer)
+	for _, segment := range segset.Segments {
+		entry := TraceEntry{Filter: tf.name, Segment: segment, Accepted: passed[segment.Fingerprint()]}
+		if !entry.Accepted && explains {
+			entry.Reason = explainer.Explain(segment)
+		}
+		tf.trace.Entries = append(tf.trace.Entries, entry)
+	}
+	return result
+}
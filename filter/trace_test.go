@@ -0,0 +1,44 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+func TestTraced(t *testing.T) {
+	var trace Trace
+	acl := Traced("acl", ACL{Deny: []addr.IA{mustIA(t, "1-ff00:0:2")}}, &trace)
+	top := Traced("top", TopK(1), &trace)
+	segments := []segment.Segment{seg12, seg13, seg23}
+	have := FromFilters(acl, top).Filter(segment.SegmentSet{Segments: segments}).Segments
+	if !equalSegments(have, []segment.Segment{seg13}) {
+		t.Fatal("want", seg13, "have", have)
+	}
+	want := []struct {
+		filter   string
+		segment  segment.Segment
+		accepted bool
+	}{
+		{"acl", seg12, false},
+		{"acl", seg13, true},
+		{"acl", seg23, false},
+		{"top", seg13, true},
+	}
+	if len(trace.Entries) != len(want) {
+		t.Fatal("want", len(want), "trace entries, have", len(trace.Entries))
+	}
+	for i, entry := range trace.Entries {
+		if entry.Filter != want[i].filter || entry.Segment.Fingerprint() != want[i].segment.Fingerprint() || entry.Accepted != want[i].accepted {
+			t.Error("entry", i, "want", want[i], "have", entry)
+		}
+		if entry.Accepted && entry.Reason != "" {
+			t.Error("entry", i, "has a reason but was accepted:", entry.Reason)
+		}
+	}
+	if reason := trace.Entries[0].Reason; !strings.Contains(reason, "1-ff00:0:2") {
+		t.Error("want rejection reason naming denied ISD-AS, have", reason)
+	}
+}
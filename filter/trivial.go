@@ -0,0 +1,31 @@
+package filter
+
+import "github.com/mblarer/conpass/segment"
+
+// AcceptAll returns a segment.Filter that keeps all path segments. It is the
+// identity of And.
+func AcceptAll() segment.Filter {
+	return acceptAllFilter{}
+}
+
+type acceptAllFilter struct{}
+
+func (acceptAllFilter) Filter(segset segment.SegmentSet) segment.SegmentSet {
+	return segset
+}
+
+// RejectAll returns a segment.Filter that keeps no path segments. It is the
+// identity of Or.
+func RejectAll() segment.Filter {
+	return rejectAllFilter{}
+}
+
+type rejectAllFilter struct{}
+
+func (rejectAllFilter) Filter(segset segment.SegmentSet) segment.SegmentSet {
+	return segment.SegmentSet{
+		Segments: []segment.Segment{},
+		SrcIA:    segset.SrcIA,
+		DstIA:    segset.DstIA,
+	}
+}
@@ -0,0 +1,38 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+func TestIdentities(t *testing.T) {
+	seg123 := segment.FromSegments(seg12, seg23)
+	segments := []segment.Segment{seg12, seg23, seg13, seg123}
+	isd1 := ACL{Deny: []addr.IA{{I: 2}}}
+	tests := []struct {
+		name   string
+		filter segment.Filter
+		want   segment.Filter
+	}{
+		{"accept all", AcceptAll(), FromPredicate(func(segment.Segment) bool { return true })},
+		{"reject all", RejectAll(), FromPredicate(func(segment.Segment) bool { return false })},
+		{"and identity", And(isd1, AcceptAll()), isd1},
+		{"and identity first", And(AcceptAll(), isd1), isd1},
+		{"and annihilator", And(isd1, RejectAll()), RejectAll()},
+		{"or identity", Or(isd1, RejectAll()), isd1},
+		{"or identity first", Or(RejectAll(), isd1), isd1},
+		{"or annihilator", Or(isd1, AcceptAll()), AcceptAll()},
+		{"not accept all", Not(AcceptAll()), RejectAll()},
+		{"not reject all", Not(RejectAll()), AcceptAll()},
+	}
+	for _, test := range tests {
+		segset := segment.SegmentSet{Segments: segments}
+		have := test.filter.Filter(segset).Segments
+		want := test.want.Filter(segset).Segments
+		if onlyHave, onlyWant, _ := segment.Diff(have, want); len(onlyHave) != 0 || len(onlyWant) != 0 {
+			t.Errorf("%s: want %v, have %v", test.name, want, have)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"math/rand"
+
 	"github.com/mblarer/conpass/segment"
 	"github.com/scionproto/scion/go/lib/addr"
 	"github.com/scionproto/scion/go/lib/common"
@@ -30,3 +32,44 @@ func generateSegment(seed, hops int, srcIA, dstIA addr.IA) segment.Segment {
 	interfaces[(hops-1)*2-1] = snet.PathInterface{ID: common.IFIDType(seed), IA: dstIA}
 	return segment.FromInterfaces(interfaces...)
 }
+
+// RandomSegment generates a random segment of at most the given depth, where a
+// segment literal has depth 1. The subsegments of a generated segment
+// composition are contiguous, i.e., every subsegment starts at the ISD-AS at
+// which the previous subsegment ends.
+func RandomSegment(r *rand.Rand, maxDepth int) segment.Segment {
+	return randomSegment(r, maxDepth, randomIA(r))
+}
+
+func randomSegment(r *rand.Rand, maxDepth int, srcIA addr.IA) segment.Segment {
+	if maxDepth <= 1 || r.Intn(2) == 0 {
+		return randomLiteral(r, srcIA)
+	}
+	subsegs := make([]segment.Segment, 1+r.Intn(3))
+	for i := range subsegs {
+		subsegs[i] = randomSegment(r, maxDepth-1, srcIA)
+		srcIA = subsegs[i].DstIA()
+	}
+	return segment.FromSegments(subsegs...)
+}
+
+func randomLiteral(r *rand.Rand, srcIA addr.IA) segment.Segment {
+	hops := 1 + r.Intn(4)
+	interfaces := make([]snet.PathInterface, 0, hops*2)
+	ia := srcIA
+	for i := 0; i < hops; i++ {
+		next := randomIA(r)
+		interfaces = append(interfaces,
+			snet.PathInterface{ID: common.IFIDType(1 + r.Intn(64)), IA: ia},
+			snet.PathInterface{ID: common.IFIDType(1 + r.Intn(64)), IA: next},
+		)
+		ia = next
+	}
+	return segment.FromInterfaces(interfaces...)
+}
+
+// randomIA returns one of a small number of ISD-AS addresses, such that
+// generated segments share ASes and interfaces.
+func randomIA(r *rand.Rand) addr.IA {
+	return addr.IA{I: addr.ISD(1 + r.Intn(2)), A: addr.AS(0xff0000000000 + r.Intn(8))}
+}
@@ -0,0 +1,30 @@
+package conpass
+
+// Logger receives the events of Clients and Servers, such as received offers,
+// accepted segments, and errors. Every event is a message followed by
+// alternating keys and values, e.g., "src" and the source ISD-AS of the
+// negotiated segments. The methods must be safe for concurrent use.
+type Logger interface {
+	// Debug logs events that are only of interest when debugging.
+	Debug(msg string, keyvals ...interface{})
+	// Info logs events of the regular operation.
+	Info(msg string, keyvals ...interface{})
+	// Warn logs failed negotiations.
+	Warn(msg string, keyvals ...interface{})
+}
+
+// nopLogger discards all events. It is used if no Logger is set.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+
+// loggerOrNop returns the logger, or a Logger that discards all events if the
+// logger is nil.
+func loggerOrNop(logger Logger) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+	return logger
+}
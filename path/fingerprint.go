@@ -1,8 +1,10 @@
 package path
 
 import (
-	"fmt"
-	"strings"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash"
 
 	"github.com/scionproto/scion/go/lib/snet"
 	"github.com/scionproto/scion/go/lib/snet/path"
@@ -17,9 +19,78 @@ func Fingerprint(spath snet.Path) string {
 	} else { // might copy metadata
 		meta = spath.Metadata()
 	}
-	var sb strings.Builder
-	for _, iface := range (*meta).Interfaces {
-		sb.WriteString(fmt.Sprintf(" %s#%d ", iface.IA, iface.ID))
+	return InterfacesFingerprint((*meta).Interfaces)
+}
+
+var newFingerprintHash = sha256.New
+
+// SetFingerprintHash sets the hash function that is used to compute
+// fingerprints. Passing nil restores the default, SHA-256. Fingerprints are
+// computed when segments are constructed and are never transmitted, so peers
+// may use different hash functions. Within one process, however, segments
+// constructed before and after changing the hash function cannot be compared
+// by fingerprint. This function should therefore only be called during
+// initialization, and it is not safe for concurrent use.
+func SetFingerprintHash(newHash func() hash.Hash) {
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	newFingerprintHash = newHash
+}
+
+// InterfacesFingerprint creates a unique string representation of a sequence
+// of path interfaces. It is the BytesFingerprint of the canonical bytes of the
+// segment literal that consists of the interfaces (see segment.CanonicalBytes):
+// the byte 0, followed by the 2-byte number of interfaces and by the
+// interfaces, each represented by its 8-byte interface ID followed by its
+// 8-byte ISD-AS address, all big-endian.
+func InterfacesFingerprint(interfaces []snet.PathInterface) string {
+	bytes := make([]byte, 3, 3+16*len(interfaces))
+	binary.BigEndian.PutUint16(bytes[1:], uint16(len(interfaces)))
+	var buf [16]byte
+	for _, iface := range interfaces {
+		binary.BigEndian.PutUint64(buf[:8], uint64(iface.ID))
+		binary.BigEndian.PutUint64(buf[8:], uint64(iface.IA.IAInt()))
+		bytes = append(bytes, buf[:]...)
+	}
+	return BytesFingerprint(bytes)
+}
+
+// BytesFingerprint returns the hex-encoded hash of a serialization, e.g., of
+// the canonical bytes of a segment. The hash function can be changed with
+// SetFingerprintHash.
+func BytesFingerprint(bytes []byte) string {
+	hash := newFingerprintHash()
+	hash.Write(bytes)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// UndirectedInterfacesFingerprint is like InterfacesFingerprint, but it does
+// not depend on the direction of the sequence of path interfaces: it is the
+// fingerprint of either the sequence or the reversed sequence, whichever has
+// the lexicographically smaller serialization.
+func UndirectedInterfacesFingerprint(interfaces []snet.PathInterface) string {
+	if !reverseIsSmaller(interfaces) {
+		return InterfacesFingerprint(interfaces)
+	}
+	reversed := make([]snet.PathInterface, len(interfaces))
+	for i, iface := range interfaces {
+		reversed[len(interfaces)-1-i] = iface
+	}
+	return InterfacesFingerprint(reversed)
+}
+
+// reverseIsSmaller reports whether the serialization of the reversed sequence
+// of interfaces is lexicographically smaller than that of the sequence.
+func reverseIsSmaller(interfaces []snet.PathInterface) bool {
+	for i, j := 0, len(interfaces)-1; i < j; i, j = i+1, j-1 {
+		forward, reverse := interfaces[i], interfaces[j]
+		if forward.ID != reverse.ID {
+			return uint64(reverse.ID) < uint64(forward.ID)
+		}
+		if forward.IA.IAInt() != reverse.IA.IAInt() {
+			return reverse.IA.IAInt() < forward.IA.IAInt()
+		}
 	}
-	return sb.String()
+	return false
 }
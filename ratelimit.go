@@ -0,0 +1,126 @@
+package conpass
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// ErrRateLimited means that an offer was rejected because its source ISD-AS
+// exceeded its rate limit.
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimiter limits the rate of offers per source ISD-AS with a token bucket
+// per ISD-AS: every offer takes a token, and the tokens are refilled at a
+// constant rate up to the burst size. A RateLimiter may be shared by multiple
+// Servers and is safe for concurrent use.
+//
+// The source ISD-AS is taken from the header of the offer, which the peer
+// chooses. Unless the transport authenticates the peer, or the Server verifies
+// that the offered segments are signed by the source ISD-AS (see
+// segment.VerifySignature), a peer can evade the limit by spoofing another
+// source ISD-AS, or use up the tokens of another ISD-AS. The limit is thus
+// advisory on its own. Moreover, a Server only learns the source ISD-AS by
+// decoding the offer, so an offer beyond the limit has already been decoded:
+// the limit saves the cost of filtering and responding, not of decoding, which
+// is bounded by the limits of the segment.Decoder instead.
+//
+// Since a peer may send offers from arbitrarily many source ISD-ASes, the
+// buckets are bounded in number: a bucket that has been refilled to the burst
+// size is dropped, as it is equivalent to a new bucket, and if MaxSources
+// buckets are in use, the least recently used bucket is dropped, which resets
+// the limit of its ISD-AS.
+type RateLimiter struct {
+	// MaxSources is the maximum number of source ISD-ASes whose buckets are
+	// kept (default: DefaultMaxSources).
+	MaxSources int
+	rate       float64
+	burst      int
+	now        func() time.Time
+	mutex      sync.Mutex
+	buckets    map[addr.IA]*list.Element
+	// lru orders the buckets from the least to the most recently used.
+	lru *list.List
+}
+
+// DefaultMaxSources is the default value for RateLimiter.MaxSources.
+const DefaultMaxSources = 1 << 16
+
+type tokenBucket struct {
+	ia     addr.IA
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a new RateLimiter that allows rate offers per second
+// and bursts of up to burst offers per source ISD-AS.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[addr.IA]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Allow reports whether an offer from the given source ISD-AS is within the
+// limit, in which case it takes a token of the ISD-AS.
+func (l *RateLimiter) Allow(ia addr.IA) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.dropRefilled(now)
+	element, ok := l.buckets[ia]
+	if ok {
+		l.lru.MoveToBack(element)
+	} else {
+		for l.lru.Len() >= l.maxSources() {
+			l.drop(l.lru.Front())
+		}
+		element = l.lru.PushBack(&tokenBucket{ia: ia, tokens: float64(l.burst), last: now})
+		l.buckets[ia] = element
+	}
+	bucket := element.Value.(*tokenBucket)
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > float64(l.burst) {
+		bucket.tokens = float64(l.burst)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// dropRefilled drops the buckets that were last used long enough ago to be
+// refilled to the burst size. These are the least recently used buckets, so
+// the cost is proportional to the number of dropped buckets.
+func (l *RateLimiter) dropRefilled(now time.Time) {
+	if l.rate <= 0 {
+		return
+	}
+	refill := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	for front := l.lru.Front(); front != nil; front = l.lru.Front() {
+		if now.Sub(front.Value.(*tokenBucket).last) < refill {
+			return
+		}
+		l.drop(front)
+	}
+}
+
+func (l *RateLimiter) drop(element *list.Element) {
+	l.lru.Remove(element)
+	delete(l.buckets, element.Value.(*tokenBucket).ia)
+}
+
+func (l *RateLimiter) maxSources() int {
+	if l.MaxSources == 0 {
+		return DefaultMaxSources
+	}
+	return l.MaxSources
+}
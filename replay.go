@@ -0,0 +1,84 @@
+package conpass
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mblarer/conpass/segment"
+)
+
+// ErrReplay means that an offer was rejected because it may be a replay of an
+// earlier offer.
+var ErrReplay = errors.New("replayed offer")
+
+// ReplayGuard detects replayed offers by the nonces that clients attach with
+// Client.ReplayProtection. It accepts an offer only if the time of its nonce
+// is within the window around the current time and if it has not seen the
+// nonce within the window before. A ReplayGuard may be shared by multiple
+// Servers and is safe for concurrent use.
+//
+// The nonce is not authenticated: it is covered by the checksum of the
+// message, which any peer can compute, but not by segment signatures, which
+// cover the segments only. An attacker who can modify offers in transit can
+// thus replace the nonce of a replayed offer with a fresh one. The
+// ReplayGuard only protects against replays if the transport authenticates
+// the messages, as QUIC with TLS does.
+type ReplayGuard struct {
+	window time.Duration
+	now    func() time.Time
+	mutex  sync.Mutex
+	seen   map[[8]byte]struct{}
+	// expiry orders the seen nonces by their time, so that the nonces which
+	// left the window can be forgotten without scanning all of them.
+	expiry nonceHeap
+}
+
+// NewReplayGuard creates a new ReplayGuard that tolerates the given clock
+// skew between clients and servers.
+func NewReplayGuard(window time.Duration) *ReplayGuard {
+	return &ReplayGuard{window: window, now: time.Now, seen: make(map[[8]byte]struct{})}
+}
+
+// Check returns an error wrapping ErrReplay if an offer with the given nonce
+// has to be rejected, and it remembers the nonce otherwise. The ok flag tells
+// whether the offer carries a nonce at all, see segment.Decoder.Nonce.
+func (g *ReplayGuard) Check(nonce segment.Nonce, ok bool) error {
+	if !ok {
+		return fmt.Errorf("%w: offer carries no nonce", ErrReplay)
+	}
+	now := g.now()
+	if skew := now.Sub(nonce.Time); skew > g.window || skew < -g.window {
+		return fmt.Errorf("%w: nonce time %s is outside of the window of %s", ErrReplay, nonce.Time, g.window)
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	// Nonces whose time is outside of the window cannot pass the check
+	// above anymore, so they need not be remembered.
+	for len(g.expiry) > 0 && now.Sub(g.expiry[0].Time) > g.window {
+		delete(g.seen, heap.Pop(&g.expiry).(segment.Nonce).Value)
+	}
+	if _, seen := g.seen[nonce.Value]; seen {
+		return fmt.Errorf("%w: nonce %x was seen before", ErrReplay, nonce.Value)
+	}
+	g.seen[nonce.Value] = struct{}{}
+	heap.Push(&g.expiry, nonce)
+	return nil
+}
+
+// nonceHeap is a min-heap of nonces by time, see container/heap.
+type nonceHeap []segment.Nonce
+
+func (h nonceHeap) Len() int            { return len(h) }
+func (h nonceHeap) Less(i, j int) bool  { return h[i].Time.Before(h[j].Time) }
+func (h nonceHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x interface{}) { *h = append(*h, x.(segment.Nonce)) }
+
+func (h *nonceHeap) Pop() interface{} {
+	old := *h
+	nonce := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return nonce
+}
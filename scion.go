@@ -0,0 +1,102 @@
+package conpass
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+	"github.com/scionproto/scion/go/lib/sock/reliable"
+	"github.com/scionproto/scion/go/lib/topology"
+)
+
+// DefaultSCIONPort is the well-known port of the CONPASS server on SCION, at
+// which DialSCIONAddr reaches it and on which ListenSCION listens unless
+// another port is given.
+const DefaultSCIONPort = 50000
+
+// DialSCIONAddr creates a Client that negotiates with the CONPASS server at the
+// given SCION address, such that the negotiation does not depend on another
+// network. There is no well-known host address of the server in an AS, so the
+// host is required, but its port defaults to DefaultSCIONPort if it is zero.
+// For the same reason, there is no DialSCION that reaches the server of an AS
+// by its ISD-AS alone; the address of the server has to be configured or
+// discovered otherwise.
+//
+// If the address has no path and the server is not in the local AS, the first
+// path that the daemon returns is used. The SCION connection is registered
+// with the default dispatcher, and the Client treats it as a datagram
+// connection, so its Retry policy applies. The connection is closed with
+// Client.Close.
+func DialSCIONAddr(ctx context.Context, daemon sciond.Connector, remote *snet.UDPAddr) (*Client, error) {
+	localIA, err := daemon.LocalIA(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query local ISD-AS: %s", err.Error())
+	}
+	if remote.Host == nil || remote.Host.IP == nil {
+		return nil, fmt.Errorf("no host address of the server in %s", remote.IA)
+	}
+	remote = remote.Copy()
+	if remote.Host.Port == 0 {
+		remote.Host.Port = DefaultSCIONPort
+	}
+	if remote.IA.Equal(localIA) {
+		remote.NextHop = &net.UDPAddr{IP: remote.Host.IP, Port: topology.EndhostPort}
+	} else if remote.Path.IsEmpty() {
+		paths, err := daemon.Paths(ctx, remote.IA, localIA, sciond.PathReqFlags{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query paths to %s: %s", remote.IA, err.Error())
+		}
+		if len(paths) == 0 {
+			return nil, fmt.Errorf("no path to %s", remote.IA)
+		}
+		remote.Path, remote.NextHop = paths[0].Path(), paths[0].UnderlayNextHop()
+	}
+	localIP, err := localIPTo(remote.NextHop)
+	if err != nil {
+		return nil, err
+	}
+	network := newSCIONNetwork(localIA, daemon)
+	conn, err := network.Dial(ctx, "udp", &net.UDPAddr{IP: localIP}, remote, addr.SvcNone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %s", remote, err.Error())
+	}
+	return NewClient(conn), nil
+}
+
+// ListenSCION creates a SCION connection on which a Server can serve offers
+// with ServePacket. It listens at the given address of the local AS, or at
+// DefaultSCIONPort if the port is zero, and it is registered with the default
+// dispatcher.
+func ListenSCION(ctx context.Context, daemon sciond.Connector, listen *net.UDPAddr) (*snet.Conn, error) {
+	localIA, err := daemon.LocalIA(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query local ISD-AS: %s", err.Error())
+	}
+	if listen.Port == 0 {
+		listen = &net.UDPAddr{IP: listen.IP, Port: DefaultSCIONPort, Zone: listen.Zone}
+	}
+	conn, err := newSCIONNetwork(localIA, daemon).Listen(ctx, "udp", listen, addr.SvcNone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen at %s: %s", listen, err.Error())
+	}
+	return conn, nil
+}
+
+func newSCIONNetwork(localIA addr.IA, daemon sciond.Connector) *snet.SCIONNetwork {
+	dispatcher := reliable.NewDispatcher(reliable.DefaultDispPath)
+	return snet.NewNetwork(localIA, dispatcher, sciond.RevHandler{Connector: daemon})
+}
+
+// localIPTo returns the local IP address from which the host sends traffic to
+// the next hop, since snet cannot bind to wildcard addresses.
+func localIPTo(nextHop *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp", nil, nextHop)
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine local address: %s", err.Error())
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
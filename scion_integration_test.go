@@ -0,0 +1,59 @@
+//go:build integration
+// +build integration
+
+package conpass
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/sciond"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// TestDialSCIONAddr negotiates with a server in the local AS over SCION. It needs
+// the daemon and the dispatcher of a local topology, e.g., of the SCIONLab
+// development setup. The daemon address is taken from SCION_DAEMON_ADDRESS.
+func TestDialSCIONAddr(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	address, ok := os.LookupEnv("SCION_DAEMON_ADDRESS")
+	if !ok {
+		address = sciond.DefaultAPIAddress
+	}
+	daemon, err := sciond.NewService(address).Connect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer daemon.Close(ctx)
+	localIA, err := daemon.LocalIA(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := net.ParseIP("127.0.0.1")
+	sconn, err := ListenSCION(ctx, daemon, &net.UDPAddr{IP: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	servectx, stop := context.WithCancel(ctx)
+	defer stop()
+	go (&Server{}).ServePacket(servectx, sconn)
+
+	client, err := DialSCIONAddr(ctx, daemon, &snet.UDPAddr{IA: localIA, Host: &net.UDPAddr{IP: host}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	segments := []segment.Segment{segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	accepted, err := client.Negotiate(ctx, segments, localIA, addr.IA{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(accepted, segments, t)
+}
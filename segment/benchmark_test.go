@@ -0,0 +1,130 @@
+package segment
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// benchmarkInput is a set of new segments that the encoding benchmarks encode
+// and decode. The inputs cover small, medium, and large sets of segments, both
+// as plain literals and as compositions of literals. The deep inputs consist
+// of deeply nested compositions, which stress the recursive traversal of
+// subsegments during encoding.
+type benchmarkInput struct {
+	name     string
+	segments []Segment
+}
+
+func benchmarkInputs() []benchmarkInput {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	var inputs []benchmarkInput
+	for _, n := range []int{10, 100, 1000} {
+		literals := generateLiterals(n, 6, srcIA, dstIA)
+		inputs = append(inputs,
+			benchmarkInput{"literals/" + strconv.Itoa(n), literals},
+			benchmarkInput{"compositions/" + strconv.Itoa(n), generateCompositions(literals)},
+		)
+	}
+	inputs = append(inputs, benchmarkInput{"deep/1000", generateDeepCompositions(generateLiterals(1000, 6, srcIA, dstIA), DefaultMaxDepth)})
+	return inputs
+}
+
+func BenchmarkDecodeSegments(b *testing.B) {
+	for _, input := range benchmarkInputs() {
+		msg, _, err := EncodeSegments(input.segments, []Segment{}, addr.IA{}, addr.IA{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(input.name, func(b *testing.B) {
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, _, _, err := DecodeSegments(msg, []Segment{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecoderReuseInterfaces compares decoding with and without reusing
+// the scratch buffer for the interfaces of decoded literals.
+func BenchmarkDecoderReuseInterfaces(b *testing.B) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	msg, _, err := EncodeSegments(generateLiterals(1000, 6, srcIA, dstIA), []Segment{}, srcIA, dstIA)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, reuse := range []bool{false, true} {
+		b.Run("reuse="+strconv.FormatBool(reuse), func(b *testing.B) {
+			stream := bytes.NewReader(msg)
+			decoder := NewDecoder(stream)
+			decoder.ReuseInterfaces = reuse
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				stream.Reset(msg)
+				if _, _, _, _, err := decoder.Decode([]Segment{}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDecodeSegmentsInto compares decoding into fresh slices with
+// decoding into slices that are reused across messages.
+func BenchmarkDecodeSegmentsInto(b *testing.B) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	msg, _, err := EncodeSegments(generateLiterals(1000, 6, srcIA, dstIA), []Segment{}, srcIA, dstIA)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, reuse := range []bool{false, true} {
+		b.Run("reuse="+strconv.FormatBool(reuse), func(b *testing.B) {
+			var newsegs, accsegs []Segment
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if !reuse {
+					newsegs, accsegs = nil, nil
+				}
+				newsegs, accsegs, _, _, err = DecodeSegmentsInto(newsegs, accsegs, msg, []Segment{})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// generateCompositions composes every literal with its successor, such that
+// the compositions share their subsegments.
+func generateCompositions(literals []Segment) []Segment {
+	segments := make([]Segment, len(literals))
+	for i := range literals {
+		segments[i] = FromSegments(literals[i], literals[(i+1)%len(literals)])
+	}
+	return segments
+}
+
+// generateDeepCompositions nests the literals into compositions of the given
+// depth, where every composition consists of the previous composition and the
+// next literal. The depth should not exceed the decoding limit.
+func generateDeepCompositions(literals []Segment, depth int) []Segment {
+	var segments []Segment
+	for i := 0; i+depth <= len(literals); i += depth {
+		composition := literals[i]
+		for j := 1; j < depth; j++ {
+			composition = FromSegments(composition, literals[i+j])
+		}
+		segments = append(segments, composition)
+	}
+	return segments
+}
@@ -0,0 +1,72 @@
+package segment
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CompositionBuilder builds a segment composition from a chain of subsegments
+// and checks that every added subsegment starts at the ISD-AS at which the
+// previous subsegment ends. The zero value is an empty builder.
+type CompositionBuilder struct {
+	segments []Segment
+}
+
+// Add appends a subsegment to the composition. It returns an error and leaves
+// the composition unchanged if the subsegment has no interfaces or does not
+// start at the ISD-AS at which the composition currently ends.
+func (b *CompositionBuilder) Add(segment Segment) error {
+	if len(segment.PathInterfaces()) == 0 {
+		return fmt.Errorf("subsegment %d has no interfaces", len(b.segments))
+	}
+	if len(b.segments) > 0 {
+		tail := b.segments[len(b.segments)-1]
+		if tail.DstIA() != segment.SrcIA() {
+			return fmt.Errorf("subsegment %d starts at %s, but subsegment %d ends at %s",
+				len(b.segments), segment.SrcIA(), len(b.segments)-1, tail.DstIA())
+		}
+	}
+	b.segments = append(b.segments, segment)
+	return nil
+}
+
+// Build returns the composition of the added subsegments, or an error if no
+// subsegments were added, since a composition without subsegments has neither
+// a source nor a destination ISD-AS. The builder may be used to add further
+// subsegments afterwards, which does not affect the returned composition.
+func (b *CompositionBuilder) Build() (Composition, error) {
+	if len(b.segments) == 0 {
+		return Composition{}, errors.New("composition has no subsegments")
+	}
+	return FromSegments(b.segments...).(Composition), nil
+}
+
+// Flatten simplifies a segment composition whose subsegments are literals that
+// join like in a CompositionBuilder into a single literal. Other compositions
+// are flattened recursively, such that they are simplified as far as
+// possible. The path interfaces of the result are exactly the path interfaces
+// of the segment. A literal that replaces a composition keeps the options of
+// the composition, whereas the options of its subsegments are dropped.
+func Flatten(segment Segment) Segment {
+	composition, ok := segment.(Composition)
+	if !ok {
+		return segment
+	}
+	subsegs := make([]Segment, len(composition.Segments))
+	var builder CompositionBuilder
+	mergeable := len(subsegs) > 0
+	for i, subseg := range composition.Segments {
+		subsegs[i] = Flatten(subseg)
+		if _, ok := subsegs[i].(Literal); !ok || builder.Add(subsegs[i]) != nil {
+			mergeable = false
+		}
+	}
+	if mergeable {
+		literal := literalOf(composition.PathInterfaces())
+		literal.Options = composition.Options
+		return literal
+	}
+	flattened := FromSegments(subsegs...).(Composition)
+	flattened.Options = composition.Options
+	return flattened
+}
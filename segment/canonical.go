@@ -0,0 +1,63 @@
+package segment
+
+import (
+	"encoding/binary"
+
+	"github.com/mblarer/conpass/path"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// CanonicalBytes returns a self-contained serialization of a segment. Unlike
+// the wire format, in which compositions refer to their subsegments by ids
+// that depend on the negotiation, the canonical bytes of a composition contain
+// the canonical bytes of its subsegments. The same segment therefore always
+// yields the same canonical bytes, and two segments have the same canonical
+// bytes if and only if they are equal. Segment options are not part of the
+// canonical bytes.
+//
+// A segment literal is serialized as the byte 0, followed by its 2-byte number
+// of interfaces and by the interfaces, each represented by its 8-byte
+// interface ID followed by its 8-byte ISD-AS address. A segment composition is
+// serialized as the byte 1, followed by its 2-byte number of subsegments and
+// by the canonical bytes of the subsegments. All integers are big-endian.
+//
+// The fingerprint of a segment is the hash over the canonical bytes of its
+// flattened path, i.e., of the equivalent literal, so that a composition and
+// the equivalent literal share the same fingerprint (see fingerprintOf).
+func CanonicalBytes(segment Segment) []byte {
+	return appendCanonical(nil, segment)
+}
+
+// fingerprintOf returns the fingerprint of the segment that consists of the
+// given path interfaces, i.e., the path.BytesFingerprint of the canonical
+// bytes of the equivalent literal. It agrees with path.InterfacesFingerprint,
+// so that segments can be compared with snet paths by fingerprint.
+func fingerprintOf(interfaces []snet.PathInterface) string {
+	return path.BytesFingerprint(appendCanonicalLiteral(make([]byte, 0, 3+16*len(interfaces)), interfaces))
+}
+
+func appendCanonical(bytes []byte, segment Segment) []byte {
+	switch s := segment.(type) {
+	case Composition:
+		bytes = append(bytes, 1, 0, 0)
+		binary.BigEndian.PutUint16(bytes[len(bytes)-2:], uint16(len(s.Segments)))
+		for _, subseg := range s.Segments {
+			bytes = appendCanonical(bytes, subseg)
+		}
+	default:
+		bytes = appendCanonicalLiteral(bytes, segment.PathInterfaces())
+	}
+	return bytes
+}
+
+func appendCanonicalLiteral(bytes []byte, interfaces []snet.PathInterface) []byte {
+	bytes = append(bytes, 0, 0, 0)
+	binary.BigEndian.PutUint16(bytes[len(bytes)-2:], uint16(len(interfaces)))
+	var buf [16]byte
+	for _, iface := range interfaces {
+		binary.BigEndian.PutUint64(buf[:8], uint64(iface.ID))
+		binary.BigEndian.PutUint64(buf[8:], uint64(iface.IA.IAInt()))
+		bytes = append(bytes, buf[:]...)
+	}
+	return bytes
+}
@@ -0,0 +1,414 @@
+package segment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// The CBOR (RFC 8949) representation of a segment mirrors its JSON
+// representation: a segment is a map with a "type" key whose value is either
+// "literal" or "composition". A literal has an "interfaces" array of maps with
+// an "ia" text and an "id" unsigned integer, and a composition has a non-empty
+// "segments" array of segments. Both may have an "options" array of maps with
+// a "type" unsigned integer and a "value" byte string. Empty arrays are
+// omitted, and map keys are sorted in the canonical CBOR order, such that the
+// representation of a segment is deterministic. The CBOR representation is
+// meant for archival and for interoperability, not for negotiation.
+
+const (
+	cborUint  byte = 0
+	cborBytes byte = 2
+	cborText  byte = 3
+	cborArray byte = 4
+	cborMap   byte = 5
+)
+
+// maxCBORNesting bounds the nesting of decoded CBOR values, such that
+// malicious input cannot exhaust the stack.
+const maxCBORNesting = 4*DefaultMaxDepth + 4
+
+// FromCBOR creates a new Segment from its CBOR representation as produced by
+// MarshalCBOR. The concrete type of the segment is determined by the "type"
+// key of the CBOR map.
+func FromCBOR(data []byte) (Segment, error) {
+	value, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+	return fromCBORValue(value)
+}
+
+func (l Literal) MarshalCBOR() ([]byte, error) {
+	return appendCBORSegment(nil, l)
+}
+
+func (l *Literal) UnmarshalCBOR(data []byte) error {
+	value, err := decodeCBOR(data)
+	if err != nil {
+		return err
+	}
+	return l.fromCBORValue(value)
+}
+
+func (l *Literal) fromCBORValue(value interface{}) error {
+	m, segtype, err := cborSegmentMap(value)
+	if err != nil {
+		return err
+	}
+	if segtype != jsonTypeLiteral {
+		return fmt.Errorf("cannot unmarshal segment of type %q into literal", segtype)
+	}
+	values, err := cborArrayOf(m["interfaces"], "interfaces")
+	if err != nil {
+		return err
+	}
+	interfaces := make([]snet.PathInterface, len(values))
+	for i, value := range values {
+		iface, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("interface %d is not a map", i)
+		}
+		iastr, ok := iface["ia"].(string)
+		if !ok {
+			return fmt.Errorf("interface %d has no ISD-AS text", i)
+		}
+		ia, err := addr.IAFromString(iastr)
+		if err != nil {
+			return err
+		}
+		id, ok := iface["id"].(uint64)
+		if !ok {
+			return fmt.Errorf("interface %d has no unsigned interface id", i)
+		}
+		interfaces[i] = snet.PathInterface{ID: common.IFIDType(id), IA: ia}
+	}
+	options, err := fromCBOROptions(m["options"])
+	if err != nil {
+		return err
+	}
+	*l = FromInterfaces(interfaces...).(Literal)
+	l.Options = options
+	return nil
+}
+
+func (c Composition) MarshalCBOR() ([]byte, error) {
+	return appendCBORSegment(nil, c)
+}
+
+func (c *Composition) UnmarshalCBOR(data []byte) error {
+	value, err := decodeCBOR(data)
+	if err != nil {
+		return err
+	}
+	return c.fromCBORValue(value)
+}
+
+func (c *Composition) fromCBORValue(value interface{}) error {
+	m, segtype, err := cborSegmentMap(value)
+	if err != nil {
+		return err
+	}
+	if segtype != jsonTypeComposition {
+		return fmt.Errorf("cannot unmarshal segment of type %q into composition", segtype)
+	}
+	values, err := cborArrayOf(m["segments"], "segments")
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return errors.New("composition has no segments")
+	}
+	segments := make([]Segment, len(values))
+	for i, value := range values {
+		segment, err := fromCBORValue(value)
+		if err != nil {
+			return err
+		}
+		segments[i] = segment
+	}
+	options, err := fromCBOROptions(m["options"])
+	if err != nil {
+		return err
+	}
+	*c = FromSegments(segments...).(Composition)
+	c.Options = options
+	return nil
+}
+
+func fromCBORValue(value interface{}) (Segment, error) {
+	_, segtype, err := cborSegmentMap(value)
+	if err != nil {
+		return nil, err
+	}
+	switch segtype {
+	case jsonTypeLiteral:
+		var l Literal
+		err := l.fromCBORValue(value)
+		return l, err
+	case jsonTypeComposition:
+		var c Composition
+		err := c.fromCBORValue(value)
+		return c, err
+	}
+	return nil, fmt.Errorf("unknown segment type %q", segtype)
+}
+
+// cborSegmentMap returns the map that represents a segment and its type.
+func cborSegmentMap(value interface{}) (map[string]interface{}, string, error) {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, "", errors.New("segment is not a map")
+	}
+	segtype, ok := m["type"].(string)
+	if !ok {
+		return nil, "", errors.New("segment has no type text")
+	}
+	return m, segtype, nil
+}
+
+// cborArrayOf returns the elements of an array value, where a missing value
+// is an empty array.
+func cborArrayOf(value interface{}, name string) ([]interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not an array", name)
+	}
+	return values, nil
+}
+
+func fromCBOROptions(value interface{}) ([]Option, error) {
+	values, err := cborArrayOf(value, "options")
+	if err != nil {
+		return nil, err
+	}
+	options := make([]Option, len(values))
+	for i, value := range values {
+		option, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("option %d is not a map", i)
+		}
+		optype, ok := option["type"].(uint64)
+		if !ok || optype > 0xff {
+			return nil, fmt.Errorf("option %d has no 1-byte type", i)
+		}
+		optvalue, ok := option["value"].([]byte)
+		if !ok {
+			return nil, fmt.Errorf("option %d has no byte string value", i)
+		}
+		options[i] = Option{Type: uint8(optype), Value: optvalue}
+	}
+	return options, nil
+}
+
+// appendCBORSegment appends the CBOR representation of a segment. The keys
+// of every map are appended in the canonical order, i.e., shorter keys first.
+func appendCBORSegment(bytes []byte, segment Segment) ([]byte, error) {
+	switch s := segment.(type) {
+	case Literal:
+		bytes = appendCBORHead(bytes, cborMap, cborEntries(len(s.Options), len(s.Interfaces)))
+		bytes = appendCBORText(bytes, "type")
+		bytes = appendCBORText(bytes, jsonTypeLiteral)
+		bytes = appendCBOROptions(bytes, s.Options)
+		if len(s.Interfaces) > 0 {
+			bytes = appendCBORText(bytes, "interfaces")
+			bytes = appendCBORHead(bytes, cborArray, uint64(len(s.Interfaces)))
+			for _, iface := range s.Interfaces {
+				bytes = appendCBORHead(bytes, cborMap, 2)
+				bytes = appendCBORText(bytes, "ia")
+				bytes = appendCBORText(bytes, iface.IA.String())
+				bytes = appendCBORText(bytes, "id")
+				bytes = appendCBORHead(bytes, cborUint, uint64(iface.ID))
+			}
+		}
+	case Composition:
+		bytes = appendCBORHead(bytes, cborMap, cborEntries(len(s.Options), len(s.Segments)))
+		bytes = appendCBORText(bytes, "type")
+		bytes = appendCBORText(bytes, jsonTypeComposition)
+		bytes = appendCBOROptions(bytes, s.Options)
+		if len(s.Segments) > 0 {
+			bytes = appendCBORText(bytes, "segments")
+			bytes = appendCBORHead(bytes, cborArray, uint64(len(s.Segments)))
+			for _, subseg := range s.Segments {
+				var err error
+				if bytes, err = appendCBORSegment(bytes, subseg); err != nil {
+					return nil, err
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("cannot marshal segment of type %T", segment)
+	}
+	return bytes, nil
+}
+
+// cborEntries returns the number of entries of a segment map, which has a
+// type and may have an options array and an array of interfaces or segments,
+// where empty arrays are omitted.
+func cborEntries(numopts, numelems int) uint64 {
+	entries := uint64(1)
+	if numopts > 0 {
+		entries++
+	}
+	if numelems > 0 {
+		entries++
+	}
+	return entries
+}
+
+func appendCBOROptions(bytes []byte, options []Option) []byte {
+	if len(options) == 0 {
+		return bytes
+	}
+	bytes = appendCBORText(bytes, "options")
+	bytes = appendCBORHead(bytes, cborArray, uint64(len(options)))
+	for _, option := range options {
+		bytes = appendCBORHead(bytes, cborMap, 2)
+		bytes = appendCBORText(bytes, "type")
+		bytes = appendCBORHead(bytes, cborUint, uint64(option.Type))
+		bytes = appendCBORText(bytes, "value")
+		bytes = appendCBORHead(bytes, cborBytes, uint64(len(option.Value)))
+		bytes = append(bytes, option.Value...)
+	}
+	return bytes
+}
+
+func appendCBORText(bytes []byte, text string) []byte {
+	bytes = appendCBORHead(bytes, cborText, uint64(len(text)))
+	return append(bytes, text...)
+}
+
+// appendCBORHead appends the initial bytes of a data item with the given
+// major type and argument in the shortest form.
+func appendCBORHead(bytes []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(bytes, major|byte(n))
+	case n <= 0xff:
+		return append(bytes, major|24, byte(n))
+	case n <= 0xffff:
+		return append(bytes, major|25, byte(n>>8), byte(n))
+	case n <= 0xffffffff:
+		bytes = append(bytes, major|26, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(bytes[len(bytes)-4:], uint32(n))
+		return bytes
+	default:
+		bytes = append(bytes, major|27, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(bytes[len(bytes)-8:], n)
+		return bytes
+	}
+}
+
+// decodeCBOR decodes the subset of CBOR that is used to represent segments:
+// unsigned integers, byte strings, text strings, arrays, and maps with text
+// keys, all of definite length. They are decoded into uint64, []byte, string,
+// []interface{}, and map[string]interface{} values, respectively. Maps with
+// duplicate keys are rejected, since RFC 8949 does not define which value
+// applies.
+func decodeCBOR(data []byte) (interface{}, error) {
+	value, n, err := decodeCBORValue(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(data) {
+		return nil, fmt.Errorf("%d trailing bytes after CBOR value", len(data)-n)
+	}
+	return value, nil
+}
+
+func decodeCBORValue(data []byte, nesting int) (interface{}, int, error) {
+	if nesting > maxCBORNesting {
+		return nil, 0, fmt.Errorf("CBOR nesting exceeds limit of %d", maxCBORNesting)
+	}
+	major, arg, n, err := decodeCBORHead(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch major {
+	case cborUint:
+		return arg, n, nil
+	case cborBytes, cborText:
+		if arg > uint64(len(data)-n) {
+			return nil, 0, fmt.Errorf("%w: CBOR string of length %d exceeds buffer", ErrShortBuffer, arg)
+		}
+		end := n + int(arg)
+		if major == cborText {
+			return string(data[n:end]), end, nil
+		}
+		return append([]byte{}, data[n:end]...), end, nil
+	case cborArray:
+		// Every element occupies at least one byte, which bounds the
+		// allocation by the size of the buffer.
+		if arg > uint64(len(data)-n) {
+			return nil, 0, fmt.Errorf("%w: CBOR array of length %d exceeds buffer", ErrShortBuffer, arg)
+		}
+		values := make([]interface{}, arg)
+		for i := range values {
+			value, m, err := decodeCBORValue(data[n:], nesting+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values[i], n = value, n+m
+		}
+		return values, n, nil
+	case cborMap:
+		if arg > uint64(len(data)-n)/2 {
+			return nil, 0, fmt.Errorf("%w: CBOR map of length %d exceeds buffer", ErrShortBuffer, arg)
+		}
+		values := make(map[string]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			key, m, err := decodeCBORValue(data[n:], nesting+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			text, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("CBOR map key is not a text string")
+			}
+			if _, ok := values[text]; ok {
+				return nil, 0, fmt.Errorf("duplicate CBOR map key %q", text)
+			}
+			n += m
+			value, m, err := decodeCBORValue(data[n:], nesting+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values[text], n = value, n+m
+		}
+		return values, n, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported CBOR major type %d", major)
+	}
+}
+
+// decodeCBORHead decodes the initial bytes of a data item. It returns the
+// major type, the argument, and the number of decoded bytes.
+func decodeCBORHead(data []byte) (byte, uint64, int, error) {
+	if len(data) < 1 {
+		return 0, 0, 0, fmt.Errorf("%w: CBOR data item is missing", ErrShortBuffer)
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	if info < 24 {
+		return major, uint64(info), 1, nil
+	}
+	if info > 27 {
+		return 0, 0, 0, fmt.Errorf("unsupported CBOR additional information %d", info)
+	}
+	size := 1 << (info - 24)
+	if len(data) < 1+size {
+		return 0, 0, 0, fmt.Errorf("%w: CBOR argument of %d bytes exceeds buffer", ErrShortBuffer, size)
+	}
+	var arg uint64
+	for _, b := range data[1 : 1+size] {
+		arg = arg<<8 | uint64(b)
+	}
+	return major, arg, 1 + size, nil
+}
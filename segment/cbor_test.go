@@ -0,0 +1,92 @@
+package segment
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestCBORRoundTrip(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102 2>1 17-ffaa:0:1107")
+	signed := a.(Literal)
+	signed.Options = []Option{{Type: OptionTypeSignature, Value: make([]byte, 64)}}
+	for _, segment := range []Segment{a, signed, FromSegments(a, b), FromSegments(FromSegments(a, b), c)} {
+		data, err := segment.(interface{ MarshalCBOR() ([]byte, error) }).MarshalCBOR()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := FromCBOR(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Fingerprint() != segment.Fingerprint() || !decoded.Equal(segment) {
+			t.Error("want:", segment, "have:", decoded)
+		}
+		if !bytes.Equal(CanonicalBytes(decoded), CanonicalBytes(segment)) {
+			t.Error("structure of", segment, "changed to", decoded)
+		}
+		if len(Signature(decoded)) != len(Signature(segment)) {
+			t.Error("options of", segment, "changed to", decoded)
+		}
+	}
+}
+
+func TestCBORFormat(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>2 19-ffaa:0:1302")
+	data, err := FromSegments(a).(Composition).MarshalCBOR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// {"type": "composition", "segments": [{"type": "literal", "interfaces":
+	// [{"ia": "19-ffaa:0:1303", "id": 1}, {"ia": "19-ffaa:0:1302", "id": 2}]}]}
+	want := "a2" + "6474797065" + "6b636f6d706f736974696f6e" + "687365676d656e7473" + "81" +
+		"a2" + "6474797065" + "676c69746572616c" + "6a696e7465726661636573" + "82" +
+		"a2" + "626961" + "6e31392d666661613a303a31333033" + "626964" + "01" +
+		"a2" + "626961" + "6e31392d666661613a303a31333032" + "626964" + "02"
+	if have := hex.EncodeToString(data); have != want {
+		t.Error("want:", want, "have:", have)
+	}
+	var literal Literal
+	if err := literal.UnmarshalCBOR(data); err == nil || !strings.Contains(err.Error(), "composition") {
+		t.Error("unmarshaling composition into literal: want error, have:", err)
+	}
+	var composition Composition
+	if err := composition.UnmarshalCBOR(data); err != nil || !composition.Equal(FromSegments(a)) {
+		t.Error("want:", FromSegments(a), "have:", composition, err)
+	}
+	for n := 0; n < len(data); n++ {
+		if _, err := FromCBOR(data[:n]); err == nil {
+			t.Error("truncated to", n, "bytes: want error, have nil")
+		}
+	}
+}
+
+func TestCBORMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		// {"type": "literal", "type": "composition"}
+		{"duplicate key", "a2" + "6474797065" + "676c69746572616c" + "6474797065" + "6b636f6d706f736974696f6e"},
+		// {"type": "composition"}
+		{"empty composition", "a1" + "6474797065" + "6b636f6d706f736974696f6e"},
+		// {"type": "composition", "segments": []}
+		{"empty segments array", "a2" + "6474797065" + "6b636f6d706f736974696f6e" + "687365676d656e7473" + "80"},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if segment, err := FromCBOR(data); err == nil {
+			t.Errorf("%s: want error, have %v", test.name, segment)
+		}
+		var composition Composition
+		if err := composition.UnmarshalCBOR(data); err == nil {
+			t.Errorf("%s: want error when unmarshaling into composition, have nil", test.name)
+		}
+	}
+}
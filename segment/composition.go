@@ -1,6 +1,7 @@
 package segment
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/scionproto/scion/go/lib/addr"
@@ -8,26 +9,137 @@ import (
 )
 
 // FromSegments creates a new Segment from a sequence of pointers to segments.
-// The segments slice is copied to prevent problems with shared slices.
+// The segments slice is copied to prevent problems with shared slices. The
+// fingerprint of a composition only depends on its path interfaces, so that it
+// is identical to the fingerprint of the equivalent segment literal.
+//
+// The flattened path interfaces, the depth, and the number of segments of the
+// expanded composition are derived from those of the direct subsegments and
+// kept with the composition, so that construction does not traverse the whole
+// subtree again, which would take exponential time for compositions that
+// refer to the same subsegments many times.
 func FromSegments(segments ...Segment) Segment {
-	var sb strings.Builder
+	composition := Composition{Segments: append([]Segment(nil), segments...), depth: 1, nodes: 1}
+	ifcount := 0
 	for _, segment := range segments {
-		sb.WriteString(segment.Fingerprint())
+		ifcount += interfaceCount(segment)
 	}
-	return Composition{
-		Segments:    append([]Segment(nil), segments...),
-		fingerprint: sb.String(),
+	composition.interfaces = make([]snet.PathInterface, 0, ifcount)
+	for _, segment := range segments {
+		composition.interfaces = appendPathInterfaces(composition.interfaces, segment)
+		depth, nodes := expandedShape(segment)
+		if depth >= composition.depth {
+			composition.depth = depth + 1
+		}
+		composition.nodes += nodes
+	}
+	composition.fingerprint = fingerprintOf(composition.interfaces)
+	return composition
+}
+
+// interfaceCount returns the number of path interfaces of a segment without
+// flattening compositions that were constructed by FromSegments.
+func interfaceCount(segment Segment) int {
+	switch s := segment.(type) {
+	case Literal:
+		return len(s.Interfaces)
+	case Composition:
+		if s.interfaces != nil {
+			return len(s.interfaces)
+		}
+	}
+	return len(segment.PathInterfaces())
+}
+
+// appendPathInterfaces appends the path interfaces of a segment like
+// PathInterfaces, but without copying them first.
+func appendPathInterfaces(interfaces []snet.PathInterface, segment Segment) []snet.PathInterface {
+	switch s := segment.(type) {
+	case Literal:
+		return append(interfaces, s.Interfaces...)
+	case Composition:
+		if s.interfaces != nil {
+			return append(interfaces, s.interfaces...)
+		}
+	}
+	return append(interfaces, segment.PathInterfaces()...)
+}
+
+// expandedShape returns the depth of a segment and the number of segments of
+// its expanded form, i.e., 1 for a segment literal and 1 plus the numbers of
+// the subsegments for a segment composition.
+func expandedShape(segment Segment) (depth, nodes int) {
+	composition, ok := segment.(Composition)
+	if !ok {
+		return segment.Depth(), 1
+	}
+	if composition.interfaces != nil {
+		return composition.depth, composition.nodes
+	}
+	nodes = 1
+	for _, subseg := range composition.Segments {
+		subdepth, subnodes := expandedShape(subseg)
+		if subdepth > depth {
+			depth = subdepth
+		}
+		nodes += subnodes
+	}
+	return depth + 1, nodes
+}
+
+// FromSegmentIDs creates a new segment composition whose subsegments are the
+// old segments with the given ids, like a composition on the wire refers to
+// old segments. It returns an error if an id is out of range or refers to a
+// nil old segment.
+func FromSegmentIDs(oldsegs []Segment, ids ...int) (Composition, error) {
+	segments := make([]Segment, len(ids))
+	for i, id := range ids {
+		if id < 0 || id >= len(oldsegs) {
+			return Composition{}, fmt.Errorf("subsegment %d: segment id %d is out of range for %d old segments", i, id, len(oldsegs))
+		}
+		if oldsegs[id] == nil {
+			return Composition{}, fmt.Errorf("subsegment %d: %w: segment id %d refers to a nil old segment", i, ErrDanglingReference, id)
+		}
+		segments[i] = oldsegs[id]
 	}
+	return FromSegments(segments...).(Composition), nil
 }
 
 // Composition implements the Segment interface.
 type Composition struct {
 	// Segments are the subsegments of the segment composition.
-	Segments    []Segment
+	Segments []Segment
+	// Options is the metadata that is transmitted alongside the segment.
+	Options     []Option
 	fingerprint string
+	// interfaces, depth, and nodes are the flattened path interfaces, the
+	// depth, and the number of segments of the expanded composition, which
+	// FromSegments derives from the subsegments. A composition that was not
+	// constructed by FromSegments has nil interfaces and derives them on
+	// demand.
+	interfaces []snet.PathInterface
+	depth      int
+	nodes      int
+}
+
+// AcceptSubsegments returns the subsegments of a composition that satisfy the
+// given predicate, in order. Passing them as the new segments to
+// EncodeSegments accepts the selected subsegments but not the composition
+// itself.
+func AcceptSubsegments(composition Composition, accept func(Segment) bool) []Segment {
+	accepted := make([]Segment, 0)
+	for _, segment := range composition.Segments {
+		if accept(segment) {
+			accepted = append(accepted, segment)
+		}
+	}
+	return accepted
 }
 
 func (c Composition) PathInterfaces() []snet.PathInterface {
+	if c.interfaces != nil {
+		return append(make([]snet.PathInterface, 0, len(c.interfaces)), c.interfaces...)
+	}
 	interfaces := make([]snet.PathInterface, 0)
 	for _, segment := range c.Segments {
 		interfaces = append(interfaces, segment.PathInterfaces()...)
@@ -35,29 +147,130 @@ func (c Composition) PathInterfaces() []snet.PathInterface {
 	return interfaces
 }
 
+// SrcIA returns the ISD-AS of the first path interface. Subsegments without
+// interfaces are skipped, and a composition without any interfaces has the
+// zero ISD-AS as its source.
 func (c Composition) SrcIA() addr.IA {
-	return c.Segments[0].SrcIA()
+	if len(c.interfaces) > 0 {
+		return c.interfaces[0].IA
+	}
+	for _, segment := range c.Segments {
+		if interfaceCount(segment) > 0 {
+			return segment.SrcIA()
+		}
+	}
+	return addr.IA{}
 }
 
+// DstIA returns the ISD-AS of the last path interface, like SrcIA.
 func (c Composition) DstIA() addr.IA {
-	return c.Segments[len(c.Segments)-1].DstIA()
+	if len(c.interfaces) > 0 {
+		return c.interfaces[len(c.interfaces)-1].IA
+	}
+	for i := len(c.Segments) - 1; i >= 0; i-- {
+		if interfaceCount(c.Segments[i]) > 0 {
+			return c.Segments[i].DstIA()
+		}
+	}
+	return addr.IA{}
+}
+
+func (c Composition) IterInterfaces(yield func(snet.PathInterface) bool) {
+	iterInterfaces(c, yield)
+}
+
+func (c Composition) ASPath() []addr.IA {
+	return asPath(c)
+}
+
+func (c Composition) Contains(iface snet.PathInterface) bool {
+	for _, segment := range c.Segments {
+		if segment.Contains(iface) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Composition) ContainsIA(ia addr.IA) bool {
+	for _, segment := range c.Segments {
+		if segment.ContainsIA(ia) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Composition) Len() int {
+	hops := 0
+	for _, segment := range c.Segments {
+		hops += segment.Len()
+	}
+	return hops
+}
+
+func (c Composition) Depth() int {
+	if c.interfaces != nil {
+		return c.depth
+	}
+	depth := 0
+	for _, segment := range c.Segments {
+		if subdepth := segment.Depth(); subdepth > depth {
+			depth = subdepth
+		}
+	}
+	return depth + 1
+}
+
+func (c Composition) LeafCount() int {
+	leaves := 0
+	for _, segment := range c.Segments {
+		leaves += segment.LeafCount()
+	}
+	return leaves
 }
 
 func (c Composition) Fingerprint() string {
 	return c.fingerprint
 }
 
-func (c Composition) String() string {
-	str := "["
+func (c Composition) Equal(other Segment) bool {
+	o, ok := other.(Composition)
+	if !ok || len(c.Segments) != len(o.Segments) {
+		return false
+	}
 	for i, segment := range c.Segments {
-		str += "("
-		str += segment.String()
-		str += ")"
-		if i == len(c.Segments)-1 {
-			break
+		if !segment.Equal(o.Segments[i]) {
+			return false
 		}
-		str += ", "
 	}
-	str += "]"
-	return str
+	return true
+}
+
+func (c Composition) Reverse() Segment {
+	segments := make([]Segment, len(c.Segments))
+	for i, segment := range c.Segments {
+		segments[len(segments)-1-i] = segment.Reverse()
+	}
+	return FromSegments(segments...)
+}
+
+func (c Composition) Clone() Segment {
+	segments := make([]Segment, len(c.Segments))
+	for i, segment := range c.Segments {
+		segments[i] = segment.Clone()
+	}
+	c.Segments = segments
+	c.Options = cloneOptions(c.Options)
+	return c
+}
+
+// String renders the composition as the bracketed list of its subsegments,
+// e.g., "[19-ffaa:0:1303#1 > 19-ffaa:0:1302#1 | 19-ffaa:0:1302#2 > 17-ffaa:0:1108#1]".
+func (c Composition) String() string {
+	children := make([]string, len(c.Segments))
+	for i, segment := range c.Segments {
+		children[i] = segment.String()
+	}
+	return "[" + strings.Join(children, " | ") + "]"
 }
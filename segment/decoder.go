@@ -0,0 +1,275 @@
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// Decoder reads and decodes messages from a bytestream. Since every message
+// announces its own length, a Decoder reads exactly one message per call to
+// Decode and leaves subsequent messages in the stream untouched. This allows
+// multiple messages to be exchanged over one long-lived connection.
+//
+// The limits of a Decoder bound the resources that decoding a message may
+// consume. A limit of zero means that the default limit is used.
+type Decoder struct {
+	// MaxDepth is the maximum nesting depth of a decoded segment, where a
+	// segment literal has depth 1 (default: DefaultMaxDepth).
+	MaxDepth int
+	// MaxInterfaces is the maximum number of path interfaces of a decoded
+	// segment, i.e., of its flattened form (default: DefaultMaxInterfaces).
+	MaxInterfaces int
+	// MaxTotalInterfaces is the maximum number of path interfaces of all
+	// segment literals of a decoded message together, which bounds the work
+	// of decoding many small literals (default: DefaultMaxTotalInterfaces).
+	MaxTotalInterfaces int
+	// MaxSubsegments is the maximum number of subsegments of a decoded
+	// segment composition (default: DefaultMaxSubsegments).
+	MaxSubsegments int
+	// MaxExpandedSize is the maximum expanded size of a decoded segment,
+	// i.e., the number of segments and path interfaces of the tree that
+	// results from expanding every reference to a subsegment (default:
+	// DefaultMaxExpandedSize). Unlike MaxInterfaces, it also bounds
+	// compositions that refer to segments without interfaces many times,
+	// whose traversal would otherwise take exponential time.
+	MaxExpandedSize int
+	// MaxTotalExpandedSize is the maximum expanded size of all segments of a
+	// decoded message together (default: DefaultMaxTotalExpandedSize).
+	MaxTotalExpandedSize int
+	// MaxSegments is the maximum number of segments of a decoded message
+	// (default: DefaultMaxSegments).
+	MaxSegments int
+	// MaxBytes is the maximum size of a decoded message in bytes (default:
+	// DefaultMaxBytes).
+	MaxBytes int
+	// DedupAccepted makes Decode drop accepted segments that have the same
+	// fingerprint as an earlier accepted segment of the message. It is off by
+	// default for backward compatibility.
+	DedupAccepted bool
+	// ReuseInterfaces makes the Decoder decode the path interfaces of all
+	// segment literals into a scratch buffer that it reuses for every message,
+	// which avoids allocating the interfaces of each literal separately. The
+	// decoded literals alias the scratch buffer: they, and all segments that
+	// are composed of them, are only valid until the next message is decoded,
+	// which overwrites the buffer. A caller that keeps decoded segments beyond
+	// that must Clone them. It is off by default.
+	ReuseInterfaces bool
+	// SkipUnknownTypes makes the Decoder skip segments of types that are not
+	// registered instead of failing, e.g., segments of types that were added
+	// in a newer version. Their bodies are assumed to occupy seglen+optlen
+	// bytes like those of registered types (see TypeCodec). A skipped segment
+	// is never accepted, and it is nil among the decoded segments, such that
+	// the ids of the other segments are preserved. A composition that refers
+	// to a skipped segment still fails with ErrDanglingReference. It is off by
+	// default.
+	SkipUnknownTypes bool
+	stream           io.Reader
+	rejectReason     RejectReason
+	maxResponseBytes int
+	nonce            Nonce
+	hasNonce         bool
+	requestID        uint64
+	scratch          []snet.PathInterface
+}
+
+const (
+	// DefaultMaxDepth is the default value for Decoder.MaxDepth.
+	DefaultMaxDepth = 32
+	// DefaultMaxInterfaces is the default value for Decoder.MaxInterfaces.
+	DefaultMaxInterfaces = 1 << 12
+	// DefaultMaxTotalInterfaces is the default value for
+	// Decoder.MaxTotalInterfaces.
+	DefaultMaxTotalInterfaces = 1 << 18
+	// DefaultMaxSubsegments is the default value for Decoder.MaxSubsegments,
+	// which is the most that the encoding supports.
+	DefaultMaxSubsegments = maxSeglen
+	// DefaultMaxExpandedSize is the default value for
+	// Decoder.MaxExpandedSize.
+	DefaultMaxExpandedSize = 1 << 14
+	// DefaultMaxTotalExpandedSize is the default value for
+	// Decoder.MaxTotalExpandedSize.
+	DefaultMaxTotalExpandedSize = 1 << 21
+	// DefaultMaxSegments is the default value for Decoder.MaxSegments.
+	DefaultMaxSegments = maxNumsegs
+	// DefaultMaxBytes is the default value for Decoder.MaxBytes.
+	DefaultMaxBytes = 1 << 22 // 4 MiB
+)
+
+// NewDecoder creates a new Decoder that reads from the given bytestream.
+func NewDecoder(stream io.Reader) *Decoder {
+	return &Decoder{stream: stream}
+}
+
+// Reset makes the Decoder read from the given bytestream, e.g., of a new
+// connection, as if it had just been created with the same limits and
+// options. The state of the last decoded message, such as its reject reason,
+// nonce, and request id, is cleared. The old segments of a negotiation are
+// never kept by a Decoder, since they are passed to every call to Decode, so
+// that no segments carry over to the new bytestream. Only the scratch buffer
+// of ReuseInterfaces is kept, which invalidates the segments decoded before.
+func (d *Decoder) Reset(stream io.Reader) {
+	d.stream = stream
+	d.resetMessage()
+}
+
+// resetMessage clears the state of the last decoded message.
+func (d *Decoder) resetMessage() {
+	d.rejectReason, d.maxResponseBytes = NotRejected, 0
+	d.nonce, d.hasNonce, d.requestID = Nonce{}, false, 0
+}
+
+var decoderPool = sync.Pool{
+	New: func() interface{} { return new(Decoder) },
+}
+
+// GetDecoder returns a Decoder from a pool that reads from the given
+// bytestream, e.g., such that a server handling many connections does not
+// allocate a Decoder for each of them. The Decoder has the default limits and
+// options like one of NewDecoder. It should be returned with PutDecoder once
+// it is no longer used.
+func GetDecoder(stream io.Reader) *Decoder {
+	d := decoderPool.Get().(*Decoder)
+	d.Reset(stream)
+	return d
+}
+
+// PutDecoder returns a Decoder to the pool of GetDecoder. Its limits and
+// options are reset to the defaults, and it must not be used afterwards. The
+// segments that it decoded with ReuseInterfaces must not be used afterwards
+// either, since their interfaces are overwritten when the Decoder is reused.
+func PutDecoder(d *Decoder) {
+	*d = Decoder{scratch: d.scratch[:0]}
+	decoderPool.Put(d)
+}
+
+// Decode reads the next message from the bytestream and decodes it like
+// DecodeSegments. If the stream ends before the message is complete,
+// io.ErrUnexpectedEOF is returned. If the stream ends before the message
+// starts, io.EOF is returned.
+func (d *Decoder) Decode(oldsegs []Segment) ([]Segment, []Segment, addr.IA, addr.IA, error) {
+	d.resetMessage()
+	hdrbytes := make([]byte, HeaderLen)
+	if n, err := io.ReadFull(d.stream, hdrbytes); err != nil {
+		if err != io.EOF { // io.EOF means that there was no message at all
+			observer.ObserveDecode(0, n, err)
+		}
+		return nil, nil, addr.IA{}, addr.IA{}, err
+	}
+	header, _ := DecodeHeader(hdrbytes)
+	msglen := int(header.MsgLen)
+	srcIA, dstIA := header.SrcIA, header.DstIA
+	if msglen < HeaderLen {
+		err := errors.New("bad message size")
+		observer.ObserveDecode(0, HeaderLen, err)
+		return nil, nil, srcIA, dstIA, err
+	}
+	// The limits are checked before the message is read into memory.
+	if err := d.checkSize(msglen, int(header.NumSegs)); err != nil {
+		observer.ObserveDecode(0, HeaderLen, err)
+		return nil, nil, srcIA, dstIA, err
+	}
+
+	bytes := make([]byte, msglen)
+	copy(bytes, hdrbytes)
+	if n, err := io.ReadFull(d.stream, bytes[HeaderLen:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		observer.ObserveDecode(0, HeaderLen+n, err)
+		return nil, nil, srcIA, dstIA, err
+	}
+	newsegs, accepted, srcIA, dstIA, err := d.decodeMessage(bytes, oldsegs, nil)
+	if err != nil {
+		return nil, nil, srcIA, dstIA, err
+	}
+	accsegs := acceptedSegments(newsegs, accepted)
+	if d.DedupAccepted {
+		accsegs = dedupSegments(accsegs)
+	}
+	return newsegs, accsegs, srcIA, dstIA, nil
+}
+
+// dedupSegments removes segments with the same fingerprint as an earlier
+// segment, keeping the first occurrence.
+func dedupSegments(segments []Segment) []Segment {
+	return DedupBy(segments, Segment.Fingerprint)
+}
+
+func (d *Decoder) decodeMessage(bytes []byte, oldsegs []Segment, into []Segment) ([]Segment, []bool, addr.IA, addr.IA, error) {
+	newsegs, accepted, srcIA, dstIA, err := d.decodeSegments(bytes, oldsegs, into)
+	observer.ObserveDecode(len(newsegs), len(bytes), err)
+	return newsegs, accepted, srcIA, dstIA, err
+}
+
+// checkSize checks the advertised size and number of segments of a message
+// against the limits of the Decoder.
+func (d *Decoder) checkSize(msglen, numsegs int) error {
+	if msglen > d.maxBytes() {
+		return fmt.Errorf("message size %d exceeds the limit of %d bytes", msglen, d.maxBytes())
+	}
+	if numsegs > d.maxSegments() {
+		return fmt.Errorf("%w: message has %d segments, the limit is %d", ErrTooManySegments, numsegs, d.maxSegments())
+	}
+	return nil
+}
+
+func (d *Decoder) maxDepth() int {
+	if d.MaxDepth == 0 {
+		return DefaultMaxDepth
+	}
+	return d.MaxDepth
+}
+
+func (d *Decoder) maxInterfaces() int {
+	if d.MaxInterfaces == 0 {
+		return DefaultMaxInterfaces
+	}
+	return d.MaxInterfaces
+}
+
+func (d *Decoder) maxTotalInterfaces() int {
+	if d.MaxTotalInterfaces == 0 {
+		return DefaultMaxTotalInterfaces
+	}
+	return d.MaxTotalInterfaces
+}
+
+func (d *Decoder) maxSubsegments() int {
+	if d.MaxSubsegments == 0 {
+		return DefaultMaxSubsegments
+	}
+	return d.MaxSubsegments
+}
+
+func (d *Decoder) maxExpandedSize() int {
+	if d.MaxExpandedSize == 0 {
+		return DefaultMaxExpandedSize
+	}
+	return d.MaxExpandedSize
+}
+
+func (d *Decoder) maxTotalExpandedSize() int {
+	if d.MaxTotalExpandedSize == 0 {
+		return DefaultMaxTotalExpandedSize
+	}
+	return d.MaxTotalExpandedSize
+}
+
+func (d *Decoder) maxSegments() int {
+	if d.MaxSegments == 0 {
+		return DefaultMaxSegments
+	}
+	return d.MaxSegments
+}
+
+func (d *Decoder) maxBytes() int {
+	if d.MaxBytes == 0 {
+		return DefaultMaxBytes
+	}
+	return d.MaxBytes
+}
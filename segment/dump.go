@@ -0,0 +1,156 @@
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+)
+
+// DumpWire renders the structure of an encoded message as readable text for
+// debugging. Every line starts with the byte offset of the annotated field.
+// The message is not validated beyond what is needed to parse it: if it is
+// malformed or truncated, DumpWire returns the dump of everything that was
+// parsed before the error, together with the error.
+func DumpWire(bytes []byte) (string, error) {
+	var dump strings.Builder
+	err := dumpWire(&dump, bytes)
+	if err != nil {
+		fmt.Fprintf(&dump, "error: %s\n", err)
+	}
+	return dump.String(), err
+}
+
+func dumpWire(dump *strings.Builder, bytes []byte) error {
+	header, err := DecodeHeader(bytes)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(dump, "%6d  version: %d\n", 0, header.Version)
+	fmt.Fprintf(dump, "%6d  hdrlen: %d\n", 1, header.HdrLen)
+	fmt.Fprintf(dump, "%6d  numsegs: %d\n", 2, header.NumSegs)
+	fmt.Fprintf(dump, "%6d  msglen: %d\n", 4, header.MsgLen)
+	fmt.Fprintf(dump, "%6d  srcIA: %s\n", 8, header.SrcIA)
+	fmt.Fprintf(dump, "%6d  dstIA: %s\n", 16, header.DstIA)
+	hdrlen, msglen := int(header.HdrLen), int(header.MsgLen)
+	if hdrlen < HeaderLen || hdrlen > len(bytes) {
+		return fmt.Errorf("%w: header length %d exceeds buffer of length %d", ErrShortBuffer, hdrlen, len(bytes))
+	}
+	if msglen < hdrlen {
+		return fmt.Errorf("message length %d is less than header length %d", msglen, hdrlen)
+	}
+	// A truncated message is dumped as far as it is available.
+	var truncated error
+	if msglen > len(bytes) {
+		truncated = fmt.Errorf("%w: message length %d exceeds buffer of length %d", ErrShortBuffer, msglen, len(bytes))
+	} else {
+		bytes = bytes[:msglen]
+	}
+
+	var msgopts []Option
+	if header.Version >= version2 {
+		msgopts, err = decodeOptions(bytes[HeaderLen:hdrlen])
+		if err != nil {
+			return fmt.Errorf("message options: %w", err)
+		}
+	}
+	offset := HeaderLen
+	tablelen := -1
+	for _, option := range msgopts {
+		value := fmt.Sprintf("%x", option.Value)
+		switch option.Type {
+		case msgOptChecksum:
+			status := "mismatch"
+			if len(option.Value) == 4 && binary.BigEndian.Uint32(option.Value) == crc32.Checksum(bytes[hdrlen:], castagnoli) {
+				status = "ok"
+			}
+			value = fmt.Sprintf("checksum %x (%s)", option.Value, status)
+		case msgOptRejectReason:
+			value = fmt.Sprintf("reject reason %s", rejectReasonOf([]Option{option}))
+		case msgOptMaxResponseBytes:
+			value = fmt.Sprintf("max response bytes %d", maxResponseBytesOf([]Option{option}))
+		case msgOptNonce:
+			if nonce, ok := nonceOf([]Option{option}); ok {
+				value = fmt.Sprintf("nonce %x at %s", nonce.Value, nonce.Time.UTC().Format(time.RFC3339Nano))
+			}
+		case msgOptRequestID:
+			value = fmt.Sprintf("request id %d", requestIDOf([]Option{option}))
+		case msgOptInterfaceTable:
+			if len(option.Value) == 2 {
+				tablelen = int(binary.BigEndian.Uint16(option.Value))
+				value = fmt.Sprintf("interface table of %d entries", tablelen)
+			}
+		}
+		fmt.Fprintf(dump, "%6d  message option %d: %s\n", offset, option.Type, value)
+		offset += 3 + len(option.Value)
+	}
+
+	offset = hdrlen
+	ifsize := 16
+	if tablelen >= 0 {
+		iftable, err := DecodeInterfaces(bytes[offset:], tablelen)
+		if err != nil {
+			return fmt.Errorf("interface table: %w", err)
+		}
+		for i, iface := range iftable {
+			fmt.Fprintf(dump, "%6d  interface table entry %d: %s#%d\n", offset+i*16, i, iface.IA, iface.ID)
+		}
+		offset += tablelen * 16
+		ifsize = 2
+	}
+
+	for i := 0; i < int(header.NumSegs); i++ {
+		if offset+4 > len(bytes) {
+			return fmt.Errorf("segment %d: %w: header exceeds buffer at offset %d", i, ErrShortBuffer, offset)
+		}
+		flags := bytes[offset]
+		seglen := int(bytes[offset+1])
+		optlen := int(binary.BigEndian.Uint16(bytes[offset+2:]))
+		// The body of a registered type is opaque, it is dumped as a whole.
+		segtype, elemsize, opaque := "literal", ifsize, false
+		switch t := segmentTypeOf(flags); t {
+		case TypeLiteral:
+		case TypeComposition:
+			segtype, elemsize = "composition", 2
+		default:
+			segtype, elemsize, opaque = fmt.Sprintf("type %d", t), 1, true
+		}
+		accepted := flags&segAcceptedMask == segAcceptedTrue
+		fmt.Fprintf(dump, "%6d  segment %d: flags: 0x%02x (%s, accepted: %t), seglen: %d, optlen: %d\n",
+			offset, i, flags, segtype, accepted, seglen, optlen)
+		body := bytes[offset+4:]
+		if seglen*elemsize+optlen > len(body) {
+			return fmt.Errorf("segment %d: %w: body exceeds buffer at offset %d", i, ErrShortBuffer, offset)
+		}
+		offset += 4
+		if opaque {
+			fmt.Fprintf(dump, "%6d    body: %x\n", offset, bytes[offset:offset+seglen])
+			offset += seglen
+		}
+		for j := 0; j < seglen && !opaque; j++ {
+			switch {
+			case segtype == "composition":
+				fmt.Fprintf(dump, "%6d    subsegment id: %d\n", offset, binary.BigEndian.Uint16(bytes[offset:]))
+			case ifsize == 2:
+				fmt.Fprintf(dump, "%6d    interface index: %d\n", offset, binary.BigEndian.Uint16(bytes[offset:]))
+			default:
+				iface, _ := DecodeInterfaces(bytes[offset:], 1)
+				fmt.Fprintf(dump, "%6d    interface: %s#%d\n", offset, iface[0].IA, iface[0].ID)
+			}
+			offset += elemsize
+		}
+		options, err := decodeOptions(bytes[offset : offset+optlen])
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", i, err)
+		}
+		for _, option := range options {
+			fmt.Fprintf(dump, "%6d    option %d: %x\n", offset, option.Type, option.Value)
+			offset += 3 + len(option.Value)
+		}
+	}
+	if offset != len(bytes) {
+		fmt.Fprintf(dump, "%6d  %d trailing bytes\n", offset, len(bytes)-offset)
+	}
+	return truncated
+}
@@ -0,0 +1,95 @@
+package segment
+
+import (
+	"crypto/ed25519"
+	"io"
+
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// Encoder encodes messages and writes them to a bytestream. Instead of
+// assembling the whole message in memory, the header and each encoded segment
+// are written to the stream one after another.
+type Encoder struct {
+	// InternInterfaces makes the Encoder transmit every distinct interface
+	// only once in an interface table, which is referenced by the segment
+	// literals. This reduces the message size if many literals share
+	// interfaces, e.g., if they share a common prefix. Interning requires
+	// version 2 of the encoding.
+	InternInterfaces bool
+	// SigningKey, if not nil, makes the Encoder sign every accepted segment of
+	// a message with Sign, such that the receiver can verify its origin with
+	// VerifySignature.
+	SigningKey ed25519.PrivateKey
+	// RejectReason, if not NotRejected, is transmitted with every message
+	// that the Encoder encodes, e.g., with a reply that accepts no segments.
+	RejectReason RejectReason
+	// MaxResponseBytes, if not zero, advertises with every message that the
+	// Encoder encodes the maximum size in bytes of a response that the sender
+	// accepts. The receiver learns it from Decoder.MaxResponseBytes and may
+	// use Encoder.Fit to trim its response accordingly.
+	MaxResponseBytes int
+	// ReplayProtection makes the Encoder attach a fresh Nonce to every
+	// message that it encodes, such that the receiver can detect replayed
+	// messages. The receiver learns the nonce from Decoder.Nonce.
+	ReplayProtection bool
+	// RequestID, if not zero, is transmitted with every message that the
+	// Encoder encodes. A responder echoes the request id of a request, which
+	// the receiver learns from Decoder.RequestID, such that the requester can
+	// match the response to the request over unreliable transports.
+	RequestID uint64
+	stream    io.Writer
+	// segidx and numsent are the segment ids and the number of segments of
+	// the messages encoded by EncodeNext.
+	segidx  map[string]int
+	numsent int
+}
+
+// NewEncoder creates a new Encoder that writes to the given bytestream.
+func NewEncoder(stream io.Writer) *Encoder {
+	return &Encoder{stream: stream}
+}
+
+// Encode encodes the segments like EncodeSegments and writes the message to
+// the bytestream. It returns the encoded segments in the order of
+// transmission, or an error if encoding or writing failed.
+func (e *Encoder) Encode(newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) ([]Segment, error) {
+	return e.writeMessage(e.stream, newsegs, oldsegs, srcIA, dstIA)
+}
+
+// EncodeKnown encodes the segments like EncodeSegmentsKnown and writes the
+// message to the bytestream.
+func (e *Encoder) EncodeKnown(newsegs []Segment, known map[string]int, numold int, srcIA, dstIA addr.IA) ([]Segment, error) {
+	sentsegs, _, err := e.writeKnownMessage(e.stream, newsegs, known, numold, srcIA, dstIA)
+	return sentsegs, err
+}
+
+// EncodeNext encodes the segments like EncodeKnown, where the old segments
+// are all segments that the Encoder sent in earlier calls to EncodeNext. The
+// Encoder thus keeps one numbering space of segment ids across its messages:
+// a segment that was sent before keeps its id, and the segments of a message
+// receive the ids that follow those of the earlier messages. The receiver has
+// to decode every message with the new segments of all earlier messages of
+// the Encoder as oldsegs, in the order in which the Decoder returned them.
+// This only holds for a one-way stream: a conpass.Session numbers the segments
+// of both directions, so it cannot receive such messages once it sent any.
+//
+// Note that the number of segments in the header of a message only counts the
+// segments transmitted in the message, while the segment ids count all
+// segments transmitted so far. Since segment ids have 16 bits, at most 65536
+// segments can be sent in total.
+func (e *Encoder) EncodeNext(newsegs []Segment, srcIA, dstIA addr.IA) ([]Segment, error) {
+	sentsegs, segidx, err := e.writeKnownMessage(e.stream, newsegs, e.segidx, e.numsent, srcIA, dstIA)
+	if err != nil {
+		return nil, err
+	}
+	e.segidx = segidx
+	e.numsent += len(sentsegs)
+	return sentsegs, nil
+}
+
+// NumSent returns the number of segments that the Encoder sent through
+// EncodeNext, i.e., the id of the next segment that it sends.
+func (e *Encoder) NumSent() int {
+	return e.numsent
+}
@@ -3,6 +3,8 @@ package segment
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 
 	"github.com/scionproto/scion/go/lib/addr"
@@ -21,6 +23,44 @@ const (
 	segAcceptedTrue  uint8 = 1 << 1
 )
 
+const (
+	// The encoding version is the first byte of the message header. Messages
+	// that predate versioning left this byte zero and use the same layout as
+	// version 1.
+	versionUnversioned uint8 = 0
+	version1           uint8 = 1
+	// Version 2 adds per-message options, which are encoded like segment
+	// options in the header (after the first 24 bytes, up to hdrlen).
+	version2 uint8 = 2
+	// Version 3 requires the checksum option.
+	version3       uint8 = 3
+	currentVersion       = version3
+)
+
+const (
+	// The interface table option announces that the message payload starts
+	// with a table of interfaces (16 bytes per interface) and that segment
+	// literals reference these interfaces by their 2-byte table index. The
+	// option value is the 2-byte number of table entries.
+	msgOptInterfaceTable uint8 = 1
+	// The checksum option contains the 4-byte CRC32C (Castagnoli) checksum
+	// over everything after the header, i.e., after hdrlen.
+	msgOptChecksum uint8 = 2
+	// The reject reason option contains the 1-byte RejectReason.
+	msgOptRejectReason uint8 = 3
+	// The max response bytes option contains the 4-byte maximum size of the
+	// response that the sender of the message accepts.
+	msgOptMaxResponseBytes uint8 = 4
+	// The nonce option contains the 8-byte random value of a Nonce followed
+	// by its 8-byte time in nanoseconds since the Unix epoch.
+	msgOptNonce uint8 = 5
+	// The request id option contains the 8-byte id by which a response is
+	// matched to its request.
+	msgOptRequestID uint8 = 6
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 // ReadSegments reads from the given bytestream and decodes the bytes received from
 // the other CONPASS agent into segments. This function also takes into account
 // the ``old'' set of segments, which is already known to both agents.  The
@@ -29,81 +69,369 @@ const (
 // the source and destination ASes. If the decoding failed, an error is
 // returned instead.
 func ReadSegments(stream io.Reader, oldsegs []Segment) ([]Segment, []Segment, addr.IA, addr.IA, error) {
-	header := make([]byte, 24)
-	n, err := stream.Read(header)
-	if n < 24 || (err != nil && err != io.EOF) {
-		return nil, nil, addr.IA{}, addr.IA{}, err
-	}
-	hdrlen := int(header[1])
-	numsegs := int(binary.BigEndian.Uint16(header[2:]))
-	msglen := int(binary.BigEndian.Uint32(header[4:]))
-	srcIA := addr.IAInt(binary.BigEndian.Uint64(header[8:])).IA()
-	dstIA := addr.IAInt(binary.BigEndian.Uint64(header[16:])).IA()
-	if msglen < 24 || msglen > (1<<22) { // 4 MiB is the limit
-		return nil, nil, srcIA, dstIA, errors.New("bad message size")
-	}
-
-	msglen -= 24 // the size of the header was included in msglen
-	bytes := make([]byte, msglen)
-	read := 0
-	for err == nil && read < msglen {
-		n, e := stream.Read(bytes[read:])
-		read += n
-		err = e
-	}
-	if err != nil && err != io.EOF {
+	return NewDecoder(stream).Decode(oldsegs)
+}
+
+// DecodeSegments decodes a message received from the other CONPASS agent into
+// segments. It is the counterpart of EncodeSegments and behaves like
+// ReadSegments, except that the whole message must already be in memory.
+// Malformed or truncated messages, as well as messages that exceed the default
+// limits of a Decoder, result in an error. A message without segments decodes
+// into empty, non-nil slices.
+func DecodeSegments(bytes []byte, oldsegs []Segment) ([]Segment, []Segment, addr.IA, addr.IA, error) {
+	newsegs, accepted, srcIA, dstIA, err := new(Decoder).decodeMessage(bytes, oldsegs, nil)
+	if err != nil {
+		return nil, nil, srcIA, dstIA, err
+	}
+	return newsegs, acceptedSegments(newsegs, accepted), srcIA, dstIA, nil
+}
+
+// DecodeSegmentsInto decodes a message like DecodeSegments, but it decodes into
+// the given slices of new and accepted segments instead of allocating new
+// ones, which allows the caller to reuse their backing arrays across messages,
+// e.g., from a pool. The lengths of the slices are reset, and a slice whose
+// capacity is too small for the message is grown. The returned slices replace
+// the given ones, whose contents are overwritten.
+func DecodeSegmentsInto(newsegs, accsegs []Segment, bytes []byte, oldsegs []Segment) ([]Segment, []Segment, addr.IA, addr.IA, error) {
+	newsegs, accepted, srcIA, dstIA, err := new(Decoder).decodeMessage(bytes, oldsegs, newsegs)
+	if err != nil {
 		return nil, nil, srcIA, dstIA, err
 	}
-	bytes = bytes[hdrlen-24:] // skip per-message options (included in hdrlen)
+	if accsegs == nil {
+		accsegs = make([]Segment, 0)
+	}
+	return newsegs, appendAcceptedSegments(accsegs[:0], newsegs, accepted), srcIA, dstIA, nil
+}
+
+// DecodeSegmentsPrefix decodes the message at the start of the buffer like
+// DecodeSegments, but the message may be followed by further bytes, e.g., by
+// the next message. It additionally returns the length of the decoded message,
+// i.e., the number of bytes by which to advance the buffer.
+func DecodeSegmentsPrefix(bytes []byte, oldsegs []Segment) ([]Segment, []Segment, addr.IA, addr.IA, int, error) {
+	newsegs, accsegs, srcIA, dstIA, err := DecodeSegments(bytes, oldsegs)
+	if err != nil {
+		return nil, nil, srcIA, dstIA, 0, err
+	}
+	header, _ := DecodeHeader(bytes)
+	return newsegs, accsegs, srcIA, dstIA, int(header.MsgLen), nil
+}
+
+// DecodeSegmentsAccepted behaves like DecodeSegments, but instead of the
+// accepted segments it returns whether each of the decoded segments was
+// accepted, such that the i-th flag belongs to the i-th decoded segment.
+func DecodeSegmentsAccepted(bytes []byte, oldsegs []Segment) ([]Segment, []bool, addr.IA, addr.IA, error) {
+	return new(Decoder).decodeMessage(bytes, oldsegs, nil)
+}
 
-	newsegs := make([]Segment, numsegs)
-	accsegs := make([]Segment, 0)
+// acceptedSegments returns the segments whose accepted flag is set.
+func acceptedSegments(segments []Segment, accepted []bool) []Segment {
+	return appendAcceptedSegments(make([]Segment, 0), segments, accepted)
+}
+
+// appendAcceptedSegments appends the segments whose accepted flag is set.
+func appendAcceptedSegments(accsegs []Segment, segments []Segment, accepted []bool) []Segment {
+	for i, segment := range segments {
+		if accepted[i] {
+			accsegs = append(accsegs, segment)
+		}
+	}
+	return accsegs
+}
+
+// decodeSegments decodes the segments of a message into the given slice,
+// which is grown if its capacity does not suffice. A nil slice is always
+// replaced by a newly allocated one.
+func (d *Decoder) decodeSegments(bytes []byte, oldsegs []Segment, into []Segment) ([]Segment, []bool, addr.IA, addr.IA, error) {
+	d.rejectReason, d.maxResponseBytes = NotRejected, 0
+	d.nonce, d.hasNonce, d.requestID = Nonce{}, false, 0
+	d.scratch = d.scratch[:0]
+	header, msgopts, err := decodeMessageHeader(bytes)
+	if err != nil {
+		return nil, nil, header.SrcIA, header.DstIA, err
+	}
+	hdrlen := int(header.HdrLen)
+	numsegs := int(header.NumSegs)
+	msglen := int(header.MsgLen)
+	srcIA, dstIA := header.SrcIA, header.DstIA
+	bytes = bytes[:msglen]
+	if err := d.checkSize(msglen, numsegs); err != nil {
+		return nil, nil, srcIA, dstIA, err
+	}
+	d.rejectReason = rejectReasonOf(msgopts)
+	d.maxResponseBytes = maxResponseBytesOf(msgopts)
+	d.nonce, d.hasNonce = nonceOf(msgopts)
+	d.requestID = requestIDOf(msgopts)
+
+	offset := hdrlen // skip per-message options (included in hdrlen)
+	var iftable []snet.PathInterface
+	for _, option := range msgopts {
+		if option.Type == msgOptInterfaceTable && len(option.Value) == 2 {
+			tablelen := int(binary.BigEndian.Uint16(option.Value))
+			iftable, err = DecodeInterfaces(bytes[offset:], tablelen)
+			if err != nil {
+				err = fmt.Errorf("interface table: %w", err)
+				return nil, nil, srcIA, dstIA, err
+			}
+			offset += tablelen * 16
+		}
+	}
+	ifsize := 16
+	if iftable != nil {
+		ifsize = 2
+	}
+
+	// Every segment occupies at least 4 bytes, which bounds the allocations
+	// below by the size of the message.
+	if numsegs*4 > len(bytes)-offset {
+		err := fmt.Errorf("%w: %d segments exceed buffer of length %d", ErrShortBuffer, numsegs, len(bytes))
+		return nil, nil, srcIA, dstIA, err
+	}
+	newsegs := into
+	if newsegs == nil || cap(newsegs) < numsegs {
+		newsegs = make([]Segment, numsegs)
+	}
+	newsegs = newsegs[:numsegs]
+	accflags := make([]bool, numsegs)
+	state := &decodeState{
+		decoder:  d,
+		oldsegs:  oldsegs,
+		newsegs:  newsegs,
+		depths:   make([]int, numsegs),
+		ifcounts: make([]int, numsegs),
+		sizes:    make([]int, numsegs),
+		ifsize:   ifsize,
+		iftable:  iftable,
+	}
 	for i := 0; i < numsegs; i++ {
-		flags := bytes[0]
-		segtype := flags & segTypeMask
+		if offset+4 > len(bytes) {
+			err := fmt.Errorf("segment %d: %w: header exceeds buffer at offset %d", i, ErrShortBuffer, offset)
+			return nil, nil, srcIA, dstIA, err
+		}
+		flags := bytes[offset]
+		segtype := segmentTypeOf(flags)
 		accepted := segAcceptedTrue == (flags & segAcceptedMask)
-		seglen := int(bytes[1])
-		optlen := int(binary.BigEndian.Uint16(bytes[2:]))
-
-		switch segtype {
-		case segTypeLiteral:
-			newsegs[i] = FromInterfaces(decodeInterfaces(bytes[4:], seglen)...)
-			bytes = bytes[4+seglen*16+optlen:]
-		case segTypeComposition:
-			subsegs := make([]Segment, seglen)
-			for j := 0; j < seglen; j++ {
-				id := binary.BigEndian.Uint16(bytes[4+j*2:])
-				switch {
-				case int(id) < len(oldsegs):
-					subsegs[j] = oldsegs[id]
-				case int(id) < len(oldsegs)+len(newsegs):
-					subsegs[j] = newsegs[int(id)-len(oldsegs)]
-				default:
-					err := errors.New("subsegment id is greater/equal to segment id")
-					return nil, nil, srcIA, dstIA, err
-				}
+		seglen := int(bytes[offset+1])
+		optlen := int(binary.BigEndian.Uint16(bytes[offset+2:]))
+		codec, ok := codecs[segtype]
+		if !ok && !d.SkipUnknownTypes {
+			err := fmt.Errorf("segment %d: %w %d", i, ErrUnknownType, segtype)
+			return nil, nil, srcIA, dstIA, err
+		}
+		if !ok { // skipped, the segment remains nil and is not accepted
+			if seglen+optlen > len(bytes)-offset-4 {
+				err := fmt.Errorf("segment %d: %w: body of type %d exceeds buffer at offset %d", i, ErrShortBuffer, segtype, offset)
+				return nil, nil, srcIA, dstIA, err
 			}
-			newsegs[i] = FromSegments(subsegs...)
-			bytes = bytes[4+seglen*2+optlen:]
+			newsegs[i] = nil
+			offset += 4 + seglen + optlen
+			continue
 		}
-		if accepted {
-			accsegs = append(accsegs, newsegs[i])
+		state.index, state.offset = i, offset
+		segment, bodylen, err := codec.decode(bytes[offset+4:], seglen, optlen, state)
+		if err != nil {
+			err = fmt.Errorf("segment %d: %w", i, err)
+			return nil, nil, srcIA, dstIA, err
 		}
+		newsegs[i] = segment
+		accflags[i] = accepted
+		offset += 4 + bodylen
+	}
+	return newsegs, accflags, srcIA, dstIA, nil
+}
+
+// decodeLiteral decodes the body of a segment literal.
+func decodeLiteral(body []byte, seglen, optlen int, state *decodeState) (Segment, int, error) {
+	d, ifsize := state.decoder, state.ifsize
+	if seglen*ifsize+optlen > len(body) {
+		return nil, 0, fmt.Errorf("%w: literal body exceeds buffer at offset %d", ErrShortBuffer, state.offset)
+	}
+	if err := state.checkLimits(1, seglen, 1+seglen); err != nil {
+		return nil, 0, err
+	}
+	if err := state.addInterfaces(seglen); err != nil {
+		return nil, 0, err
+	}
+	// In reuse mode, the interfaces are appended to the scratch buffer of
+	// the Decoder, and the literal aliases the buffer instead of owning a
+	// copy of its interfaces.
+	interfaces := d.scratch
+	if !d.ReuseInterfaces {
+		interfaces = make([]snet.PathInterface, 0, seglen)
+	}
+	start := len(interfaces)
+	var err error
+	if state.iftable != nil {
+		interfaces, err = appendInternedInterfaces(interfaces, body, seglen, state.iftable)
+	} else {
+		interfaces, err = appendInterfaces(interfaces, body, seglen)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.ReuseInterfaces {
+		d.scratch = interfaces
+		interfaces = interfaces[start:len(interfaces):len(interfaces)]
+	}
+	options, err := decodeOptions(body[seglen*ifsize : seglen*ifsize+optlen])
+	if err != nil {
+		return nil, 0, err
 	}
-	return newsegs, accsegs, srcIA, dstIA, nil
+	state.record(1, seglen, 1+seglen)
+	literal := literalOf(interfaces)
+	literal.Options = options
+	return literal, seglen*ifsize + optlen, nil
 }
 
-func decodeInterfaces(bytes []byte, seglen int) []snet.PathInterface {
-	interfaces := make([]snet.PathInterface, seglen)
+// decodeComposition decodes the body of a segment composition, whose
+// subsegments are old segments or segments decoded earlier in the message.
+func decodeComposition(body []byte, seglen, optlen int, state *decodeState) (Segment, int, error) {
+	i, oldsegs, newsegs := state.index, state.oldsegs, state.newsegs
+	if seglen*2+optlen > len(body) {
+		return nil, 0, fmt.Errorf("%w: composition body exceeds buffer at offset %d", ErrShortBuffer, state.offset)
+	}
+	if seglen == 0 {
+		return nil, 0, fmt.Errorf("composition at offset %d has no segments", state.offset)
+	}
+	if maxSubsegments := state.decoder.maxSubsegments(); seglen > maxSubsegments {
+		return nil, 0, fmt.Errorf("%d subsegments exceed limit of %d", seglen, maxSubsegments)
+	}
+	subsegs := make([]Segment, seglen)
+	depth, ifcount, size := 0, 0, 1
+	for j := 0; j < seglen; j++ {
+		id := binary.BigEndian.Uint16(body[j*2:])
+		var subdepth, subifcount, subsize int
+		switch {
+		case int(id) < len(oldsegs):
+			subsegs[j] = oldsegs[id]
+			if subsegs[j] == nil {
+				return nil, 0, fmt.Errorf("%w: subsegment id %d refers to a nil old segment", ErrDanglingReference, id)
+			}
+			// The shape of old segments is kept with them, so that
+			// they need not be flattened.
+			var subnodes int
+			subdepth, subnodes = expandedShape(subsegs[j])
+			subifcount = interfaceCount(subsegs[j])
+			subsize = subnodes + subifcount
+		case int(id) < len(oldsegs)+i: // only previously decoded segments
+			subsegs[j] = newsegs[int(id)-len(oldsegs)]
+			if subsegs[j] == nil {
+				return nil, 0, fmt.Errorf("%w: subsegment id %d refers to a skipped segment", ErrDanglingReference, id)
+			}
+			k := int(id) - len(oldsegs)
+			subdepth, subifcount, subsize = state.depths[k], state.ifcounts[k], state.sizes[k]
+		default:
+			return nil, 0, fmt.Errorf("%w: subsegment id %d is not less than %d", ErrForwardReference, id, len(oldsegs)+i)
+		}
+		if subdepth > depth {
+			depth = subdepth
+		}
+		ifcount += subifcount
+		size += subsize
+	}
+	if err := state.checkLimits(depth+1, ifcount, size); err != nil {
+		return nil, 0, err
+	}
+	state.record(depth+1, ifcount, size)
+	options, err := decodeOptions(body[seglen*2 : seglen*2+optlen])
+	if err != nil {
+		return nil, 0, err
+	}
+	composition := FromSegments(subsegs...).(Composition)
+	composition.Options = options
+	return composition, seglen*2 + optlen, nil
+}
+
+// decodeMessageHeader decodes and validates the header of a message including
+// the message options, and it verifies the checksum of the message. Messages
+// that predate version 2 have no message options.
+func decodeMessageHeader(bytes []byte) (Header, []Option, error) {
+	header, err := DecodeHeader(bytes)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	if header.Version > currentVersion {
+		return Header{}, nil, fmt.Errorf("%w %d", ErrBadVersion, header.Version)
+	}
+	hdrlen, msglen := int(header.HdrLen), int(header.MsgLen)
+	if hdrlen < HeaderLen || hdrlen > len(bytes) {
+		err := fmt.Errorf("%w: header length %d exceeds buffer of length %d", ErrShortBuffer, hdrlen, len(bytes))
+		return header, nil, err
+	}
+	if msglen < hdrlen || msglen > len(bytes) {
+		err := fmt.Errorf("%w: message length %d exceeds buffer of length %d", ErrShortBuffer, msglen, len(bytes))
+		return header, nil, err
+	}
+	if header.Version < version2 {
+		return header, nil, nil
+	}
+	msgopts, err := decodeOptions(bytes[HeaderLen:hdrlen])
+	if err != nil {
+		return header, nil, fmt.Errorf("message options: %w", err)
+	}
+	if header.Version >= version3 {
+		if err := verifyChecksum(bytes[hdrlen:msglen], msgopts); err != nil {
+			return header, nil, err
+		}
+	}
+	return header, msgopts, nil
+}
+
+func verifyChecksum(payload []byte, msgopts []Option) error {
+	for _, option := range msgopts {
+		if option.Type == msgOptChecksum && len(option.Value) == 4 {
+			if binary.BigEndian.Uint32(option.Value) != crc32.Checksum(payload, castagnoli) {
+				return errors.New("segment payload checksum mismatch")
+			}
+			return nil
+		}
+	}
+	return errors.New("segment payload checksum is missing")
+}
+
+// DecodeInterfaces decodes seglen path interfaces that were encoded with
+// EncodeInterfacesTo. It returns an error if the buffer holds fewer than
+// seglen interfaces, or if seglen is negative.
+func DecodeInterfaces(bytes []byte, seglen int) ([]snet.PathInterface, error) {
+	if seglen < 0 {
+		return nil, fmt.Errorf("negative number of interfaces %d", seglen)
+	}
+	if len(bytes) < seglen*16 {
+		return nil, fmt.Errorf("%w: %d interfaces exceed buffer of length %d", ErrShortBuffer, seglen, len(bytes))
+	}
+	return appendInterfaces(make([]snet.PathInterface, 0, seglen), bytes, seglen)
+}
+
+// appendInterfaces decodes seglen path interfaces like DecodeInterfaces and
+// appends them to the given slice.
+func appendInterfaces(interfaces []snet.PathInterface, bytes []byte, seglen int) ([]snet.PathInterface, error) {
+	if len(bytes) < seglen*16 {
+		return nil, fmt.Errorf("%w: %d interfaces exceed buffer of length %d", ErrShortBuffer, seglen, len(bytes))
+	}
 	for i := 0; i < seglen; i++ {
 		id := binary.BigEndian.Uint64(bytes[i*16:])
 		ia := binary.BigEndian.Uint64(bytes[i*16+8:])
-		interfaces[i] = snet.PathInterface{
+		interfaces = append(interfaces, snet.PathInterface{
 			ID: common.IFIDType(id),
 			IA: addr.IAInt(ia).IA(),
+		})
+	}
+	return interfaces, nil
+}
+
+// appendInternedInterfaces decodes seglen interface indices into the interface
+// table and appends the path interfaces to the given slice.
+func appendInternedInterfaces(interfaces []snet.PathInterface, bytes []byte, seglen int, iftable []snet.PathInterface) ([]snet.PathInterface, error) {
+	if len(bytes) < seglen*2 {
+		return nil, fmt.Errorf("%w: %d interface indices exceed buffer of length %d", ErrShortBuffer, seglen, len(bytes))
+	}
+	for i := 0; i < seglen; i++ {
+		idx := int(binary.BigEndian.Uint16(bytes[i*2:]))
+		if idx >= len(iftable) {
+			return nil, fmt.Errorf("interface index %d exceeds interface table of length %d", idx, len(iftable))
 		}
+		interfaces = append(interfaces, iftable[idx])
 	}
-	return interfaces
+	return interfaces, nil
 }
 
 // WriteSegments encodes the segments to send to the other CONPASS segments in
@@ -111,98 +439,538 @@ func decodeInterfaces(bytes []byte, seglen int) []snet.PathInterface {
 // account the ``old'' set of segments, which is already known to both agents.
 // The function returns the encoded segments in the order of transmission.
 func WriteSegments(stream io.Writer, newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) ([]Segment, error) {
-	bytes, sentsegs := EncodeSegments(newsegs, oldsegs, srcIA, dstIA)
-	_, err := stream.Write(bytes)
-	if err != nil {
-		return nil, err
-	}
-	return sentsegs, nil
+	return NewEncoder(stream).Encode(newsegs, oldsegs, srcIA, dstIA)
 }
 
 // EncodeSegments encodes the segments to send to the other CONPASS segments in
 // bytes. This function also takes into account the ``old'' set of segments,
 // which is already known to both agents.  The function returns the byte
-// sequence and the encoded segments in the order of transmission.
-func EncodeSegments(newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) ([]byte, []Segment) {
-	hdrlen := 24
-	allbytes := make([]byte, hdrlen)
-	allbytes[1] = uint8(hdrlen)
-	binary.BigEndian.PutUint64(allbytes[8:], uint64(srcIA.IAInt()))
-	binary.BigEndian.PutUint64(allbytes[16:], uint64(dstIA.IAInt()))
+// sequence and the encoded segments in the order of transmission. If a segment
+// cannot be represented in the encoding, an error is returned instead. The
+// encoding is deterministic: segment ids are assigned in traversal order, so
+// identical inputs always result in identical byte sequences. Encoding no
+// segments is valid and yields a message that consists of the header only,
+// e.g., to reply that no segment was accepted.
+//
+// The encoded segments are indexed by their segment ids, i.e., they can be
+// appended to the old segments for the next message, and they equal the
+// segments that the receiver decodes for the same ids. They are deliberately
+// not deduplicated: a segment that was seen before is accepted by a
+// composition that merely references its id, which occupies an id of its own.
+// See CompactSegments for the distinct encoded segments.
+func EncodeSegments(newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) ([]byte, []Segment, error) {
+	return new(Encoder).encodeMessage(newsegs, oldsegs, srcIA, dstIA)
+}
+
+// EncodeSegmentsIndexed is like EncodeSegments, but it additionally returns
+// the segment ids of the message, e.g., to correlate the bytes of the message
+// with the encoded segments. The ids map the fingerprint of every old and
+// every sent segment to the id by which the message refers to the segment.
+// Note that a composition that accepts a segment that was seen before has the
+// fingerprint of that segment, so its fingerprint maps to the id of the
+// original segment rather than to the id of the composition.
+func EncodeSegmentsIndexed(newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) ([]byte, []Segment, map[string]int, error) {
+	return new(Encoder).encodeIndexedMessage(newsegs, oldsegs, srcIA, dstIA)
+}
+
+// EncodeSegmentsKnown is like EncodeSegments, but the ``old'' segments are
+// only given by the ids of their fingerprints and by their number, such that a
+// long negotiation does not need to keep all old segments in memory. The ids
+// range from 0 to numold-1. Since the old segments are not available, the
+// returned segments accept a segment that was sent in an earlier message
+// through a composition of the segment itself rather than of the old segment.
+// Both have the same encoding, but may differ in structure.
+func EncodeSegmentsKnown(newsegs []Segment, known map[string]int, numold int, srcIA, dstIA addr.IA) ([]byte, []Segment, error) {
+	bytes, sentsegs, _, err := new(Encoder).encodeKnownMessage(newsegs, known, numold, srcIA, dstIA)
+	return bytes, sentsegs, err
+}
+
+// EncodedSize returns the number of bytes that EncodeSegments needs to encode
+// the given segments if no ``old'' segments are known, e.g., to size a buffer.
+func EncodedSize(segments []Segment) int {
+	sentsegs, _, _ := planMessage(segments, []Segment{})
+	size := HeaderLen + 3 + 4 // including the checksum option
+	for _, sentseg := range sentsegs {
+		size += encodedSegmentLen(sentseg, 16)
+	}
+	return size
+}
+
+// CompactSegments returns the distinct segments among the encoded segments of
+// a message, e.g., to log what was sent. It unwraps the compositions by which
+// a message accepts a segment that was seen before, i.e., the compositions of
+// a single subsegment without options, and it removes the segments with the
+// same fingerprint as an earlier segment. The result is no longer indexed by
+// segment ids, so it must not be used as old segments.
+func CompactSegments(sentsegs []Segment) []Segment {
+	unwrapped := make([]Segment, len(sentsegs))
+	for i, sentseg := range sentsegs {
+		if c, ok := sentseg.(Composition); ok && len(c.Segments) == 1 && len(c.Options) == 0 {
+			sentseg = c.Segments[0]
+		}
+		unwrapped[i] = sentseg
+	}
+	return dedupSegments(unwrapped)
+}
+
+// maxNumsegs is the maximum number of segments that fit into a message.
+const maxNumsegs = 1<<16 - 1
+
+// maxHdrlen is the maximum length of the header including the options.
+const maxHdrlen = 1<<8 - 1
+
+// maxIftable is the maximum number of entries in an interface table.
+const maxIftable = 1<<16 - 1
 
+// encodeMessage validates and plans the segments of a message and encodes them.
+func (e *Encoder) encodeMessage(newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) ([]byte, []Segment, error) {
+	bytes, sentsegs, _, err := e.encodeIndexedMessage(newsegs, oldsegs, srcIA, dstIA)
+	return bytes, sentsegs, err
+}
+
+// encodeIndexedMessage is like encodeMessage, but it also returns the segment
+// ids that were assigned to the fingerprints.
+func (e *Encoder) encodeIndexedMessage(newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) ([]byte, []Segment, map[string]int, error) {
+	msg, err := e.plan(newsegs, oldsegs, srcIA, dstIA)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bytes, err := msg.bytes()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	observer.ObserveEncode(len(msg.sentsegs), len(bytes))
+	return bytes, msg.sentsegs, msg.segidx, nil
+}
+
+// writeMessage is like encodeMessage, but it writes the message to the stream
+// piecewise instead of returning it.
+func (e *Encoder) writeMessage(stream io.Writer, newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) ([]Segment, error) {
+	msg, err := e.plan(newsegs, oldsegs, srcIA, dstIA)
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.writeTo(stream); err != nil {
+		return nil, err
+	}
+	observer.ObserveEncode(len(msg.sentsegs), msg.msglen)
+	return msg.sentsegs, nil
+}
+
+// encode is like encodeIndexedMessage, but the message is not reported to the
+// observer, e.g., because it is only encoded to determine its size.
+func (e *Encoder) encode(newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) ([]byte, []Segment, map[string]int, error) {
+	msg, err := e.plan(newsegs, oldsegs, srcIA, dstIA)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bytes, err := msg.bytes()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return bytes, msg.sentsegs, msg.segidx, nil
+}
+
+// plan validates and plans the segments of a message and encodes its header.
+func (e *Encoder) plan(newsegs, oldsegs []Segment, srcIA, dstIA addr.IA) (*message, error) {
+	for _, newseg := range newsegs {
+		if err := Validate(newseg); err != nil {
+			return nil, err
+		}
+	}
+	sentsegs, accepted, segidx := planMessage(newsegs, oldsegs)
+	return e.encodeHead(sentsegs, accepted, segidx, srcIA, dstIA)
+}
+
+// encodeKnownMessage is like encodeMessage, but the ``old'' segments are only
+// known by their fingerprints and ids. It also returns the segment ids that
+// were assigned to the fingerprints, which extend the known ids.
+func (e *Encoder) encodeKnownMessage(newsegs []Segment, known map[string]int, numold int, srcIA, dstIA addr.IA) ([]byte, []Segment, map[string]int, error) {
+	msg, err := e.planKnown(newsegs, known, numold, srcIA, dstIA)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	bytes, err := msg.bytes()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	observer.ObserveEncode(len(msg.sentsegs), len(bytes))
+	return bytes, msg.sentsegs, msg.segidx, nil
+}
+
+// writeKnownMessage is like encodeKnownMessage, but it writes the message to
+// the stream piecewise instead of returning it.
+func (e *Encoder) writeKnownMessage(stream io.Writer, newsegs []Segment, known map[string]int, numold int, srcIA, dstIA addr.IA) ([]Segment, map[string]int, error) {
+	msg, err := e.planKnown(newsegs, known, numold, srcIA, dstIA)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := msg.writeTo(stream); err != nil {
+		return nil, nil, err
+	}
+	observer.ObserveEncode(len(msg.sentsegs), msg.msglen)
+	return msg.sentsegs, msg.segidx, nil
+}
+
+// planKnown is like plan, but the ``old'' segments are only known by their
+// fingerprints and ids.
+func (e *Encoder) planKnown(newsegs []Segment, known map[string]int, numold int, srcIA, dstIA addr.IA) (*message, error) {
+	for _, newseg := range newsegs {
+		if err := Validate(newseg); err != nil {
+			return nil, err
+		}
+	}
+	segidx := make(map[string]int, len(known))
+	for fprint, idx := range known {
+		if idx < 0 || idx >= numold {
+			return nil, fmt.Errorf("known segment id %d is not in the range of %d old segments", idx, numold)
+		}
+		segidx[fprint] = idx
+	}
+	sentsegs, accepted := planSegments(newsegs, nil, segidx, numold)
+	if numold+len(sentsegs) > maxNumsegs+1 {
+		return nil, fmt.Errorf("%w: segment ids of %d old and %d new segments exceed %d", ErrTooManySegments, numold, len(sentsegs), maxNumsegs)
+	}
+	return e.encodeHead(sentsegs, accepted, segidx, srcIA, dstIA)
+}
+
+// message is a planned message of which only the header, including the
+// message options and the interface table, is encoded. The segments are
+// encoded once the message is assembled or written.
+type message struct {
+	head     []byte
+	msglen   int
+	sentsegs []Segment
+	accepted []bool
+	segidx   map[string]int
+	ifidx    map[snet.PathInterface]int
+}
+
+// encodeHead signs the planned segments if the Encoder has a signing key and
+// encodes the header of the message. The checksum is left zero.
+func (e *Encoder) encodeHead(sentsegs []Segment, accepted []bool, segidx map[string]int, srcIA, dstIA addr.IA) (*message, error) {
+	if e.SigningKey != nil {
+		for i := range sentsegs {
+			if accepted[i] {
+				sentsegs[i] = Sign(sentsegs[i], e.SigningKey)
+			}
+		}
+	}
+	numsegs := len(sentsegs)
+	if numsegs > maxNumsegs {
+		return nil, fmt.Errorf("%w: message has %d segments, at most %d are supported", ErrTooManySegments, numsegs, maxNumsegs)
+	}
+
+	// The checksum option is always first, so its value starts at byte 27.
+	msgopts := []Option{{Type: msgOptChecksum, Value: make([]byte, 4)}}
+	if e.RejectReason != NotRejected {
+		msgopts = append(msgopts, Option{Type: msgOptRejectReason, Value: []byte{uint8(e.RejectReason)}})
+	}
+	if e.MaxResponseBytes != 0 {
+		maxbytes := make([]byte, 4)
+		binary.BigEndian.PutUint32(maxbytes, uint32(e.MaxResponseBytes))
+		msgopts = append(msgopts, Option{Type: msgOptMaxResponseBytes, Value: maxbytes})
+	}
+	if e.RequestID != 0 {
+		requestID := make([]byte, 8)
+		binary.BigEndian.PutUint64(requestID, e.RequestID)
+		msgopts = append(msgopts, Option{Type: msgOptRequestID, Value: requestID})
+	}
+	if e.ReplayProtection {
+		nonce, err := newNonce()
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		msgopts = append(msgopts, Option{Type: msgOptNonce, Value: encodeNonce(nonce)})
+	}
+	var ifidx map[snet.PathInterface]int
+	var iftable []snet.PathInterface
+	if e.InternInterfaces {
+		ifidx, iftable = internInterfaces(sentsegs)
+		if len(iftable) <= maxIftable {
+			tablelen := make([]byte, 2)
+			binary.BigEndian.PutUint16(tablelen, uint16(len(iftable)))
+			msgopts = append(msgopts, Option{Type: msgOptInterfaceTable, Value: tablelen})
+		} else { // fall back to the regular encoding
+			ifidx, iftable = nil, nil
+		}
+	}
+	ifsize := 16
+	if ifidx != nil {
+		ifsize = 2
+	}
+
+	hdrlen := HeaderLen + encodedOptionsLen(msgopts)
+	if hdrlen > maxHdrlen {
+		return nil, fmt.Errorf("header has %d bytes, at most %d are supported", hdrlen, maxHdrlen)
+	}
+	msglen := hdrlen + len(iftable)*16
+	for _, sentseg := range sentsegs {
+		msglen += encodedSegmentLen(sentseg, ifsize)
+	}
+	head := make([]byte, hdrlen+len(iftable)*16)
+	header := Header{
+		Version: currentVersion,
+		HdrLen:  uint8(hdrlen),
+		NumSegs: uint16(numsegs),
+		MsgLen:  uint32(msglen),
+		SrcIA:   srcIA,
+		DstIA:   dstIA,
+	}
+	header.EncodeHeader(head)
+	encodeOptions(head[HeaderLen:], msgopts)
+	if _, err := EncodeInterfacesTo(head[hdrlen:], iftable); err != nil {
+		return nil, err
+	}
+	return &message{
+		head:     head,
+		msglen:   msglen,
+		sentsegs: sentsegs,
+		accepted: accepted,
+		segidx:   segidx,
+		ifidx:    ifidx,
+	}, nil
+}
+
+// bytes assembles the message in a buffer that is allocated once with the
+// exact size of the message.
+func (m *message) bytes() ([]byte, error) {
+	allbytes := make([]byte, len(m.head), m.msglen)
+	copy(allbytes, m.head)
+	for i, sentseg := range m.sentsegs {
+		var err error
+		allbytes, err = appendSegment(allbytes, sentseg, m.accepted[i], m.segidx, m.ifidx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hdrlen := int(allbytes[1])
+	binary.BigEndian.PutUint32(allbytes[27:], crc32.Checksum(allbytes[hdrlen:], castagnoli))
+	return allbytes, nil
+}
+
+// writeTo writes the message to the stream piecewise: the header, and then
+// every segment with a write of its own. Only the header and one segment are
+// held in memory at a time. Since the checksum in the header covers the
+// segments, they are encoded twice, first to compute the checksum and then to
+// be written, and nothing is written if a segment fails to encode.
+func (m *message) writeTo(stream io.Writer) error {
+	hdrlen := int(m.head[1])
+	checksum := crc32.Checksum(m.head[hdrlen:], castagnoli) // interface table
+	var chunk []byte
+	for i, sentseg := range m.sentsegs {
+		var err error
+		chunk, err = appendSegment(chunk[:0], sentseg, m.accepted[i], m.segidx, m.ifidx)
+		if err != nil {
+			return err
+		}
+		checksum = crc32.Update(checksum, castagnoli, chunk)
+	}
+	binary.BigEndian.PutUint32(m.head[27:], checksum)
+	if _, err := stream.Write(m.head); err != nil {
+		return err
+	}
+	for i, sentseg := range m.sentsegs {
+		chunk, _ = appendSegment(chunk[:0], sentseg, m.accepted[i], m.segidx, m.ifidx)
+		if _, err := stream.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// planMessage determines which segments need to be transmitted in which order
+// and whether they are accepted. It also assigns ids to the segments.
+func planMessage(newsegs, oldsegs []Segment) ([]Segment, []bool, map[string]int) {
 	segidx := make(map[string]int)
 	for idx, seg := range oldsegs {
-		segidx[seg.Fingerprint()] = idx
+		// A nil old segment, e.g., a skipped segment of an unknown type,
+		// cannot be referred to.
+		if seg != nil {
+			segidx[seg.Fingerprint()] = idx
+		}
 	}
-	currentIdx := len(oldsegs)
+	sentsegs, accepted := planSegments(newsegs, oldsegs, segidx, len(oldsegs))
+	return sentsegs, accepted, segidx
+}
+
+// planSegments plans a message given the ids of the numold ``old'' segments in
+// segidx, which it extends with the ids of the transmitted segments. If the old
+// segments themselves are not available, i.e., if len(oldsegs) < numold, a
+// segment that was seen in an old message is accepted by a composition that
+// refers to the new segment instead of the old one. Both have the same
+// fingerprint and therefore the same encoding.
+func planSegments(newsegs, oldsegs []Segment, segidx map[string]int, numold int) ([]Segment, []bool) {
+	currentIdx := numold
 	sentsegs := make([]Segment, 0)
+	accepted := make([]bool, 0)
 
 	for _, newseg := range newsegs {
-		// encode (unaccepted) subsegments
+		// (unaccepted) subsegments
 		subsegs := recursiveSubsegments(newseg)
 		for _, subseg := range subsegs {
 			fprint := subseg.Fingerprint()
 			if _, ok := segidx[fprint]; !ok { // not seen before
 				segidx[fprint] = currentIdx
 				currentIdx++
-				accepted := false
-				allbytes = append(allbytes, encodeSegment(subseg, accepted, segidx)...)
 				sentsegs = append(sentsegs, subseg)
+				accepted = append(accepted, false)
 			}
 		}
-		// encode (accepted) segment
+		// (accepted) segment
 		fprint := newseg.Fingerprint()
 		if idx, ok := segidx[fprint]; !ok { // not seen before
 			segidx[fprint] = currentIdx
 			currentIdx++
-			accepted := true
-			allbytes = append(allbytes, encodeSegment(newseg, accepted, segidx)...)
 			sentsegs = append(sentsegs, newseg)
 		} else { // seen before
+			// The segment already has an id, either from an earlier message
+			// or as a subsegment of this message. It is accepted by sending
+			// a composition that merely references this id. The composition
+			// occupies a new id, but the fingerprint keeps mapping to the
+			// original id, which later references should use.
+			seen := newseg
+			if idx < len(oldsegs) {
+				seen = oldsegs[idx]
+			} else if idx >= numold {
+				seen = sentsegs[idx-numold]
+			}
 			currentIdx++
-			accepted := true
-			allbytes = append(allbytes, encodeSegment(FromSegments(oldsegs[idx]), accepted, segidx)...)
-			sentsegs = append(sentsegs, FromSegments(oldsegs[idx]))
+			sentsegs = append(sentsegs, FromSegments(seen))
+		}
+		accepted = append(accepted, true)
+	}
+	return sentsegs, accepted
+}
+
+// internInterfaces assigns a table index to every distinct interface of the
+// given segment literals, in order of first occurrence.
+func internInterfaces(segments []Segment) (map[snet.PathInterface]int, []snet.PathInterface) {
+	ifidx := make(map[snet.PathInterface]int)
+	iftable := make([]snet.PathInterface, 0)
+	for _, segment := range segments {
+		if literal, ok := segment.(Literal); ok {
+			for _, iface := range literal.Interfaces {
+				if _, ok := ifidx[iface]; !ok {
+					ifidx[iface] = len(iftable)
+					iftable = append(iftable, iface)
+				}
+			}
 		}
 	}
+	return ifidx, iftable
+}
+
+// maxSeglen is the maximum number of interfaces of a literal and the maximum
+// number of subsegments of a composition that fit into the seglen field.
+const maxSeglen = 1<<8 - 1
+
+// encodedSegmentLen returns the number of bytes of an encoded segment if every
+// interface of a literal occupies ifsize bytes.
+func encodedSegmentLen(segment Segment, ifsize int) int {
+	if codec, ok := codecOf(segment); ok {
+		return codec.encodedLen(segment, ifsize)
+	}
+	return 4
+}
 
-	numsegs := uint16(currentIdx - len(oldsegs))
-	binary.BigEndian.PutUint16(allbytes[2:], numsegs)
-	binary.BigEndian.PutUint32(allbytes[4:], uint32(len(allbytes)))
-	return allbytes, sentsegs
+func encodedLiteralLen(segment Segment, ifsize int) int {
+	literal := segment.(Literal)
+	return 4 + len(literal.Interfaces)*ifsize + encodedOptionsLen(literal.Options)
 }
 
-func encodeSegment(segment Segment, accepted bool, segidx map[string]int) []byte {
+func encodedCompositionLen(segment Segment, ifsize int) int {
+	composition := segment.(Composition)
+	return 4 + len(composition.Segments)*2 + encodedOptionsLen(composition.Options)
+}
+
+// appendSegment appends the encoded segment to the given bytes.
+func appendSegment(bytes []byte, segment Segment, accepted bool, segidx map[string]int, ifidx map[snet.PathInterface]int) ([]byte, error) {
 	var flags uint8
-	var seglen, optlen int
 	if accepted {
 		flags = segAcceptedTrue
 	} else {
 		flags = segAcceptedFalse
 	}
-	var bytes []byte
+	offset := len(bytes)
+	codec, ok := codecOf(segment)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T is not registered", ErrUnknownType, segment)
+	}
+	flags |= codec.segtype.flags()
+	bytes = append(bytes, make([]byte, 4)...)
+	bytes, seglen, optlen, err := codec.appendBody(bytes, segment, &encodeState{segidx: segidx, ifidx: ifidx})
+	if err != nil {
+		return nil, err
+	}
 
-	switch s := segment.(type) {
-	case Literal:
-		flags |= segTypeLiteral
-		seglen = len(s.Interfaces)
-		bytes = make([]byte, 4+seglen*16+optlen)
-		encodeInterfaces(bytes[4:], s.Interfaces)
-	case Composition:
-		flags |= segTypeComposition
-		seglen = len(s.Segments)
-		bytes = make([]byte, 4+seglen*2+optlen)
-		for i, subseg := range s.Segments {
-			binary.BigEndian.PutUint16(bytes[4+i*2:], uint16(segidx[subseg.Fingerprint()]))
+	bytes[offset] = flags
+	bytes[offset+1] = uint8(seglen)
+	binary.BigEndian.PutUint16(bytes[offset+2:], uint16(optlen))
+	return bytes, nil
+}
+
+// appendLiteral appends the body of a segment literal.
+func appendLiteral(bytes []byte, segment Segment, state *encodeState) ([]byte, int, int, error) {
+	literal := segment.(Literal)
+	seglen := len(literal.Interfaces)
+	if seglen > maxSeglen {
+		return nil, 0, 0, fmt.Errorf("literal has %d interfaces, at most %d are supported", seglen, maxSeglen)
+	}
+	optlen := encodedOptionsLen(literal.Options)
+	if optlen > maxOptlen {
+		return nil, 0, 0, fmt.Errorf("literal has %d bytes of options, at most %d are supported", optlen, maxOptlen)
+	}
+	ifsize := 16
+	if state.ifidx != nil {
+		ifsize = 2
+	}
+	offset := len(bytes)
+	bytes = append(bytes, make([]byte, seglen*ifsize+optlen)...)
+	body := bytes[offset:]
+	if state.ifidx != nil {
+		for i, iface := range literal.Interfaces {
+			binary.BigEndian.PutUint16(body[i*2:], uint16(state.ifidx[iface]))
 		}
+	} else if _, err := EncodeInterfacesTo(body, literal.Interfaces); err != nil {
+		return nil, 0, 0, err
 	}
+	encodeOptions(body[seglen*ifsize:], literal.Options)
+	return bytes, seglen, optlen, nil
+}
 
-	bytes[0] = flags
-	bytes[1] = uint8(seglen)
-	binary.BigEndian.PutUint16(bytes[2:], uint16(optlen))
-	return bytes
+// appendComposition appends the body of a segment composition, which refers
+// to its subsegments by their ids.
+func appendComposition(bytes []byte, segment Segment, state *encodeState) ([]byte, int, int, error) {
+	composition := segment.(Composition)
+	seglen := len(composition.Segments)
+	if seglen == 0 {
+		return nil, 0, 0, errors.New("composition has no segments")
+	}
+	if seglen > maxSeglen {
+		return nil, 0, 0, fmt.Errorf("composition has %d subsegments, at most %d are supported", seglen, maxSeglen)
+	}
+	optlen := encodedOptionsLen(composition.Options)
+	if optlen > maxOptlen {
+		return nil, 0, 0, fmt.Errorf("composition has %d bytes of options, at most %d are supported", optlen, maxOptlen)
+	}
+	offset := len(bytes)
+	bytes = append(bytes, make([]byte, seglen*2+optlen)...)
+	body := bytes[offset:]
+	for i, subseg := range composition.Segments {
+		id, ok := state.segidx[subseg.Fingerprint()]
+		if !ok {
+			return nil, 0, 0, fmt.Errorf("subsegment %d of composition has no segment id", i)
+		}
+		binary.BigEndian.PutUint16(body[i*2:], uint16(id))
+	}
+	encodeOptions(body[seglen*2:], composition.Options)
+	return bytes, seglen, optlen, nil
 }
 
+// recursiveSubsegments returns all subsegments of a segment, excluding the
+// segment itself, in post-order. Unlike the pre-order of Walk, this is the
+// order of transmission, in which every subsegment precedes its compositions.
 func recursiveSubsegments(segment Segment) []Segment {
 	switch s := segment.(type) {
 	case Composition:
@@ -216,6 +984,19 @@ func recursiveSubsegments(segment Segment) []Segment {
 	return []Segment{}
 }
 
+// EncodeInterfacesTo encodes path interfaces into the buffer, where each
+// interface is represented by its 8-byte interface ID followed by its 8-byte
+// ISD-AS address. It returns the number of bytes written, or an error if the
+// buffer is too short, in which case nothing is written.
+func EncodeInterfacesTo(bytes []byte, interfaces []snet.PathInterface) (int, error) {
+	n := len(interfaces) * 16
+	if len(bytes) < n {
+		return 0, fmt.Errorf("%w: %d interfaces exceed buffer of length %d", ErrShortBuffer, len(interfaces), len(bytes))
+	}
+	encodeInterfaces(bytes, interfaces)
+	return n, nil
+}
+
 func encodeInterfaces(bytes []byte, interfaces []snet.PathInterface) {
 	for i, iface := range interfaces {
 		binary.BigEndian.PutUint64(bytes[i*16:], uint64(iface.ID))
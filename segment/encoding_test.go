@@ -0,0 +1,1440 @@
+package segment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+func TestDecodeTruncatedSegments(t *testing.T) {
+	literals := []Segment{
+		FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+	}
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	tests := []struct {
+		name    string
+		newsegs []Segment
+	}{
+		{"literal", literals[:1]},
+		{"literals", literals},
+		{"composition", []Segment{FromSegments(literals...)}},
+	}
+	for _, test := range tests {
+		bytes, _, err := EncodeSegments(test.newsegs, []Segment{}, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if _, _, _, _, err := DecodeSegments(bytes, []Segment{}); err != nil {
+			t.Fatal(test.name, "untruncated:", err)
+		}
+		for n := 0; n < len(bytes); n++ {
+			_, _, _, _, err := DecodeSegments(bytes[:n], []Segment{})
+			if err == nil {
+				t.Error(test.name, "truncated to", n, "bytes: want error, have nil")
+			}
+		}
+	}
+}
+
+func TestEncodeTooLongSegments(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	interfaces := make([]snet.PathInterface, maxSeglen+1)
+	for i := range interfaces {
+		interfaces[i] = snet.PathInterface{ID: common.IFIDType(i), IA: srcIA}
+	}
+	literal := FromInterfaces(interfaces...)
+	if _, _, err := EncodeSegments([]Segment{literal}, []Segment{}, srcIA, dstIA); err == nil {
+		t.Error("literal with", len(interfaces), "interfaces: want error, have nil")
+	}
+	literal = FromInterfaces(interfaces[:maxSeglen]...)
+	if _, _, err := EncodeSegments([]Segment{literal}, []Segment{}, srcIA, dstIA); err != nil {
+		t.Error("literal with", maxSeglen, "interfaces:", err)
+	}
+
+	subsegs := make([]Segment, maxSeglen+1)
+	for i := range subsegs {
+		subsegs[i] = FromInterfaces(interfaces[i])
+	}
+	composition := FromSegments(subsegs...)
+	if _, _, err := EncodeSegments([]Segment{composition}, []Segment{}, srcIA, dstIA); err == nil {
+		t.Error("composition with", len(subsegs), "subsegments: want error, have nil")
+	}
+}
+
+func TestDecodeVersion(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	newsegs := []Segment{FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	bytes, _, err := EncodeSegments(newsegs, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes[0] != currentVersion {
+		t.Fatal("want version:", currentVersion, "have:", bytes[0])
+	}
+	bytes[0] = versionUnversioned
+	if _, _, _, _, err := DecodeSegments(bytes, []Segment{}); err != nil {
+		t.Error("unversioned message:", err)
+	}
+	bytes[0] = currentVersion + 1
+	if _, _, _, _, err := DecodeSegments(bytes, []Segment{}); err == nil {
+		t.Error("unknown version: want error, have nil")
+	}
+}
+
+func TestOptionsRoundTrip(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	literal := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302").(Literal)
+	literal.Options = []Option{{Type: 1, Value: []byte{0x05, 0xdc}}, {Type: 0xff, Value: []byte{}}}
+	composition := FromSegments(literal, FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")).(Composition)
+	composition.Options = []Option{{Type: 42, Value: []byte("policy")}}
+	bytes, _, err := EncodeSegments([]Segment{composition}, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newsegs, accsegs, _, _, err := DecodeSegments(bytes, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOptions(newsegs[0].(Literal).Options, literal.Options, t)
+	assertOptions(newsegs[1].(Literal).Options, []Option{}, t)
+	assertOptions(accsegs[0].(Composition).Options, composition.Options, t)
+}
+
+func TestWithOptions(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	options := []Option{{Type: 7, Value: []byte("first")}, {Type: 3, Value: []byte("second")}}
+	for _, segment := range []Segment{a, FromSegments(a, b)} {
+		withopts := WithOptions(segment, options...)
+		if !withopts.Equal(segment) || withopts.Fingerprint() != segment.Fingerprint() {
+			t.Error("want", segment, "have", withopts)
+		}
+		options[0].Value[0] = 'F' // the options are copied
+		msg, _, err := EncodeSegments([]Segment{withopts}, []Segment{}, a.SrcIA(), b.DstIA())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, accsegs, _, _, err := DecodeSegments(msg, []Segment{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Option{{Type: 7, Value: []byte("first")}, {Type: 3, Value: []byte("second")}}
+		switch s := accsegs[0].(type) {
+		case Literal:
+			assertOptions(s.Options, want, t)
+		case Composition:
+			assertOptions(s.Options, want, t)
+		}
+		options[0].Value[0] = 'f'
+	}
+	if len(a.(Literal).Options) != 0 {
+		t.Error("original segment has options", a.(Literal).Options)
+	}
+	// Further options are appended to the existing options.
+	withopts := WithOptions(WithOptions(a, options[0]), options[1]).(Literal)
+	assertOptions(withopts.Options, options, t)
+}
+
+func assertOptions(have, want []Option, t *testing.T) {
+	if len(have) != len(want) {
+		t.Fatal("options have not right length, want:", len(want), ", have:", len(have))
+	}
+	for i := range have {
+		if have[i].Type != want[i].Type || string(have[i].Value) != string(want[i].Value) {
+			t.Error("want:", want[i], "have:", have[i])
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	msg1, sentsegs, err := EncodeSegments([]Segment{a, b}, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg2, _, err := EncodeSegments([]Segment{FromSegments(a, b)}, sentsegs, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := bytes.NewReader(append(append([]byte(nil), msg1...), msg2...))
+	decoder := NewDecoder(stream)
+	newsegs, _, _, _, err := decoder.Decode([]Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, accsegs, _, _, err := decoder.Decode(newsegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accsegs) != 1 || !accsegs[0].Equal(FromSegments(a, b)) {
+		t.Error("want:", FromSegments(a, b), "have:", accsegs)
+	}
+	if _, _, _, _, err := decoder.Decode(newsegs); err != io.EOF {
+		t.Error("want:", io.EOF, "have:", err)
+	}
+
+	for _, n := range []int{10, 24, len(msg1) - 1} {
+		_, _, _, _, err := NewDecoder(bytes.NewReader(msg1[:n])).Decode([]Segment{})
+		if err != io.ErrUnexpectedEOF {
+			t.Error("truncated to", n, "bytes, want:", io.ErrUnexpectedEOF, "have:", err)
+		}
+	}
+}
+
+func TestEncoderDecoderPipe(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102 2>1 17-ffaa:0:1107")
+	newsegs := []Segment{a, FromSegments(a, b, c)}
+	r, w := io.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := NewEncoder(w).Encode(newsegs, []Segment{}, srcIA, dstIA)
+		errs <- err
+	}()
+	_, accsegs, decSrcIA, decDstIA, err := NewDecoder(r).Decode([]Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if decSrcIA != srcIA || decDstIA != dstIA {
+		t.Error("want:", srcIA, dstIA, "have:", decSrcIA, decDstIA)
+	}
+	if len(accsegs) != len(newsegs) {
+		t.Fatal("segments have not right length, want:", len(newsegs), ", have:", len(accsegs))
+	}
+	for i := range accsegs {
+		if !accsegs[i].Equal(newsegs[i]) {
+			t.Error("want:", newsegs[i], "have:", accsegs[i])
+		}
+	}
+}
+
+// recordingWriter records every call to Write.
+type recordingWriter struct {
+	writes [][]byte
+}
+
+func (w *recordingWriter) Write(bytes []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte(nil), bytes...))
+	return len(bytes), nil
+}
+
+func TestEncoderWritesPiecewise(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	newsegs := []Segment{a, FromSegments(a, b)}
+	for _, intern := range []bool{false, true} {
+		var w recordingWriter
+		encoder := NewEncoder(&w)
+		encoder.InternInterfaces = intern
+		sentsegs, err := encoder.Encode(newsegs, []Segment{}, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// One write for the header and one for every segment.
+		if len(w.writes) != 1+len(sentsegs) {
+			t.Error("intern", intern, "want", 1+len(sentsegs), "writes, have", len(w.writes))
+		}
+		encoder = new(Encoder)
+		encoder.InternInterfaces = intern
+		want, _, err := encoder.encodeMessage(newsegs, []Segment{}, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := bytes.Join(w.writes, nil); !bytes.Equal(have, want) {
+			t.Error("intern", intern, "streamed message differs from the assembled message")
+		}
+	}
+}
+
+type recordingObserver struct {
+	encoded, decoded []int
+	errs             []error
+}
+
+func (ro *recordingObserver) ObserveEncode(numsegs, bytes int) {
+	ro.encoded = append(ro.encoded, numsegs, bytes)
+}
+
+func (ro *recordingObserver) ObserveDecode(numsegs, bytes int, err error) {
+	ro.decoded = append(ro.decoded, numsegs, bytes)
+	ro.errs = append(ro.errs, err)
+}
+
+func TestObserver(t *testing.T) {
+	ro := new(recordingObserver)
+	SetObserver(ro)
+	defer SetObserver(nil)
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	msg, _, err := EncodeSegments([]Segment{FromSegments(a, b)}, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DecodeSegments(msg, []Segment{})
+	DecodeSegments(msg[:len(msg)-1], []Segment{})
+	NewDecoder(bytes.NewReader(msg[:10])).Decode([]Segment{})
+	NewDecoder(bytes.NewReader(nil)).Decode([]Segment{})
+
+	if len(ro.encoded) != 2 || ro.encoded[0] != 3 || ro.encoded[1] != len(msg) {
+		t.Error("want encode observation:", []int{3, len(msg)}, "have:", ro.encoded)
+	}
+	want := []int{3, len(msg), 0, len(msg) - 1, 0, 10}
+	if len(ro.decoded) != len(want) {
+		t.Fatal("want decode observations:", want, "have:", ro.decoded)
+	}
+	for i := range want {
+		if ro.decoded[i] != want[i] {
+			t.Error("want decode observations:", want, "have:", ro.decoded)
+			break
+		}
+	}
+	if ro.errs[0] != nil || ro.errs[1] == nil || ro.errs[2] != io.ErrUnexpectedEOF {
+		t.Error("want errors: [nil <error> unexpected EOF], have:", ro.errs)
+	}
+}
+
+func TestInternInterfaces(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	prefix := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108 2>1 17-ffaa:0:1102")
+	newsegs := make([]Segment, 0)
+	for i := 0; i < 32; i++ {
+		suffix := []snet.PathInterface{
+			{ID: common.IFIDType(100 + i), IA: prefix.DstIA()},
+			{ID: common.IFIDType(1), IA: dstIA},
+		}
+		newsegs = append(newsegs, FromInterfaces(append(prefix.PathInterfaces(), suffix...)...))
+	}
+
+	plain, _, err := EncodeSegments(newsegs, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	encoder.InternInterfaces = true
+	if _, err := encoder.Encode(newsegs, []Segment{}, srcIA, dstIA); err != nil {
+		t.Fatal(err)
+	}
+	interned := buf.Bytes()
+	// 32 literals with 8 interfaces each, of which 6 are shared by all and 1
+	// is shared by all but the first occurrence: 39 instead of 256 interfaces
+	// are transmitted, plus 2 instead of 16 bytes per interface reference.
+	if len(interned) > len(plain)/3 {
+		t.Error("interned message has", len(interned), "bytes, plain message has", len(plain))
+	}
+	_, accsegs, _, _, err := DecodeSegments(interned, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accsegs) != len(newsegs) {
+		t.Fatal("segments have not right length, want:", len(newsegs), ", have:", len(accsegs))
+	}
+	for i := range accsegs {
+		if !accsegs[i].Equal(newsegs[i]) {
+			t.Error("want:", newsegs[i], "have:", accsegs[i])
+		}
+	}
+}
+
+func TestEncodedSize(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102 2>1 17-ffaa:0:1107")
+	newsegs := []Segment{a, FromSegments(a, b), FromSegments(FromSegments(a, b), c)}
+	bytes, _, err := EncodeSegments(newsegs, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := EncodedSize(newsegs); size != len(bytes) || size != cap(bytes) {
+		t.Error("want size:", len(bytes), "have:", size, "capacity:", cap(bytes))
+	}
+}
+
+// BenchmarkEncodeSegments encodes 500 literals, as well as the inputs of
+// benchmarkInputs.
+func BenchmarkEncodeSegments(b *testing.B) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	inputs := append([]benchmarkInput{{"literals/500", generateLiterals(500, 6, srcIA, dstIA)}}, benchmarkInputs()...)
+	for _, input := range inputs {
+		b.Run(input.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := EncodeSegments(input.segments, []Segment{}, srcIA, dstIA); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// generateLiterals generates n disjoint segment literals with a given number
+// of hops between a source and destination ISD-AS address pair.
+func generateLiterals(n, hops int, srcIA, dstIA addr.IA) []Segment {
+	segments := make([]Segment, n)
+	for i := range segments {
+		interfaces := make([]snet.PathInterface, (hops-1)*2)
+		interfaces[0] = snet.PathInterface{ID: common.IFIDType(i), IA: srcIA}
+		for j := 1; j < hops-1; j++ {
+			ia := addr.IA{I: srcIA.I, A: srcIA.A + addr.AS(j)}
+			interfaces[2*j-1] = snet.PathInterface{ID: common.IFIDType(i*hops + j), IA: ia}
+			interfaces[2*j] = snet.PathInterface{ID: common.IFIDType(i*hops + j + 1), IA: ia}
+		}
+		interfaces[len(interfaces)-1] = snet.PathInterface{ID: common.IFIDType(i), IA: dstIA}
+		segments[i] = FromInterfaces(interfaces...)
+	}
+	return segments
+}
+
+func TestChecksum(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	msg, _, err := EncodeSegments([]Segment{FromSegments(a, b)}, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrlen := int(msg[1])
+	for _, offset := range []int{hdrlen, hdrlen + 20, len(msg) - 1} {
+		corrupted := append([]byte(nil), msg...)
+		corrupted[offset] ^= 0x10
+		_, _, _, _, err := DecodeSegments(corrupted, []Segment{})
+		if err == nil || err.Error() != "segment payload checksum mismatch" {
+			t.Error("bit flip at offset", offset, "want checksum mismatch, have:", err)
+		}
+	}
+	// Versions without checksum are decoded without verification.
+	for _, version := range []uint8{version1, version2} {
+		unchecked := append([]byte(nil), msg...)
+		unchecked[0] = version
+		unchecked[hdrlen+20] ^= 0x10
+		if _, _, _, _, err := DecodeSegments(unchecked, []Segment{}); err != nil {
+			t.Error("version", version, "message:", err)
+		}
+	}
+}
+
+func TestEncodeDeterministic(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	newsegs := func() []Segment {
+		a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+		b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+		c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102 2>1 17-ffaa:0:1107")
+		d := FromString("19-ffaa:0:1302 3>2 17-ffaa:0:1108")
+		return []Segment{c, FromSegments(a, b, c), FromSegments(FromSegments(a, d), c)}
+	}
+	oldsegs := []Segment{FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	for _, intern := range []bool{false, true} {
+		var buf1, buf2 bytes.Buffer
+		encoder1, encoder2 := NewEncoder(&buf1), NewEncoder(&buf2)
+		encoder1.InternInterfaces, encoder2.InternInterfaces = intern, intern
+		if _, err := encoder1.Encode(newsegs(), oldsegs, srcIA, dstIA); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := encoder2.Encode(newsegs(), oldsegs, srcIA, dstIA); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf1.Bytes(), buf2.Bytes()) {
+			t.Error("interning:", intern, "encodings differ:", buf1.Bytes(), buf2.Bytes())
+		}
+	}
+}
+
+func TestEncodeSeenBefore(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	ab := FromSegments(a, b)
+	tests := []struct {
+		name    string
+		newsegs []Segment
+		oldsegs []Segment
+	}{
+		{"old segment", []Segment{a}, []Segment{b, a}},
+		{"old composition as literal", []Segment{FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")}, []Segment{ab}},
+		{"subsegment of same message", []Segment{ab, b}, []Segment{}},
+		{"duplicate in same message", []Segment{a, FromSegments(a, b), a}, []Segment{}},
+	}
+	for _, test := range tests {
+		msg, sentsegs, err := EncodeSegments(test.newsegs, test.oldsegs, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		newsegs, accsegs, _, _, err := DecodeSegments(msg, test.oldsegs)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		if len(newsegs) != len(sentsegs) || len(accsegs) != len(test.newsegs) {
+			t.Fatal(test.name, "want:", len(sentsegs), len(test.newsegs), "have:", len(newsegs), len(accsegs))
+		}
+		for i := range newsegs {
+			if !newsegs[i].Equal(sentsegs[i]) {
+				t.Error(test.name, "want:", sentsegs[i], "have:", newsegs[i])
+			}
+		}
+		for i := range accsegs {
+			if accsegs[i].Fingerprint() != test.newsegs[i].Fingerprint() {
+				t.Error(test.name, "want:", test.newsegs[i], "have:", accsegs[i])
+			}
+		}
+	}
+	// The accepted reference must resolve to the structure known to both.
+	msg, _, _ := EncodeSegments([]Segment{FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")}, []Segment{ab}, srcIA, dstIA)
+	_, accsegs, _, _, _ := DecodeSegments(msg, []Segment{ab})
+	if !accsegs[0].Equal(FromSegments(ab)) {
+		t.Error("want:", FromSegments(ab), "have:", accsegs[0])
+	}
+}
+
+func TestCompactSegments(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	ab := FromSegments(a, b)
+	_, sentsegs, err := EncodeSegments([]Segment{a, ab, a}, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The encoded segments stay indexed by segment ids: a, b, ab, and the
+	// reference that accepts a again.
+	if len(sentsegs) != 4 {
+		t.Fatal("want 4 encoded segments, have", sentsegs)
+	}
+	compact := CompactSegments(sentsegs)
+	assertFingerprints(t, compact, []Segment{a, b, ab})
+	for _, segment := range compact {
+		if composition, ok := segment.(Composition); ok && len(composition.Segments) == 1 {
+			t.Error("redundant reference", segment)
+		}
+	}
+}
+
+// craftNestedMessage crafts a version 1 message consisting of a segment
+// literal with two interfaces and n compositions, each of which references
+// the previous segment fanout times.
+func craftNestedMessage(n, fanout int) []byte {
+	return craftNestedMessageWithLeaf(n, fanout, 2)
+}
+
+// craftNestedMessageWithLeaf is like craftNestedMessage, but the literal has
+// the given number of zero interfaces.
+func craftNestedMessageWithLeaf(n, fanout, leaflen int) []byte {
+	msg := make([]byte, 24, 24+4+16*leaflen+n*(4+2*fanout))
+	msg[0], msg[1] = version1, 24
+	binary.BigEndian.PutUint16(msg[2:], uint16(n+1))
+	msg = append(msg, segTypeLiteral|segAcceptedFalse, uint8(leaflen), 0, 0)
+	msg = append(msg, make([]byte, 16*leaflen)...)
+	for i := 0; i < n; i++ {
+		msg = append(msg, segTypeComposition|segAcceptedTrue, uint8(fanout), 0, 0)
+		for j := 0; j < fanout; j++ {
+			msg = append(msg, 0, 0)
+			binary.BigEndian.PutUint16(msg[len(msg)-2:], uint16(i))
+		}
+	}
+	binary.BigEndian.PutUint32(msg[4:], uint32(len(msg)))
+	return msg
+}
+
+func TestDecodeLimits(t *testing.T) {
+	deep := craftNestedMessage(DefaultMaxDepth, 1)
+	if _, _, _, _, err := DecodeSegments(deep, []Segment{}); err == nil || !strings.Contains(err.Error(), "depth") {
+		t.Error("deep nesting: want depth error, have:", err)
+	}
+	decoder := NewDecoder(bytes.NewReader(deep))
+	decoder.MaxDepth = DefaultMaxDepth + 1
+	if _, _, _, _, err := decoder.Decode([]Segment{}); err != nil {
+		t.Error("deep nesting with raised limit:", err)
+	}
+
+	wide := craftNestedMessage(12, 2) // expands to 2^13 interfaces
+	if _, _, _, _, err := DecodeSegments(wide, []Segment{}); err == nil || !strings.Contains(err.Error(), "interfaces") {
+		t.Error("exponential expansion: want interface error, have:", err)
+	}
+	decoder = NewDecoder(bytes.NewReader(craftNestedMessage(4, 2)))
+	decoder.MaxInterfaces = 16
+	if _, _, _, _, err := decoder.Decode([]Segment{}); err == nil {
+		t.Error("32 interfaces with limit of 16: want error, have nil")
+	}
+
+	// An empty literal adds no interfaces, so that only the expanded size
+	// bounds compositions that expand to 50^6 segments.
+	empty := craftNestedMessageWithLeaf(6, 50, 0)
+	if _, _, _, _, err := DecodeSegments(empty, []Segment{}); err == nil || !strings.Contains(err.Error(), "expanded size") {
+		t.Error("exponential expansion of empty literal: want expanded size error, have:", err)
+	}
+	decoder = NewDecoder(bytes.NewReader(craftNestedMessageWithLeaf(2, 50, 0)))
+	decoder.MaxExpandedSize = 2550
+	if _, _, _, _, err := decoder.Decode([]Segment{}); err == nil {
+		t.Error("expanded size 2551 with limit of 2550: want error, have nil")
+	}
+	decoder = NewDecoder(bytes.NewReader(craftNestedMessage(DefaultMaxDepth-1, 1)))
+	decoder.MaxTotalExpandedSize = 100
+	if _, _, _, _, err := decoder.Decode([]Segment{}); err == nil || !strings.Contains(err.Error(), "of message") {
+		t.Error("total expanded size above limit of 100: want error, have:", err)
+	}
+
+	// The expanded size of old segments is known without flattening them.
+	oldsegs := []Segment{FromInterfaces()}
+	for i := 0; i < 6; i++ {
+		subsegs := make([]Segment, 50)
+		for j := range subsegs {
+			subsegs[j] = oldsegs[i]
+		}
+		oldsegs = append(oldsegs, FromSegments(subsegs...))
+	}
+	msg := craftNestedMessageWithLeaf(1, 1, 0)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], uint16(len(oldsegs)-1))
+	if _, _, _, _, err := DecodeSegments(msg, oldsegs); err == nil || !strings.Contains(err.Error(), "expanded size") {
+		t.Error("composition of large old segment: want expanded size error, have:", err)
+	}
+}
+
+func TestDecodeMaxSubsegments(t *testing.T) {
+	msg := craftNestedMessage(1, 9) // a composition of 9 subsegments
+	decoder := NewDecoder(bytes.NewReader(msg))
+	decoder.MaxSubsegments = 8
+	if _, _, _, _, err := decoder.Decode([]Segment{}); err == nil || !strings.Contains(err.Error(), "9 subsegments exceed limit of 8") {
+		t.Error("9 subsegments with limit of 8: want error, have", err)
+	}
+	decoder = NewDecoder(bytes.NewReader(msg))
+	decoder.MaxSubsegments = 9
+	if _, _, _, _, err := decoder.Decode([]Segment{}); err != nil {
+		t.Error("9 subsegments with limit of 9:", err)
+	}
+}
+
+func TestDecodeMaxTotalInterfaces(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	literals := generateLiterals(100, 3, srcIA, dstIA) // 4 interfaces each
+	msg, _, err := EncodeSegments(literals, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := NewDecoder(bytes.NewReader(msg))
+	decoder.MaxTotalInterfaces = 399
+	if _, _, _, _, err := decoder.Decode([]Segment{}); err == nil || !strings.Contains(err.Error(), "segment 99: 400 interfaces of message exceed limit of 399") {
+		t.Error("400 interfaces with limit of 399: want error at the last segment, have", err)
+	}
+	decoder = NewDecoder(bytes.NewReader(msg))
+	decoder.MaxTotalInterfaces = 400
+	if _, _, _, _, err := decoder.Decode([]Segment{}); err != nil {
+		t.Error("400 interfaces with limit of 400:", err)
+	}
+}
+
+func TestDecodeForwardReference(t *testing.T) {
+	for _, id := range []uint16{1, 2} { // self reference, forward reference
+		msg := craftNestedMessage(2, 1)
+		binary.BigEndian.PutUint16(msg[24+36+4:], id) // first composition
+		_, _, _, _, err := DecodeSegments(msg, []Segment{})
+		if err == nil {
+			t.Error("reference to id", id, "from segment 1: want error, have nil")
+		}
+	}
+	oldsegs := []Segment{FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	msg := craftNestedMessage(2, 1)
+	binary.BigEndian.PutUint16(msg[24+36+4:], 1) // segment 0 of this message
+	if _, _, _, _, err := DecodeSegments(msg, oldsegs); err != nil {
+		t.Error("backward reference with one old segment:", err)
+	}
+}
+
+func TestDecodeEmptyComposition(t *testing.T) {
+	msg := craftNestedMessage(1, 1)
+	msg[24+36+1] = 0 // seglen of the composition
+	if _, _, _, _, err := DecodeSegments(msg, []Segment{}); err == nil || !strings.Contains(err.Error(), "no segments") {
+		t.Error("composition without subsegments: want error, have", err)
+	}
+	srcIA, dstIA := addr.IA{}, addr.IA{}
+	if _, _, err := EncodeSegments([]Segment{FromSegments()}, []Segment{}, srcIA, dstIA); err == nil {
+		t.Error("encode composition without subsegments: want error, have nil")
+	}
+}
+
+func TestDecodeDanglingReference(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	msg, _, err := EncodeSegments([]Segment{FromSegments(a, b)}, []Segment{a, b}, a.SrcIA(), b.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The id of b is in range, but the receiver does not know the segment.
+	_, _, _, _, err = DecodeSegments(msg, []Segment{a, nil})
+	if !errors.Is(err, ErrDanglingReference) || !strings.Contains(err.Error(), "id 1") {
+		t.Error("want dangling reference to id 1, have", err)
+	}
+	if err := Validate(Composition{Segments: []Segment{a, nil}}); !errors.Is(err, ErrDanglingReference) {
+		t.Error("composition with nil subsegment: want dangling reference, have", err)
+	}
+}
+
+func TestDecodeSegmentsAccepted(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	newsegs := []Segment{FromSegments(a, b), c}
+	msg, _, err := EncodeSegments(newsegs, []Segment{}, a.SrcIA(), b.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, accepted, _, _, err := DecodeSegmentsAccepted(msg, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bool{false, false, true, true} // a, b, (a, b), c
+	if len(accepted) != len(want) || len(decoded) != len(want) {
+		t.Fatal("want", len(want), "flags, have", len(accepted), "flags for", len(decoded), "segments")
+	}
+	_, accsegs, _, _, _ := DecodeSegments(msg, []Segment{})
+	j := 0
+	for i := range accepted {
+		if accepted[i] != want[i] {
+			t.Error("segment", i, "want accepted", want[i], "have", accepted[i])
+		}
+		if accepted[i] {
+			if j >= len(accsegs) || !accsegs[j].Equal(decoded[i]) {
+				t.Error("segment", i, "is not among the accepted segments in order")
+			}
+			j++
+		}
+	}
+	if j != len(accsegs) {
+		t.Error("want", len(accsegs), "accepted flags, have", j)
+	}
+}
+
+func TestDecoderDedupAccepted(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	// The duplicate of a is sent as a composition with the same fingerprint.
+	msg, _, err := EncodeSegments([]Segment{a, b, a}, []Segment{}, a.SrcIA(), b.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dedup := range []bool{false, true} {
+		decoder := NewDecoder(bytes.NewReader(msg))
+		decoder.DedupAccepted = dedup
+		_, accsegs, _, _, err := decoder.Decode([]Segment{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 3
+		if dedup {
+			want = 2
+		}
+		if len(accsegs) != want {
+			t.Error("dedup", dedup, "want", want, "accepted segments, have", len(accsegs))
+		}
+	}
+}
+
+func TestDecoderReuseInterfaces(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	for _, intern := range []bool{false, true} {
+		var stream bytes.Buffer
+		encoder := NewEncoder(&stream)
+		encoder.InternInterfaces = intern
+		first := []Segment{a, b, FromSegments(a, b)}
+		second := []Segment{c, b, a}
+		for _, newsegs := range [][]Segment{first, second} {
+			if _, err := encoder.Encode(newsegs, []Segment{}, a.SrcIA(), b.DstIA()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		decoder := NewDecoder(&stream)
+		decoder.ReuseInterfaces = true
+		_, accsegs, _, _, err := decoder.Decode([]Segment{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertFingerprints(t, accsegs, first)
+		kept := make([]Segment, len(accsegs))
+		for i, segment := range accsegs {
+			kept[i] = segment.Clone()
+		}
+		_, accsegs, _, _, err = decoder.Decode([]Segment{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertFingerprints(t, accsegs, second)
+		for i, segment := range kept {
+			if !segment.Equal(first[i]) {
+				t.Error("intern", intern, "cloned segment", i, "changed to", segment)
+			}
+		}
+	}
+}
+
+func TestDecoderReset(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	var first, second bytes.Buffer
+	encoder := NewEncoder(&first)
+	encoder.RejectReason = ResponseTooLarge
+	encoder.ReplayProtection = true
+	encoder.RequestID = 42
+	if _, err := encoder.Encode([]Segment{a}, []Segment{}, a.SrcIA(), a.DstIA()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEncoder(&second).Encode([]Segment{b}, []Segment{}, b.SrcIA(), b.DstIA()); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := GetDecoder(&first)
+	decoder.MaxSegments = 1
+	decoder.ReuseInterfaces = true
+	_, accsegs, _, _, err := decoder.Decode([]Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFingerprints(t, accsegs, []Segment{a})
+	if _, ok := decoder.Nonce(); !ok || decoder.RequestID() != 42 || decoder.RejectReason() != ResponseTooLarge {
+		t.Fatal("first message: want nonce, request id, and reject reason")
+	}
+	decoder.Reset(&second)
+	if _, ok := decoder.Nonce(); ok || decoder.RequestID() != 0 || decoder.RejectReason() != NotRejected {
+		t.Error("reset: want no state of the first message")
+	}
+	if decoder.MaxSegments != 1 || !decoder.ReuseInterfaces {
+		t.Error("reset: want limits and options to be kept")
+	}
+	newsegs, accsegs, srcIA, dstIA, err := decoder.Decode([]Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFingerprints(t, newsegs, []Segment{b})
+	assertFingerprints(t, accsegs, []Segment{b})
+	if srcIA != b.SrcIA() || dstIA != b.DstIA() {
+		t.Error("want", b.SrcIA(), b.DstIA(), "have", srcIA, dstIA)
+	}
+	if _, ok := decoder.Nonce(); ok || decoder.RequestID() != 0 || decoder.RejectReason() != NotRejected {
+		t.Error("second message: want no state of the first message")
+	}
+
+	PutDecoder(decoder)
+	decoder = GetDecoder(&first)
+	defer PutDecoder(decoder)
+	if decoder.MaxSegments != 0 || decoder.ReuseInterfaces {
+		t.Error("pooled decoder: want default limits and options")
+	}
+}
+
+func TestEmptyMessage(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	for _, newsegs := range [][]Segment{nil, {}} {
+		msg, sentsegs, err := EncodeSegments(newsegs, nil, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sentsegs == nil || len(sentsegs) != 0 {
+			t.Error("want empty sent segments, have", sentsegs)
+		}
+		if len(msg) != EncodedSize(newsegs) {
+			t.Error("want", EncodedSize(newsegs), "bytes, have", len(msg))
+		}
+		decoded, accsegs, src, dst, err := DecodeSegments(msg, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded == nil || accsegs == nil || len(decoded) != 0 || len(accsegs) != 0 {
+			t.Error("want non-nil empty slices, have", decoded, accsegs)
+		}
+		if src != srcIA || dst != dstIA {
+			t.Error("want", srcIA, dstIA, "have", src, dst)
+		}
+		decoded, accsegs, src, dst, err = NewDecoder(bytes.NewReader(msg)).Decode(nil)
+		if err != nil || decoded == nil || accsegs == nil || src != srcIA || dst != dstIA {
+			t.Error("Decoder: want empty message, have", decoded, accsegs, src, dst, err)
+		}
+	}
+}
+
+func TestEncodeSegmentsKnown(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	oldsegs := []Segment{b, FromSegments(a, b), c}
+	known := map[string]int{}
+	for idx, oldseg := range oldsegs {
+		known[oldseg.Fingerprint()] = idx
+	}
+	tests := [][]Segment{
+		{FromSegments(a, b)},
+		{FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108"), c},
+		{FromSegments(a, FromSegments(b)), a},
+	}
+	for _, newsegs := range tests {
+		want, _, err := EncodeSegments(newsegs, oldsegs, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, sentsegs, err := EncodeSegmentsKnown(newsegs, known, len(oldsegs), srcIA, dstIA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Error(newsegs, "encoding differs from encoding with old segments")
+		}
+		decoded, accsegs, _, _, err := DecodeSegments(have, oldsegs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertFingerprints(t, decoded, sentsegs)
+		assertFingerprints(t, accsegs, newsegs)
+	}
+	if _, _, err := EncodeSegmentsKnown(nil, known, 2, srcIA, dstIA); err == nil {
+		t.Error("known id out of range: want error, have nil")
+	}
+}
+
+func TestEncoderEncodeNext(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	var stream bytes.Buffer
+	encoder := NewEncoder(&stream)
+	messages := [][]Segment{{a, b}, {FromSegments(a, b), c}, {c, a}}
+	wantNumSent := []int{2, 4, 6}
+	for i, newsegs := range messages {
+		if _, err := encoder.EncodeNext(newsegs, srcIA, dstIA); err != nil {
+			t.Fatal(err)
+		}
+		if encoder.NumSent() != wantNumSent[i] {
+			t.Error("message", i, "want", wantNumSent[i], "sent segments, have", encoder.NumSent())
+		}
+	}
+	// The receiver decodes every message with all earlier segments.
+	decoder := NewDecoder(&stream)
+	oldsegs := []Segment{}
+	for i, want := range messages {
+		newsegs, accsegs, _, _, err := decoder.Decode(oldsegs)
+		if err != nil {
+			t.Fatal("message", i, err)
+		}
+		assertFingerprints(t, accsegs, want)
+		oldsegs = append(oldsegs, newsegs...)
+	}
+	// The composition of the second message refers to the ids of a and b in
+	// the first message.
+	if composition, ok := oldsegs[2].(Composition); !ok || !composition.Segments[0].Equal(oldsegs[0]) || !composition.Segments[1].Equal(oldsegs[1]) {
+		t.Error("want composition of the first message's segments, have", oldsegs[2])
+	}
+	// The segments of the third message were all sent before, so that the
+	// message only refers to them by their ids.
+	for _, segment := range oldsegs[4:] {
+		if composition, ok := segment.(Composition); !ok || len(composition.Segments) != 1 {
+			t.Error("want reference to earlier segment, have", segment)
+		}
+	}
+}
+
+func assertFingerprints(t *testing.T, have, want []Segment) {
+	t.Helper()
+	if len(have) != len(want) {
+		t.Fatal("want", len(want), "segments, have", len(have))
+	}
+	for i := range want {
+		if have[i].Fingerprint() != want[i].Fingerprint() {
+			t.Error("want", want[i], "have", have[i])
+		}
+	}
+}
+
+func TestDecodeSizeLimits(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	msg, _, err := EncodeSegments(nil, nil, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(msg[2:], 65535) // huge numsegs, tiny body
+	if _, _, _, _, err := DecodeSegments(msg, nil); err == nil {
+		t.Error("65535 segments in empty body: want error, have nil")
+	}
+
+	// The limits are enforced before the body is read from the stream, so a
+	// stream that ends after the header yields the limit error.
+	binary.BigEndian.PutUint16(msg[2:], 100)
+	decoder := NewDecoder(bytes.NewReader(msg[:24]))
+	decoder.MaxSegments = 10
+	if _, _, _, _, err := decoder.Decode(nil); err == nil || err == io.ErrUnexpectedEOF {
+		t.Error("numsegs exceeds MaxSegments: want limit error, have", err)
+	}
+	binary.BigEndian.PutUint16(msg[2:], 0)
+	binary.BigEndian.PutUint32(msg[4:], 1<<20)
+	decoder = NewDecoder(bytes.NewReader(msg[:24]))
+	decoder.MaxBytes = 1 << 10
+	if _, _, _, _, err := decoder.Decode(nil); err == nil || err == io.ErrUnexpectedEOF {
+		t.Error("msglen exceeds MaxBytes: want limit error, have", err)
+	}
+}
+
+func TestAcceptSubsegments(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102")
+	srcIA, dstIA := a.SrcIA(), c.DstIA()
+	offer, sentsegs, err := EncodeSegments([]Segment{FromSegments(a, b, c)}, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segsin, accsegs, _, _, err := DecodeSegments(offer, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notB := func(segment Segment) bool { return segment.Fingerprint() != b.Fingerprint() }
+	selected := AcceptSubsegments(accsegs[0].(Composition), notB)
+	reply, _, err := EncodeSegments(selected, segsin, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, accsegs, _, _, err = DecodeSegments(reply, sentsegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFingerprints(t, accsegs, []Segment{a, c})
+}
+
+func TestHeader(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	want := Header{Version: 3, HdrLen: 31, NumSegs: 513, MsgLen: 70000, SrcIA: srcIA, DstIA: dstIA}
+	buf := make([]byte, HeaderLen)
+	if err := want.EncodeHeader(buf); err != nil {
+		t.Fatal(err)
+	}
+	have, err := DecodeHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have != want {
+		t.Error("want", want, "have", have)
+	}
+	if err := want.EncodeHeader(buf[:HeaderLen-1]); err == nil {
+		t.Error("EncodeHeader into short buffer: want error, have nil")
+	}
+	if _, err := DecodeHeader(buf[:HeaderLen-1]); err == nil {
+		t.Error("DecodeHeader from short buffer: want error, have nil")
+	}
+
+	msg, _, err := EncodeSegments([]Segment{FromString("19-ffaa:0:1303 1>1 17-ffaa:0:1108")}, nil, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, _ = DecodeHeader(msg)
+	if have.Version != currentVersion || int(have.MsgLen) != len(msg) || have.NumSegs != 1 || have.SrcIA != srcIA || have.DstIA != dstIA {
+		t.Error("header of encoded message:", have)
+	}
+}
+
+func TestDecodeSegmentsPrefix(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	first, sentsegs, err := EncodeSegments([]Segment{a}, nil, a.SrcIA(), b.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := EncodeSegments([]Segment{FromSegments(a, b)}, sentsegs, a.SrcIA(), b.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := append(append([]byte(nil), first...), second...)
+	newsegs, accsegs, _, _, n, err := DecodeSegmentsPrefix(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(first) {
+		t.Fatal("want", len(first), "bytes consumed, have", n)
+	}
+	assertFingerprints(t, accsegs, []Segment{a})
+	_, accsegs, _, _, n, err = DecodeSegmentsPrefix(buf[n:], newsegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(second) {
+		t.Error("want", len(second), "bytes consumed, have", n)
+	}
+	assertFingerprints(t, accsegs, []Segment{FromSegments(a, b)})
+}
+
+func TestDecodeErrors(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	msg, _, err := EncodeSegments([]Segment{a}, nil, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badVersion := append([]byte(nil), msg...)
+	badVersion[0] = currentVersion + 1
+	forward := craftNestedMessage(2, 1)
+	binary.BigEndian.PutUint16(forward[HeaderLen+36+4:], 2)
+	tooMany := append([]byte(nil), msg...)
+	binary.BigEndian.PutUint16(tooMany[2:], 2)
+	tests := []struct {
+		name   string
+		msg    []byte
+		target error
+	}{
+		{"truncated header", msg[:HeaderLen-1], ErrShortBuffer},
+		{"truncated message", msg[:len(msg)-1], ErrShortBuffer},
+		{"bad version", badVersion, ErrBadVersion},
+		{"forward reference", forward, ErrForwardReference},
+		{"segments exceed body", tooMany, ErrShortBuffer},
+	}
+	for _, test := range tests {
+		_, _, _, _, err := DecodeSegments(test.msg, nil)
+		if !errors.Is(err, test.target) {
+			t.Errorf("%s: want %v, have %v", test.name, test.target, err)
+		}
+	}
+	decoder := NewDecoder(bytes.NewReader(tooMany))
+	decoder.MaxSegments = 1
+	if _, _, _, _, err := decoder.Decode(nil); !errors.Is(err, ErrTooManySegments) {
+		t.Errorf("MaxSegments: want %v, have %v", ErrTooManySegments, err)
+	}
+}
+
+func TestRejectReason(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	var buf bytes.Buffer
+	for _, reason := range []RejectReason{PolicyDenied, NotRejected, RateLimited} {
+		encoder := NewEncoder(&buf)
+		encoder.RejectReason = reason
+		if _, err := encoder.Encode(nil, nil, srcIA, dstIA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg := buf.Bytes()
+	if reason, err := DecodeRejectReason(msg); err != nil || reason != PolicyDenied {
+		t.Error("want", PolicyDenied, "have", reason, err)
+	}
+	decoder := NewDecoder(&buf)
+	for _, want := range []RejectReason{PolicyDenied, NotRejected, RateLimited} {
+		newsegs, accsegs, src, dst, err := decoder.Decode(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(newsegs) != 0 || len(accsegs) != 0 || src != srcIA || dst != dstIA {
+			t.Error("want empty message, have", newsegs, accsegs, src, dst)
+		}
+		if decoder.RejectReason() != want {
+			t.Error("want", want, "have", decoder.RejectReason())
+		}
+	}
+}
+
+func TestEncodeInterfacesTo(t *testing.T) {
+	interfaces := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108").PathInterfaces()
+	buf := make([]byte, len(interfaces)*16+1)
+	n, err := EncodeInterfacesTo(buf, interfaces)
+	if err != nil || n != len(interfaces)*16 {
+		t.Fatal("want", len(interfaces)*16, "bytes, have", n, err)
+	}
+	decoded, err := DecodeInterfaces(buf, len(interfaces))
+	if err != nil || !FromInterfaces(decoded...).Equal(FromInterfaces(interfaces...)) {
+		t.Error("want", interfaces, "have", decoded, err)
+	}
+	short := make([]byte, len(interfaces)*16-1)
+	if n, err := EncodeInterfacesTo(short, interfaces); !errors.Is(err, ErrShortBuffer) || n != 0 {
+		t.Error("undersized buffer: want", ErrShortBuffer, "have", n, err)
+	}
+	if !bytes.Equal(short, make([]byte, len(short))) {
+		t.Error("undersized buffer was written to")
+	}
+}
+
+func TestDecodeInterfaces(t *testing.T) {
+	interfaces := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302").PathInterfaces()
+	buf := make([]byte, len(interfaces)*16)
+	EncodeInterfacesTo(buf, interfaces)
+	if _, err := DecodeInterfaces(buf, len(interfaces)); err != nil {
+		t.Error(err)
+	}
+	for _, seglen := range []int{len(interfaces) + 1, -1} {
+		if _, err := DecodeInterfaces(buf, seglen); err == nil {
+			t.Error("seglen", seglen, "with buffer for", len(interfaces), "interfaces: want error, have nil")
+		}
+	}
+	// A literal whose seglen exceeds the message is rejected when decoding.
+	msg := craftNestedMessage(1, 1)
+	msg[HeaderLen+1] = 3
+	if _, _, _, _, err := DecodeSegments(msg, nil); !errors.Is(err, ErrShortBuffer) {
+		t.Error("literal seglen exceeds message: want", ErrShortBuffer, "have", err)
+	}
+}
+
+func TestWildcardEndpoints(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-0")
+	segments := []Segment{
+		FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108"),
+		FromString("19-ffaa:0:1303 4>1 17-ffaa:0:1107"),
+	}
+	msg, _, err := EncodeSegments(segments, nil, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, accsegs, src, dst, err := DecodeSegments(msg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if src != srcIA || dst != dstIA {
+		t.Error("want", srcIA, dstIA, "have", src, dst)
+	}
+	if err := VerifyEndpoints(accsegs, src, dst); err != nil {
+		t.Error("segments towards wildcard destination:", err)
+	}
+	other := FromString("19-ffaa:0:1303 5>1 16-ffaa:0:1001")
+	if err := VerifyEndpoints([]Segment{other}, src, dst); err == nil {
+		t.Error("segment towards other ISD: want error, have nil")
+	}
+	if err := VerifyEndpoints(accsegs, addr.IA{I: srcIA.I}, addr.IA{}); err != nil {
+		t.Error("segments between wildcard endpoints:", err)
+	}
+}
+
+func TestMaxResponseBytes(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	var buf bytes.Buffer
+	for _, maxBytes := range []int{1 << 10, 0} {
+		encoder := NewEncoder(&buf)
+		encoder.MaxResponseBytes = maxBytes
+		if _, err := encoder.Encode(nil, nil, srcIA, dstIA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoder := NewDecoder(&buf)
+	for _, want := range []int{1 << 10, 0} {
+		if _, _, _, _, err := decoder.Decode(nil); err != nil {
+			t.Fatal(err)
+		}
+		if decoder.MaxResponseBytes() != want {
+			t.Error("want", want, "have", decoder.MaxResponseBytes())
+		}
+	}
+}
+
+func TestEncoderFit(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1107")
+	newsegs := generateLiterals(10, 4, srcIA, dstIA)
+	sizes := make([]int, len(newsegs)+1)
+	for n := range sizes {
+		msg, _, err := EncodeSegments(newsegs[:n], []Segment{}, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[n] = len(msg)
+	}
+	tests := []struct {
+		maxBytes int
+		want     int
+	}{
+		{0, len(newsegs)},
+		{sizes[len(newsegs)], len(newsegs)},
+		{sizes[len(newsegs)] - 1, len(newsegs) - 1},
+		{sizes[3], 3},
+		{sizes[3] + 1, 3},
+		{sizes[1] - 1, 0},
+		{1, 0},
+	}
+	for _, test := range tests {
+		fitted, err := new(Encoder).Fit(newsegs, []Segment{}, srcIA, dstIA, test.maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertFingerprints(t, fitted, newsegs[:test.want])
+	}
+}
+
+func TestEncodeSegmentsIndexed(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	ab := FromSegments(a, b)
+	oldsegs := []Segment{b}
+	msg, sentsegs, ids, err := EncodeSegmentsIndexed([]Segment{a, ab, a}, oldsegs, a.SrcIA(), b.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _, _ := EncodeSegments([]Segment{a, ab, a}, oldsegs, a.SrcIA(), b.DstIA()); !bytes.Equal(msg, want) {
+		t.Error("indexed encoding differs from EncodeSegments")
+	}
+	// The last segment accepts a again by referring to its id.
+	wantIDs := []int{1, 2, 1}
+	if len(sentsegs) != len(wantIDs) {
+		t.Fatal("want", len(wantIDs), "sent segments, have", len(sentsegs))
+	}
+	for i, sentseg := range sentsegs {
+		if id, ok := ids[sentseg.Fingerprint()]; !ok || id != wantIDs[i] {
+			t.Error("sent segment", i, "want id", wantIDs[i], "have", id, ok)
+		}
+	}
+	if id, ok := ids[b.Fingerprint()]; !ok || id != 0 {
+		t.Error("old segment: want id 0, have", id, ok)
+	}
+	if len(ids) != 3 {
+		t.Error("want 3 ids, have", len(ids))
+	}
+}
+
+func TestDumpWire(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	encoder := NewEncoder(nil)
+	encoder.RejectReason = PolicyDenied
+	msg, _, err := encoder.encodeMessage([]Segment{FromSegments(a, b)}, []Segment{}, a.SrcIA(), b.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := DumpWire(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"     0  version: 3",
+		"numsegs: 3",
+		"srcIA: 19-ffaa:0:1303",
+		"dstIA: 17-ffaa:0:1108",
+		"(ok)",
+		"reject reason policy denied",
+		"segment 0: flags: 0x00 (literal, accepted: false), seglen: 2, optlen: 0",
+		"interface: 19-ffaa:0:1303#1",
+		"segment 2: flags: 0x03 (composition, accepted: true), seglen: 2, optlen: 0",
+		"subsegment id: 1",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump does not contain %q:\n%s", want, dump)
+		}
+	}
+	truncated, err := DumpWire(msg[:len(msg)-1])
+	if err == nil {
+		t.Fatal("truncated message: want error, have nil")
+	}
+	if !strings.Contains(truncated, "interface: 19-ffaa:0:1303#1") || !strings.Contains(truncated, "error:") {
+		t.Errorf("truncated dump lacks parsed fields or error:\n%s", truncated)
+	}
+}
+
+func TestDecodeSegmentsInto(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	msg, _, err := EncodeSegments([]Segment{FromSegments(a, b), c}, []Segment{}, a.SrcIA(), b.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantnew, wantacc, _, _, err := DecodeSegments(msg, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A slice that is too small is grown, a large enough one is reused.
+	newsegs, accsegs, _, _, err := DecodeSegmentsInto(make([]Segment, 0, 1), nil, msg, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFingerprints(t, newsegs, wantnew)
+	assertFingerprints(t, accsegs, wantacc)
+	reused, reacc, _, _, err := DecodeSegmentsInto(newsegs, accsegs, msg, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFingerprints(t, reused, wantnew)
+	assertFingerprints(t, reacc, wantacc)
+	if &reused[0] != &newsegs[0] || &reacc[0] != &accsegs[0] {
+		t.Error("want backing arrays to be reused")
+	}
+	empty, _, err := EncodeSegments([]Segment{}, []Segment{}, a.SrcIA(), b.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newsegs, accsegs, _, _, err = DecodeSegmentsInto(nil, nil, empty, []Segment{})
+	if err != nil || newsegs == nil || accsegs == nil {
+		t.Error("empty message: want empty, non-nil slices, have", newsegs, accsegs, err)
+	}
+}
+
+func TestNonce(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	var stream bytes.Buffer
+	encoder := NewEncoder(&stream)
+	encoder.ReplayProtection = true
+	before := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := encoder.Encode([]Segment{a}, []Segment{}, a.SrcIA(), a.DstIA()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoder := NewDecoder(&stream)
+	var nonces []Nonce
+	for i := 0; i < 2; i++ {
+		if _, _, _, _, err := decoder.Decode([]Segment{}); err != nil {
+			t.Fatal(err)
+		}
+		nonce, ok := decoder.Nonce()
+		if !ok {
+			t.Fatal("message", i, "carries no nonce")
+		}
+		if nonce.Time.Before(before) || nonce.Time.After(time.Now()) {
+			t.Error("message", i, "nonce time", nonce.Time, "is not the time of encoding")
+		}
+		nonces = append(nonces, nonce)
+	}
+	if nonces[0].Value == nonces[1].Value {
+		t.Error("want distinct nonces, have", nonces[0].Value, "twice")
+	}
+	msg, _, err := EncodeSegments([]Segment{a}, []Segment{}, a.SrcIA(), a.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder = NewDecoder(bytes.NewReader(msg))
+	if _, _, _, _, err := decoder.Decode([]Segment{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoder.Nonce(); ok {
+		t.Error("want no nonce without replay protection")
+	}
+}
@@ -1,6 +1,8 @@
 package segment
 
 import (
+	"sort"
+
 	"github.com/scionproto/scion/go/lib/addr"
 )
 
@@ -8,6 +10,11 @@ import (
 // destination ISD-AS pair from a given set of segments. For constant-bounded
 // segment length, the runtime complexity is linear in the number of
 // enumeratable segments starting at the source ISD-AS.
+//
+// Segments that are chained together, i.e., where the destination ISD-AS of
+// one segment is the source ISD-AS of the next, are stitched into a segment
+// composition. At most three segments are stitched together, and chains that
+// revisit an ISD-AS are discarded.
 func SrcDstPaths(segments []Segment, srcIA, dstIA addr.IA) []Segment {
 	maxSegLen := 3 // SCION-specific
 	buckets := createSegmentBuckets(segments)
@@ -16,9 +23,27 @@ func SrcDstPaths(segments []Segment, srcIA, dstIA addr.IA) []Segment {
 	return flattened
 }
 
+// Stitch enumerates the end-to-end segments between a source and destination
+// ISD-AS pair like SrcDstPaths, but it orders them by the number of stitched
+// segments, fewest first, and it only returns distinct paths: of all chains
+// whose flattened path interfaces are the same, only the first one with the
+// fewest segments is kept.
+func Stitch(segments []Segment, srcIA, dstIA addr.IA) []Segment {
+	maxSegLen := 3 // SCION-specific
+	buckets := createSegmentBuckets(segments)
+	seglists := recursiveSrcDstSeglists(maxSegLen, srcIA, dstIA, buckets)
+	sort.SliceStable(seglists, func(i, j int) bool {
+		return len(seglists[i]) < len(seglists[j])
+	})
+	return dedupSegments(flattenSeglists(seglists))
+}
+
 func createSegmentBuckets(segments []Segment) map[addr.IA][]Segment {
 	buckets := make(map[addr.IA][]Segment, len(segments))
 	for _, segment := range segments {
+		if interfaceCount(segment) == 0 { // no endpoints
+			continue
+		}
 		srcIA, dstIA := segment.SrcIA(), segment.DstIA()
 		if srcIA == dstIA { // cyclic
 			continue
@@ -0,0 +1,71 @@
+package segment
+
+import "testing"
+
+func TestSrcDstPaths(t *testing.T) {
+	var (
+		up1   = FromString("1-ff00:0:1 1>2 1-ff00:0:2")
+		up2   = FromString("1-ff00:0:1 3>4 1-ff00:0:3")
+		core1 = FromString("1-ff00:0:2 5>6 1-ff00:0:4")
+		core2 = FromString("1-ff00:0:3 7>8 1-ff00:0:4")
+		down  = FromString("1-ff00:0:4 9>10 1-ff00:0:5")
+		back  = FromString("1-ff00:0:4 11>12 1-ff00:0:1") // leads back to source
+		dead  = FromString("1-ff00:0:2 13>14 1-ff00:0:6") // dead end
+	)
+	segments := []Segment{up1, up2, core1, core2, down, back, dead}
+	srcIA, dstIA := up1.SrcIA(), down.DstIA()
+	want := []Segment{FromSegments(up1, core1, down), FromSegments(up2, core2, down)}
+	have := SrcDstPaths(segments, srcIA, dstIA)
+	if len(have) != len(want) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	for i := range want {
+		if !have[i].Equal(want[i]) {
+			t.Errorf("path %d: want %v, have %v", i, want[i], have[i])
+		}
+	}
+}
+
+func TestStitch(t *testing.T) {
+	var (
+		ab     = FromString("1-ff00:0:1 1>2 1-ff00:0:2")
+		bc     = FromString("1-ff00:0:2 3>4 1-ff00:0:3")
+		cd     = FromString("1-ff00:0:3 5>6 1-ff00:0:4")
+		ac     = FromString("1-ff00:0:1 1>2 1-ff00:0:2 3>4 1-ff00:0:3") // shortcut for ab, bc
+		bd     = FromString("1-ff00:0:2 3>4 1-ff00:0:3 5>6 1-ff00:0:4") // shortcut for bc, cd
+		direct = FromString("1-ff00:0:1 7>8 1-ff00:0:4")
+	)
+	segments := []Segment{ab, bc, cd, ac, bd, direct}
+	srcIA, dstIA := ab.SrcIA(), cd.DstIA()
+	if n := len(SrcDstPaths(segments, srcIA, dstIA)); n != 4 {
+		t.Fatal("want 4 chains from SrcDstPaths, have", n)
+	}
+	want := []Segment{direct, FromSegments(ab, bd)}
+	have := Stitch(segments, srcIA, dstIA)
+	if len(have) != len(want) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	seen := make(map[string]bool)
+	for i := range have {
+		if seen[have[i].Fingerprint()] {
+			t.Errorf("path %d: duplicate flattened path %v", i, have[i])
+		}
+		seen[have[i].Fingerprint()] = true
+		if !have[i].Equal(want[i]) {
+			t.Errorf("path %d: want %v, have %v", i, want[i], have[i])
+		}
+	}
+}
+
+func TestSrcDstPathsEmptySegments(t *testing.T) {
+	ab := FromString("1-ff00:0:1 1>2 1-ff00:0:2")
+	empty := FromInterfaces()
+	segments := []Segment{empty, Composition{}, FromSegments(empty), FromSegments(empty, ab, empty)}
+	have := SrcDstPaths(segments, ab.SrcIA(), ab.DstIA())
+	if len(have) != 1 || !have[0].Equal(segments[3]) {
+		t.Errorf("want %v, have %v", segments[3:], have)
+	}
+	if srcIA, dstIA := segments[3].SrcIA(), segments[3].DstIA(); srcIA != ab.SrcIA() || dstIA != ab.DstIA() {
+		t.Errorf("endpoints: want %s>%s, have %s>%s", ab.SrcIA(), ab.DstIA(), srcIA, dstIA)
+	}
+}
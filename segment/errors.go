@@ -0,0 +1,29 @@
+package segment
+
+import "errors"
+
+// The following errors classify why a message could not be decoded. The
+// errors returned by the decoding functions wrap them, so that callers can
+// distinguish the failure modes with errors.Is.
+var (
+	// ErrShortBuffer means that the message is truncated, i.e., that a length
+	// field of the message exceeds the available bytes.
+	ErrShortBuffer = errors.New("short buffer")
+	// ErrBadVersion means that the message uses an unsupported version of the
+	// encoding.
+	ErrBadVersion = errors.New("unsupported encoding version")
+	// ErrForwardReference means that a segment composition refers to a
+	// segment that has not been decoded before it.
+	ErrForwardReference = errors.New("forward reference")
+	// ErrDanglingReference means that a segment composition refers to a
+	// segment id that is in range, but for which no segment is known, e.g.,
+	// because the corresponding old segment is nil.
+	ErrDanglingReference = errors.New("dangling reference")
+	// ErrTooManySegments means that the message has more segments than
+	// permitted.
+	ErrTooManySegments = errors.New("too many segments")
+	// ErrUnknownType means that a segment is of a type that is not
+	// registered, see RegisterType. It is also returned when encoding such a
+	// segment.
+	ErrUnknownType = errors.New("unknown segment type")
+)
@@ -0,0 +1,44 @@
+package segment
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// OptionTypeExpiry is the type of the segment option that carries the time at
+// which a segment expires, e.g., because the SCION path segments that it is
+// made of expire. The value is the expiry time in seconds since the Unix epoch
+// as an 8-byte unsigned integer.
+const OptionTypeExpiry uint8 = 2
+
+// ExpiryOption returns an option for WithOptions that advertises the given
+// expiry time of a segment. The time is truncated to seconds. The expiry time
+// is only authenticated if the segment is signed after it is attached, since
+// the signature covers the options (see Sign).
+func ExpiryOption(expiry time.Time) Option {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(expiry.Unix()))
+	return Option{Type: OptionTypeExpiry, Value: value}
+}
+
+// Expiry returns the expiry time that is attached to the segment itself and
+// whether there is one. Options of the expiry type with a malformed value are
+// ignored.
+func Expiry(segment Segment) (time.Time, bool) {
+	for _, option := range optionsOf(segment) {
+		if option.Type == OptionTypeExpiry && len(option.Value) == 8 {
+			return time.Unix(int64(binary.BigEndian.Uint64(option.Value)), 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Expired reports whether the segment must not be used at the given time
+// anymore, i.e., whether the segment or any of its subsegments has an expiry
+// time that is not after now. A segment without expiry times never expires.
+func Expired(segment Segment, now time.Time) bool {
+	return !Walk(segment, func(segment Segment) bool {
+		expiry, ok := Expiry(segment)
+		return !ok || expiry.After(now)
+	})
+}
@@ -0,0 +1,50 @@
+package segment
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	fresh := WithOptions(a, ExpiryOption(now.Add(time.Hour)))
+	expired := WithOptions(b, ExpiryOption(now.Add(-time.Hour)))
+	tests := []struct {
+		name    string
+		segment Segment
+		expired bool
+	}{
+		{"no expiry", a, false},
+		{"fresh", fresh, false},
+		{"expired", expired, true},
+		{"expiring now", WithOptions(a, ExpiryOption(now)), true},
+		{"expired subsegment", FromSegments(fresh, expired), true},
+		{"fresh composition", WithOptions(FromSegments(fresh, b), ExpiryOption(now.Add(time.Minute))), false},
+	}
+	for _, test := range tests {
+		if have := Expired(test.segment, now); have != test.expired {
+			t.Errorf("%s: want expired %t, have %t", test.name, test.expired, have)
+		}
+	}
+	if _, ok := Expiry(a); ok {
+		t.Error("segment without expiry: want no expiry, have one")
+	}
+}
+
+func TestExpiryRoundTrip(t *testing.T) {
+	expiry := time.Unix(1700003600, 0)
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	msg, _, err := EncodeSegments([]Segment{WithOptions(a, ExpiryOption(expiry))}, []Segment{}, a.SrcIA(), a.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, accsegs, _, _, err := DecodeSegments(msg, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, ok := Expiry(accsegs[0]); !ok || !have.Equal(expiry) {
+		t.Error("want expiry", expiry, "have", have, ok)
+	}
+}
@@ -1,6 +1,8 @@
 package segment
 
 import (
+	"encoding/binary"
+
 	"github.com/mblarer/conpass/path"
 	"github.com/scionproto/scion/go/lib/snet"
 )
@@ -12,3 +14,40 @@ func Hash(segment Segment) string {
 	fingerprint := snet.Fingerprint(path)
 	return string(fingerprint)
 }
+
+// UndirectedFingerprint returns a fingerprint of the segment that does not
+// depend on its direction, i.e., a segment and its reverse share the same
+// undirected fingerprint (see path.UndirectedInterfacesFingerprint). Unlike
+// Fingerprint, it is never used by this package, since the direction of a
+// segment matters for negotiation. Callers that consider both directions of a
+// path equivalent may pass it to deduplicate segments, e.g., with DedupBy.
+func UndirectedFingerprint(segment Segment) string {
+	return path.UndirectedInterfacesFingerprint(segment.PathInterfaces())
+}
+
+// StructuralFingerprint returns a fingerprint of the segment that, unlike
+// Fingerprint, depends on how the segment is composed. It is the hash over the
+// type tag of the segment followed by, for a segment literal, its interfaces
+// as in CanonicalBytes, or, for a segment composition, the 2-byte number of
+// subsegments and their structural fingerprints in order, which all have the
+// same length. A composition and the equivalent literal thus have different
+// structural fingerprints.
+//
+// Fingerprint remains independent of the structure because the encoding
+// relies on it: a segment that was seen before is referred to by id whatever
+// subsegments it was sent with, which requires that a literal and the
+// equivalent composition share the same fingerprint. Callers that need to
+// tell such segments apart, e.g., to deduplicate by structure with DedupBy,
+// can use StructuralFingerprint instead.
+func StructuralFingerprint(segment Segment) string {
+	composition, ok := segment.(Composition)
+	if !ok {
+		return path.BytesFingerprint(appendCanonicalLiteral(nil, segment.PathInterfaces()))
+	}
+	bytes := []byte{1, 0, 0}
+	binary.BigEndian.PutUint16(bytes[1:], uint16(len(composition.Segments)))
+	for _, subseg := range composition.Segments {
+		bytes = append(bytes, StructuralFingerprint(subseg)...)
+	}
+	return path.BytesFingerprint(bytes)
+}
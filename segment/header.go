@@ -0,0 +1,78 @@
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// HeaderLen is the length of the fixed part of the message header. It is
+// followed by the message options, which are included in Header.HdrLen.
+const HeaderLen = 24
+
+// Header is the fixed part of the header of a message. Its layout is
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|    Version    |    HdrLen     |            NumSegs            |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                            MsgLen                             |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                             SrcIA                             |
+//	+                                                               +
+//	|                                                               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//	|                             DstIA                             |
+//	+                                                               +
+//	|                                                               |
+//	+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+// where all integers are big-endian.
+type Header struct {
+	// Version is the encoding version of the message.
+	Version uint8
+	// HdrLen is the length of the header including the message options.
+	HdrLen uint8
+	// NumSegs is the number of segments in the message.
+	NumSegs uint16
+	// MsgLen is the length of the message including the header.
+	MsgLen uint32
+	// SrcIA is the source ISD-AS of the negotiated segments.
+	SrcIA addr.IA
+	// DstIA is the destination ISD-AS of the negotiated segments.
+	DstIA addr.IA
+}
+
+// EncodeHeader writes the header into the first HeaderLen bytes of the buffer.
+// It returns an error if the buffer is too short.
+func (h Header) EncodeHeader(bytes []byte) error {
+	if len(bytes) < HeaderLen {
+		return fmt.Errorf("%w: header exceeds buffer of length %d", ErrShortBuffer, len(bytes))
+	}
+	bytes[0] = h.Version
+	bytes[1] = h.HdrLen
+	binary.BigEndian.PutUint16(bytes[2:], h.NumSegs)
+	binary.BigEndian.PutUint32(bytes[4:], h.MsgLen)
+	binary.BigEndian.PutUint64(bytes[8:], uint64(h.SrcIA.IAInt()))
+	binary.BigEndian.PutUint64(bytes[16:], uint64(h.DstIA.IAInt()))
+	return nil
+}
+
+// DecodeHeader reads the header from the first HeaderLen bytes of the buffer.
+// It returns an error if the buffer is too short. The fields are not
+// validated.
+func DecodeHeader(bytes []byte) (Header, error) {
+	if len(bytes) < HeaderLen {
+		return Header{}, fmt.Errorf("%w: header exceeds buffer of length %d", ErrShortBuffer, len(bytes))
+	}
+	return Header{
+		Version: bytes[0],
+		HdrLen:  bytes[1],
+		NumSegs: binary.BigEndian.Uint16(bytes[2:]),
+		MsgLen:  binary.BigEndian.Uint32(bytes[4:]),
+		SrcIA:   addr.IAInt(binary.BigEndian.Uint64(bytes[8:])).IA(),
+		DstIA:   addr.IAInt(binary.BigEndian.Uint64(bytes[16:])).IA(),
+	}, nil
+}
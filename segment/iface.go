@@ -0,0 +1,120 @@
+package segment
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// NormalizeInterface returns the canonical form of a path interface, i.e., the
+// interface as it is represented in the encoding and in fingerprints. SCION AS
+// numbers have 48 bits, so any higher bits of the AS number are cleared.
+func NormalizeInterface(iface snet.PathInterface) snet.PathInterface {
+	iface.IA = iface.IA.IAInt().IA()
+	return iface
+}
+
+// IfaceEqual reports whether two path interfaces are equal in their canonical
+// form, i.e., whether they are encoded identically. Equal and Contains compare
+// interfaces like IfaceEqual, so that they agree with fingerprints.
+func IfaceEqual(a, b snet.PathInterface) bool {
+	return NormalizeInterface(a) == NormalizeInterface(b)
+}
+
+// asPath returns the distinct ISD-ASes of the path interfaces of a segment in
+// order of their first occurrence, where ISD-ASes are compared like the
+// interfaces in IfaceEqual.
+func asPath(segment Segment) []addr.IA {
+	path := make([]addr.IA, 0)
+	seen := make(map[addr.IA]bool)
+	segment.IterInterfaces(func(iface snet.PathInterface) bool {
+		if ia := NormalizeInterface(iface).IA; !seen[ia] {
+			seen[ia] = true
+			path = append(path, ia)
+		}
+		return true
+	})
+	return path
+}
+
+// SamePath reports whether two segments traverse the same path, i.e., whether
+// their path interfaces are pairwise equal like in IfaceEqual, regardless of
+// how the segments are composed. Segments that traverse the same path also
+// have the same ASPath. Unlike comparing fingerprints, SamePath cannot be
+// affected by hash collisions.
+func SamePath(a, b Segment) bool {
+	ifacesA, ifacesB := a.PathInterfaces(), b.PathInterfaces()
+	if len(ifacesA) != len(ifacesB) {
+		return false
+	}
+	for i := range ifacesA {
+		if !IfaceEqual(ifacesA[i], ifacesB[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// CommonPrefix returns a segment literal of the longest sequence of path
+// interfaces with which both segments start, where interfaces are compared
+// like in IfaceEqual. If the segments do not start with the same interface,
+// the literal has no interfaces. The prefix may end within an AS, i.e., it may
+// consist of an odd number of interfaces.
+func CommonPrefix(a, b Segment) Literal {
+	ifacesA, ifacesB := a.PathInterfaces(), b.PathInterfaces()
+	n := 0
+	for n < len(ifacesA) && n < len(ifacesB) && IfaceEqual(ifacesA[n], ifacesB[n]) {
+		n++
+	}
+	return literalOf(ifacesA[:n:n])
+}
+
+// Redacted returns a summary of the segment for logs that must not reveal
+// interface ids, e.g., of offers from untrusted peers. It lists the ISD-ASes of
+// the ASPath in the format of FromString, but with masked interface ids, e.g.,
+// "19-ffaa:0:1303 *>* 19-ffaa:0:1302".
+func Redacted(segment Segment) string {
+	ases := segment.ASPath()
+	hops := make([]string, len(ases))
+	for i, ia := range ases {
+		hops[i] = ia.String()
+	}
+	return strings.Join(hops, " *>* ")
+}
+
+// ToPathPolicy renders the paths of the segments, e.g., of segments accepted
+// in a negotiation, as a path policy sequence in the syntax of SCION's pathpol
+// package, such that the paths can be reused without negotiating again. Each
+// segment becomes one clause of the ISD-ASes that it traverses, in order and
+// including revisited ones, and the clauses are joined as a disjunction, e.g.,
+// "(1-ff00:0:1 1-ff00:0:2) | (1-ff00:0:1 1-ff00:0:3)". Segments that traverse
+// the same ISD-ASes yield only one clause. Since pathpol treats the empty
+// policy as matching any path, ToPathPolicy returns an error instead if there
+// are no segments or if a segment has no interfaces.
+func ToPathPolicy(segs []Segment) (string, error) {
+	if len(segs) == 0 {
+		return "", fmt.Errorf("no segments to render as path policy")
+	}
+	clauses := make([]string, 0, len(segs))
+	seen := make(map[string]bool)
+	for i, segment := range segs {
+		ifaces := segment.PathInterfaces()
+		if len(ifaces) == 0 {
+			return "", fmt.Errorf("segment %d has no interfaces", i)
+		}
+		// Each AS after the first is entered through an interface at
+		// an odd index.
+		hops := []string{NormalizeInterface(ifaces[0]).IA.String()}
+		for j := 1; j < len(ifaces); j += 2 {
+			hops = append(hops, NormalizeInterface(ifaces[j]).IA.String())
+		}
+		clause := "(" + strings.Join(hops, " ") + ")"
+		if !seen[clause] {
+			seen[clause] = true
+			clauses = append(clauses, clause)
+		}
+	}
+	return strings.Join(clauses, " | "), nil
+}
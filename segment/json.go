@@ -0,0 +1,152 @@
+package segment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+const (
+	jsonTypeLiteral     = "literal"
+	jsonTypeComposition = "composition"
+)
+
+// jsonSegment is the tagged union as which segments are represented in JSON.
+type jsonSegment struct {
+	Type       string            `json:"type"`
+	Interfaces []jsonInterface   `json:"interfaces,omitempty"`
+	Segments   []json.RawMessage `json:"segments,omitempty"`
+	Options    []jsonOption      `json:"options,omitempty"`
+}
+
+type jsonInterface struct {
+	IA string `json:"ia"`
+	ID uint64 `json:"id"`
+}
+
+type jsonOption struct {
+	Type  uint8  `json:"type"`
+	Value []byte `json:"value"`
+}
+
+// FromJSON creates a new Segment from its JSON representation as produced by
+// json.Marshal. The concrete type of the segment is determined by the "type"
+// field of the JSON object.
+func FromJSON(data []byte) (Segment, error) {
+	var js jsonSegment
+	if err := json.Unmarshal(data, &js); err != nil {
+		return nil, err
+	}
+	switch js.Type {
+	case jsonTypeLiteral:
+		var l Literal
+		err := l.fromJSONSegment(js)
+		return l, err
+	case jsonTypeComposition:
+		var c Composition
+		err := c.fromJSONSegment(js)
+		return c, err
+	}
+	return nil, fmt.Errorf("unknown segment type %q", js.Type)
+}
+
+func (l Literal) MarshalJSON() ([]byte, error) {
+	interfaces := make([]jsonInterface, len(l.Interfaces))
+	for i, iface := range l.Interfaces {
+		interfaces[i] = jsonInterface{IA: iface.IA.String(), ID: uint64(iface.ID)}
+	}
+	return json.Marshal(jsonSegment{
+		Type:       jsonTypeLiteral,
+		Interfaces: interfaces,
+		Options:    toJSONOptions(l.Options),
+	})
+}
+
+func (l *Literal) UnmarshalJSON(data []byte) error {
+	var js jsonSegment
+	if err := json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+	return l.fromJSONSegment(js)
+}
+
+func (l *Literal) fromJSONSegment(js jsonSegment) error {
+	if js.Type != jsonTypeLiteral {
+		return fmt.Errorf("cannot unmarshal segment of type %q into literal", js.Type)
+	}
+	interfaces := make([]snet.PathInterface, len(js.Interfaces))
+	for i, iface := range js.Interfaces {
+		ia, err := addr.IAFromString(iface.IA)
+		if err != nil {
+			return err
+		}
+		interfaces[i] = snet.PathInterface{ID: common.IFIDType(iface.ID), IA: ia}
+	}
+	*l = FromInterfaces(interfaces...).(Literal)
+	l.Options = fromJSONOptions(js.Options)
+	return nil
+}
+
+func (c Composition) MarshalJSON() ([]byte, error) {
+	segments := make([]json.RawMessage, len(c.Segments))
+	for i, segment := range c.Segments {
+		bytes, err := json.Marshal(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = bytes
+	}
+	return json.Marshal(jsonSegment{
+		Type:     jsonTypeComposition,
+		Segments: segments,
+		Options:  toJSONOptions(c.Options),
+	})
+}
+
+func (c *Composition) UnmarshalJSON(data []byte) error {
+	var js jsonSegment
+	if err := json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+	return c.fromJSONSegment(js)
+}
+
+func (c *Composition) fromJSONSegment(js jsonSegment) error {
+	if js.Type != jsonTypeComposition {
+		return fmt.Errorf("cannot unmarshal segment of type %q into composition", js.Type)
+	}
+	if len(js.Segments) == 0 {
+		return errors.New("composition has no segments")
+	}
+	segments := make([]Segment, len(js.Segments))
+	for i, data := range js.Segments {
+		segment, err := FromJSON(data)
+		if err != nil {
+			return err
+		}
+		segments[i] = segment
+	}
+	*c = FromSegments(segments...).(Composition)
+	c.Options = fromJSONOptions(js.Options)
+	return nil
+}
+
+func toJSONOptions(options []Option) []jsonOption {
+	joptions := make([]jsonOption, len(options))
+	for i, option := range options {
+		joptions[i] = jsonOption{Type: option.Type, Value: option.Value}
+	}
+	return joptions
+}
+
+func fromJSONOptions(joptions []jsonOption) []Option {
+	options := make([]Option, len(joptions))
+	for i, joption := range joptions {
+		options[i] = Option{Type: joption.Type, Value: joption.Value}
+	}
+	return options
+}
@@ -0,0 +1,61 @@
+package segment
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102 2>1 17-ffaa:0:1107")
+	for _, segment := range []Segment{a, FromSegments(a, b), FromSegments(FromSegments(a, b), c)} {
+		data, err := json.Marshal(segment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := FromJSON(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Fingerprint() != segment.Fingerprint() || !decoded.Equal(segment) {
+			t.Error("want:", segment, "have:", decoded)
+		}
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>2 19-ffaa:0:1302")
+	data, err := json.Marshal(FromSegments(a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"type":"composition","segments":[{"type":"literal","interfaces":[{"ia":"19-ffaa:0:1303","id":1},{"ia":"19-ffaa:0:1302","id":2}]}]}`
+	if string(data) != want {
+		t.Error("want:", want, "have:", string(data))
+	}
+	var literal Literal
+	if err := json.Unmarshal(data, &literal); err == nil || !strings.Contains(err.Error(), "composition") {
+		t.Error("unmarshaling composition into literal: want error, have:", err)
+	}
+}
+
+func TestJSONMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty composition", `{"type":"composition"}`},
+		{"empty segments array", `{"type":"composition","segments":[]}`},
+	}
+	for _, test := range tests {
+		if segment, err := FromJSON([]byte(test.data)); err == nil {
+			t.Errorf("%s: want error, have %v", test.name, segment)
+		}
+		var composition Composition
+		if err := json.Unmarshal([]byte(test.data), &composition); err == nil {
+			t.Errorf("%s: want error when unmarshaling into composition, have nil", test.name)
+		}
+	}
+}
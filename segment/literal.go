@@ -1,6 +1,7 @@
 package segment
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -13,14 +14,41 @@ import (
 // FromInterfaces creates a new Segment from a sequence of interfaces. The
 // interface slice is copied to prevent problems with shared slices.
 func FromInterfaces(interfaces ...snet.PathInterface) Segment {
-	var sb strings.Builder
-	for _, iface := range interfaces {
-		sb.WriteString(fmt.Sprintf(" %s#%d ", iface.IA, iface.ID))
-	}
 	return Literal{
 		Interfaces:  append([]snet.PathInterface(nil), interfaces...),
-		fingerprint: sb.String(),
+		fingerprint: fingerprintOf(interfaces),
+	}
+}
+
+// literalOf creates a new segment literal that takes ownership of the given
+// interfaces instead of copying them.
+func literalOf(interfaces []snet.PathInterface) Literal {
+	return Literal{
+		Interfaces:  interfaces,
+		fingerprint: fingerprintOf(interfaces),
+	}
+}
+
+// FromInterfacesChecked creates a new segment literal like FromInterfaces, but
+// returns an error if the interfaces cannot form a path, i.e., if there are no
+// interfaces, an odd number of interfaces, or an interface with a zero ISD-AS
+// or interface id.
+func FromInterfacesChecked(interfaces ...snet.PathInterface) (Literal, error) {
+	if len(interfaces) == 0 {
+		return Literal{}, errors.New("literal has no interfaces")
+	}
+	if len(interfaces)%2 != 0 {
+		return Literal{}, fmt.Errorf("literal has an odd number of interfaces (%d)", len(interfaces))
+	}
+	for i, iface := range interfaces {
+		if iface.IA.IsZero() {
+			return Literal{}, fmt.Errorf("interface %d has a zero ISD-AS", i)
+		}
+		if iface.ID == 0 {
+			return Literal{}, fmt.Errorf("interface %d of %s has a zero interface id", i, iface.IA)
+		}
 	}
+	return FromInterfaces(interfaces...).(Literal), nil
 }
 
 // FromString creates a new Segment from its string representation. This
@@ -41,7 +69,6 @@ func FromString(segstr string) Segment {
 		}
 	}
 	interfaces := make([]snet.PathInterface, length)
-	var sb strings.Builder
 	for i := 0; i < length; i++ {
 		ia, err := addr.IAFromString(iastrs[i])
 		if err != nil {
@@ -52,16 +79,17 @@ func FromString(segstr string) Segment {
 			panic(err)
 		}
 		interfaces[i] = snet.PathInterface{ID: common.IFIDType(id), IA: ia}
-		sb.WriteString(fmt.Sprintf(" %s#%d ", ia, common.IFIDType(id)))
 	}
-	return Literal{Interfaces: interfaces, fingerprint: sb.String()}
+	return Literal{Interfaces: interfaces, fingerprint: fingerprintOf(interfaces)}
 }
 
 // Literal implements the Segment interface.
 type Literal struct {
 	// Interfaces is the sequence of ingress-egress interfaces of which the
 	// segment literal consists.
-	Interfaces  []snet.PathInterface
+	Interfaces []snet.PathInterface
+	// Options is the metadata that is transmitted alongside the segment.
+	Options     []Option
 	fingerprint string
 }
 
@@ -77,20 +105,84 @@ func (l Literal) DstIA() addr.IA {
 	return l.Interfaces[len(l.Interfaces)-1].IA
 }
 
+func (l Literal) IterInterfaces(yield func(snet.PathInterface) bool) {
+	iterInterfaces(l, yield)
+}
+
+func (l Literal) ASPath() []addr.IA {
+	return asPath(l)
+}
+
+func (l Literal) Contains(iface snet.PathInterface) bool {
+	for _, i := range l.Interfaces {
+		if IfaceEqual(i, iface) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l Literal) ContainsIA(ia addr.IA) bool {
+	ia = ia.IAInt().IA()
+	for _, iface := range l.Interfaces {
+		if iface.IA.IAInt().IA() == ia {
+			return true
+		}
+	}
+	return false
+}
+
+func (l Literal) Len() int {
+	return len(l.Interfaces) / 2
+}
+
+func (l Literal) Depth() int {
+	return 1
+}
+
+func (l Literal) LeafCount() int {
+	return 1
+}
+
 func (l Literal) Fingerprint() string {
 	return l.fingerprint
 }
 
-func (l Literal) String() string {
-	str := ""
+func (l Literal) Equal(other Segment) bool {
+	o, ok := other.(Literal)
+	if !ok || len(l.Interfaces) != len(o.Interfaces) {
+		return false
+	}
 	for i, iface := range l.Interfaces {
-		if i == len(l.Interfaces)-1 {
-			str += fmt.Sprintf(">%d %s", iface.ID, iface.IA)
-		} else if i%2 == 0 {
-			str += fmt.Sprintf("%s %d", iface.IA, iface.ID)
-		} else if i%2 == 1 {
-			str += fmt.Sprintf(">%d ", iface.ID)
+		if !IfaceEqual(iface, o.Interfaces[i]) {
+			return false
 		}
 	}
-	return str
+	return true
+}
+
+func (l Literal) Reverse() Segment {
+	interfaces := make([]snet.PathInterface, len(l.Interfaces))
+	for i, iface := range l.Interfaces {
+		interfaces[len(interfaces)-1-i] = iface
+	}
+	return FromInterfaces(interfaces...)
+}
+
+func (l Literal) Clone() Segment {
+	l.Interfaces = append([]snet.PathInterface(nil), l.Interfaces...)
+	l.Options = cloneOptions(l.Options)
+	return l
+}
+
+// String renders the interfaces of the literal in order, each as its ISD-AS
+// and interface ID, e.g.,
+// "19-ffaa:0:1303#1 > 19-ffaa:0:1302#1 > 19-ffaa:0:1302#2 > 17-ffaa:0:1108#1".
+// Unlike the format of FromString, it keeps the ISD-AS of every interface.
+func (l Literal) String() string {
+	ifaces := make([]string, len(l.Interfaces))
+	for i, iface := range l.Interfaces {
+		ifaces[i] = fmt.Sprintf("%s#%d", iface.IA, iface.ID)
+	}
+	return strings.Join(ifaces, " > ")
 }
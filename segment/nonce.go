@@ -0,0 +1,53 @@
+package segment
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// Nonce identifies a message for replay protection. It consists of a random
+// value, which is unique per message, and the time at which the message was
+// encoded, which bounds how long the receiver has to remember the value.
+type Nonce struct {
+	// Value is the random value of the nonce.
+	Value [8]byte
+	// Time is the time at which the message was encoded.
+	Time time.Time
+}
+
+// Nonce returns the nonce of the message that was last decoded by the Decoder.
+// The second return value is false if the message carries no nonce.
+func (d *Decoder) Nonce() (Nonce, bool) {
+	return d.nonce, d.hasNonce
+}
+
+// newNonce returns a nonce with a random value for the current time.
+func newNonce() (Nonce, error) {
+	nonce := Nonce{Time: time.Now()}
+	if _, err := rand.Read(nonce.Value[:]); err != nil {
+		return Nonce{}, err
+	}
+	return nonce, nil
+}
+
+// encodeNonce returns the value of the nonce option, i.e., the random value
+// followed by the time in nanoseconds since the Unix epoch.
+func encodeNonce(nonce Nonce) []byte {
+	value := make([]byte, 16)
+	copy(value, nonce.Value[:])
+	binary.BigEndian.PutUint64(value[8:], uint64(nonce.Time.UnixNano()))
+	return value
+}
+
+func nonceOf(msgopts []Option) (Nonce, bool) {
+	for _, option := range msgopts {
+		if option.Type == msgOptNonce && len(option.Value) == 16 {
+			var nonce Nonce
+			copy(nonce.Value[:], option.Value)
+			nonce.Time = time.Unix(0, int64(binary.BigEndian.Uint64(option.Value[8:])))
+			return nonce, true
+		}
+	}
+	return Nonce{}, false
+}
@@ -0,0 +1,30 @@
+package segment
+
+// Observer is notified about every message that is encoded or decoded, e.g.,
+// to collect metrics. The number of bytes is the size of the whole message.
+type Observer interface {
+	// ObserveEncode is called after a message has been encoded.
+	ObserveEncode(numsegs, bytes int)
+	// ObserveDecode is called after a message has been decoded. If decoding
+	// failed, err is the error that is returned to the caller.
+	ObserveDecode(numsegs, bytes int, err error)
+}
+
+var observer Observer = noopObserver{}
+
+// SetObserver sets the Observer that is notified about encoded and decoded
+// messages. Passing nil restores the default, which ignores all messages.
+// This function should only be called during initialization, and it is not
+// safe for concurrent use.
+func SetObserver(o Observer) {
+	if o == nil {
+		o = noopObserver{}
+	}
+	observer = o
+}
+
+type noopObserver struct{}
+
+func (noopObserver) ObserveEncode(numsegs, bytes int) {}
+
+func (noopObserver) ObserveDecode(numsegs, bytes int, err error) {}
@@ -0,0 +1,100 @@
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Option is a piece of metadata that is attached to a segment and transmitted
+// alongside it. On the wire, each option is encoded as a type-length-value
+// triple consisting of a one-byte type, a two-byte length, and the value.
+// Options do not contribute to the fingerprint of a segment.
+type Option struct {
+	// Type identifies the kind of option. Options of unknown type are
+	// preserved when decoding.
+	Type uint8
+	// Value is the payload of the option.
+	Value []byte
+}
+
+// maxOptlen is the maximum number of bytes that the options of a segment can
+// occupy on the wire.
+const maxOptlen = 1<<16 - 1
+
+// WithOptions returns a copy of the segment that carries the given options in
+// addition to its own options, which precede them. The options are copied, and
+// the original segment is left untouched. Segments other than literals and
+// compositions are returned unchanged, since they cannot carry options.
+func WithOptions(segment Segment, options ...Option) Segment {
+	switch s := segment.(type) {
+	case Literal:
+		s.Options = append(cloneOptions(s.Options), cloneOptions(options)...)
+		return s
+	case Composition:
+		s.Options = append(cloneOptions(s.Options), cloneOptions(options)...)
+		return s
+	default:
+		return segment
+	}
+}
+
+// optionsOf returns the options of the segment, or nil if it cannot carry
+// options.
+func optionsOf(segment Segment) []Option {
+	switch s := segment.(type) {
+	case Literal:
+		return s.Options
+	case Composition:
+		return s.Options
+	default:
+		return nil
+	}
+}
+
+// cloneOptions returns a deep copy of the options.
+func cloneOptions(options []Option) []Option {
+	if options == nil {
+		return nil
+	}
+	cloned := make([]Option, len(options))
+	for i, option := range options {
+		cloned[i] = Option{Type: option.Type, Value: append([]byte(nil), option.Value...)}
+	}
+	return cloned
+}
+
+func encodedOptionsLen(options []Option) int {
+	optlen := 0
+	for _, option := range options {
+		optlen += 3 + len(option.Value)
+	}
+	return optlen
+}
+
+func encodeOptions(bytes []byte, options []Option) {
+	for _, option := range options {
+		bytes[0] = option.Type
+		binary.BigEndian.PutUint16(bytes[1:], uint16(len(option.Value)))
+		copy(bytes[3:], option.Value)
+		bytes = bytes[3+len(option.Value):]
+	}
+}
+
+func decodeOptions(bytes []byte) ([]Option, error) {
+	options := make([]Option, 0)
+	for offset := 0; offset < len(bytes); {
+		if offset+3 > len(bytes) {
+			return nil, fmt.Errorf("%w: option header exceeds buffer at offset %d", ErrShortBuffer, offset)
+		}
+		length := int(binary.BigEndian.Uint16(bytes[offset+1:]))
+		if offset+3+length > len(bytes) {
+			return nil, fmt.Errorf("%w: option value exceeds buffer at offset %d", ErrShortBuffer, offset)
+		}
+		options = append(options, Option{
+			Type:  bytes[offset],
+			Value: append([]byte(nil), bytes[offset+3:offset+3+length]...),
+		})
+		offset += 3 + length
+	}
+	return options, nil
+}
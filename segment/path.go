@@ -0,0 +1,35 @@
+package segment
+
+import (
+	"errors"
+
+	"github.com/mblarer/conpass/path"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// FromPath creates a new Segment from the path interfaces of a SCION path. An
+// empty (AS-internal) path results in a segment literal without interfaces.
+func FromPath(spath snet.Path) Segment {
+	meta := spath.Metadata()
+	if meta == nil {
+		return FromInterfaces()
+	}
+	return FromInterfaces(meta.Interfaces...)
+}
+
+// ToPath returns a SCION path that can be used to send packets along the given
+// segment. Segments only describe the sequence of path interfaces and lack the
+// forwarding information (hop fields) that is required by the dataplane. This
+// information is therefore taken from the candidate path, e.g., obtained from
+// the SCION daemon, that consists of exactly the path interfaces of the
+// segment. Segment compositions are matched by their flattened path
+// interfaces. If none of the candidate paths matches, an error is returned.
+func ToPath(segment Segment, paths []snet.Path) (snet.Path, error) {
+	fprint := segment.Fingerprint()
+	for _, spath := range paths {
+		if path.Fingerprint(spath) == fprint {
+			return spath, nil
+		}
+	}
+	return nil, errors.New("no candidate path provides forwarding information for segment")
+}
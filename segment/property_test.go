@@ -0,0 +1,56 @@
+package segment_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/mblarer/conpass/internal"
+	"github.com/mblarer/conpass/segment"
+)
+
+func TestEncodeDecodeRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for round := 0; round < 200; round++ {
+		segments := make([]segment.Segment, 1+r.Intn(8))
+		for i := range segments {
+			segments[i] = internal.RandomSegment(r, 4)
+		}
+		srcIA, dstIA := segments[0].SrcIA(), segments[0].DstIA()
+
+		msg, sentsegs, err := segment.EncodeSegments(segments, []segment.Segment{}, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newsegs, accsegs, _, _, err := segment.DecodeSegments(msg, []segment.Segment{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertRoundFingerprints(t, round, accsegs, segments)
+		assertRoundFingerprints(t, round, newsegs, sentsegs)
+
+		// Sending the same segments again refers to the decoded segments.
+		msg, _, err = segment.EncodeSegments(segments, newsegs, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, accsegs, _, _, err = segment.DecodeSegments(msg, newsegs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertRoundFingerprints(t, round, accsegs, segments)
+	}
+}
+
+// assertRoundFingerprints is like assertFingerprints of the internal tests, but
+// it reports the negotiation round in which the segments differ.
+func assertRoundFingerprints(t *testing.T, round int, have, want []segment.Segment) {
+	t.Helper()
+	if len(have) != len(want) {
+		t.Fatal("round", round, "want", len(want), "segments, have", len(have))
+	}
+	for i := range want {
+		if have[i].Fingerprint() != want[i].Fingerprint() {
+			t.Error("round", round, "want", want[i], "have", have[i])
+		}
+	}
+}
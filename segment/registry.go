@@ -0,0 +1,215 @@
+package segment
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// SegmentType identifies the kind of a segment on the wire. The types of the
+// built-in segments are TypeLiteral and TypeComposition, further types can be
+// added with RegisterType.
+type SegmentType uint8
+
+const (
+	// TypeLiteral is the type of a segment Literal.
+	TypeLiteral SegmentType = 0
+	// TypeComposition is the type of a segment Composition.
+	TypeComposition SegmentType = 1
+	// MaxSegmentType is the largest segment type that can be encoded.
+	MaxSegmentType SegmentType = 1<<7 - 1
+)
+
+// The segment type is encoded in the flags of a segment around the accepted
+// flag: its least significant bit is the least significant bit of the flags,
+// which distinguishes literals from compositions, and its remaining bits are
+// the six most significant bits of the flags. Messages that only contain
+// built-in segments are thus encoded as before types could be registered.
+
+func segmentTypeOf(flags uint8) SegmentType {
+	return SegmentType(flags&segTypeMask | flags>>2<<1)
+}
+
+func (t SegmentType) flags() uint8 {
+	return uint8(t)&segTypeMask | uint8(t)>>1<<2
+}
+
+// TypeCodec encodes and decodes the segments of a registered SegmentType.
+// Segments of registered types are transmitted as a body of at most 255 bytes
+// that must be self-contained, i.e., it cannot refer to other segments of the
+// message. Such segments carry no options.
+type TypeCodec struct {
+	// Encode returns the body of the segment.
+	Encode func(segment Segment) ([]byte, error)
+	// Decode decodes a segment from its body.
+	Decode func(body []byte) (Segment, error)
+}
+
+// RegisterType registers the codec for the given segment type, such that
+// encoders transmit the segments of the dynamic type of the prototype with
+// the type, and such that decoders decode segments of the type with the
+// codec. RegisterType is meant to be called from init functions. It panics if
+// the type or the dynamic type of the prototype is already registered, or if
+// the type exceeds MaxSegmentType.
+func RegisterType(t SegmentType, prototype Segment, codec TypeCodec) {
+	registerCodec(t, prototype, segmentCodec{
+		encodedLen: func(segment Segment, ifsize int) int {
+			body, _ := codec.Encode(segment)
+			return 4 + len(body)
+		},
+		appendBody: func(bytes []byte, segment Segment, state *encodeState) ([]byte, int, int, error) {
+			body, err := codec.Encode(segment)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			if len(body) > maxSeglen {
+				return nil, 0, 0, fmt.Errorf("segment of type %d has %d bytes, at most %d are supported", t, len(body), maxSeglen)
+			}
+			return append(bytes, body...), len(body), 0, nil
+		},
+		decode: func(body []byte, seglen, optlen int, state *decodeState) (Segment, int, error) {
+			if seglen+optlen > len(body) {
+				return nil, 0, fmt.Errorf("%w: body of type %d exceeds buffer at offset %d", ErrShortBuffer, t, state.offset)
+			}
+			segment, err := codec.Decode(body[:seglen])
+			if err != nil {
+				return nil, 0, fmt.Errorf("segment of type %d: %w", t, err)
+			}
+			depth, nodes := expandedShape(segment)
+			ifcount := interfaceCount(segment)
+			if err := state.checkLimits(depth, ifcount, nodes+ifcount); err != nil {
+				return nil, 0, err
+			}
+			if err := state.addInterfaces(ifcount); err != nil {
+				return nil, 0, err
+			}
+			state.record(depth, ifcount, nodes+ifcount)
+			return segment, seglen + optlen, nil
+		},
+	})
+}
+
+// segmentCodec encodes and decodes the segments of one SegmentType. Unlike a
+// TypeCodec, it has access to the state of the message, which the built-in
+// types need to encode path interfaces and subsegments by their ids.
+type segmentCodec struct {
+	segtype SegmentType
+	// encodedLen returns the number of bytes of the encoded segment,
+	// including its 4-byte header, if every path interface of a literal
+	// occupies ifsize bytes.
+	encodedLen func(segment Segment, ifsize int) int
+	// appendBody appends the encoded segment without its header and returns
+	// the values of its seglen and optlen fields.
+	appendBody func(bytes []byte, segment Segment, state *encodeState) ([]byte, int, int, error)
+	// decode decodes the segment whose body starts at the given bytes and
+	// returns it together with the length of its body.
+	decode func(body []byte, seglen, optlen int, state *decodeState) (Segment, int, error)
+}
+
+// encodeState is the state of a message that is being encoded.
+type encodeState struct {
+	segidx map[string]int
+	ifidx  map[snet.PathInterface]int
+}
+
+// decodeState is the state of a message that is being decoded, where index
+// and offset locate the segment that is currently decoded. The depths,
+// ifcounts, and sizes of the decoded segments are tracked by id, so that the
+// limits are enforced before a composition is constructed. totalInterfaces
+// counts the path interfaces of the leaf segments decoded so far, and
+// totalSize the expanded sizes of all segments decoded so far.
+type decodeState struct {
+	decoder  *Decoder
+	oldsegs  []Segment
+	newsegs  []Segment
+	depths   []int
+	ifcounts []int
+	sizes    []int
+	ifsize   int
+	iftable  []snet.PathInterface
+	index    int
+	offset   int
+
+	totalInterfaces int
+	totalSize       int
+}
+
+// addInterfaces adds the path interfaces of a leaf segment to the total of the
+// message, unless the total would exceed the limit of the Decoder.
+func (state *decodeState) addInterfaces(n int) error {
+	if maxTotal := state.decoder.maxTotalInterfaces(); state.totalInterfaces+n > maxTotal {
+		return fmt.Errorf("%d interfaces of message exceed limit of %d", state.totalInterfaces+n, maxTotal)
+	}
+	state.totalInterfaces += n
+	return nil
+}
+
+// checkLimits checks the depth, number of path interfaces, and expanded size
+// of the segment that is currently decoded against the limits of the Decoder,
+// and it adds the expanded size to the total of the message.
+func (state *decodeState) checkLimits(depth, ifcount, size int) error {
+	if maxDepth := state.decoder.maxDepth(); depth > maxDepth {
+		return fmt.Errorf("depth %d exceeds limit of %d", depth, maxDepth)
+	}
+	if maxInterfaces := state.decoder.maxInterfaces(); ifcount > maxInterfaces {
+		return fmt.Errorf("%d interfaces exceed limit of %d", ifcount, maxInterfaces)
+	}
+	if maxSize := state.decoder.maxExpandedSize(); size > maxSize {
+		return fmt.Errorf("expanded size %d exceeds limit of %d", size, maxSize)
+	}
+	if maxTotal := state.decoder.maxTotalExpandedSize(); state.totalSize+size > maxTotal {
+		return fmt.Errorf("expanded size %d of message exceeds limit of %d", state.totalSize+size, maxTotal)
+	}
+	state.totalSize += size
+	return nil
+}
+
+// record records the depth, number of path interfaces, and expanded size of
+// the segment that is currently decoded.
+func (state *decodeState) record(depth, ifcount, size int) {
+	state.depths[state.index], state.ifcounts[state.index], state.sizes[state.index] = depth, ifcount, size
+}
+
+var (
+	codecs     = make(map[SegmentType]segmentCodec)
+	codecTypes = make(map[reflect.Type]SegmentType)
+)
+
+func init() {
+	registerCodec(TypeLiteral, Literal{}, segmentCodec{
+		encodedLen: encodedLiteralLen,
+		appendBody: appendLiteral,
+		decode:     decodeLiteral,
+	})
+	registerCodec(TypeComposition, Composition{}, segmentCodec{
+		encodedLen: encodedCompositionLen,
+		appendBody: appendComposition,
+		decode:     decodeComposition,
+	})
+}
+
+func registerCodec(t SegmentType, prototype Segment, codec segmentCodec) {
+	gotype := reflect.TypeOf(prototype)
+	if t > MaxSegmentType {
+		panic(fmt.Sprintf("segment: type %d exceeds maximum of %d", t, MaxSegmentType))
+	}
+	if _, ok := codecs[t]; ok {
+		panic(fmt.Sprintf("segment: type %d is already registered", t))
+	}
+	if _, ok := codecTypes[gotype]; ok {
+		panic(fmt.Sprintf("segment: %s is already registered", gotype))
+	}
+	codec.segtype = t
+	codecs[t] = codec
+	codecTypes[gotype] = t
+}
+
+// codecOf returns the codec for the dynamic type of the segment.
+func codecOf(segment Segment) (segmentCodec, bool) {
+	t, ok := codecTypes[reflect.TypeOf(segment)]
+	if !ok {
+		return segmentCodec{}, false
+	}
+	return codecs[t], true
+}
@@ -0,0 +1,160 @@
+package segment
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// namedPath is a segment that is transmitted by the name of a well-known path
+// instead of its path interfaces.
+type namedPath struct {
+	Literal
+	name string
+}
+
+const typeNamedPath SegmentType = 2
+
+var wellKnownPaths = map[string]Literal{
+	"core": FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108").(Literal),
+}
+
+func init() {
+	RegisterType(typeNamedPath, namedPath{}, TypeCodec{
+		Encode: func(segment Segment) ([]byte, error) {
+			return []byte(segment.(namedPath).name), nil
+		},
+		Decode: func(body []byte) (Segment, error) {
+			literal, ok := wellKnownPaths[string(body)]
+			if !ok {
+				return nil, fmt.Errorf("unknown path %q", body)
+			}
+			return namedPath{Literal: literal, name: string(body)}, nil
+		},
+	})
+}
+
+func TestRegisterType(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	core := namedPath{Literal: wellKnownPaths["core"], name: "core"}
+	newsegs := []Segment{core, FromSegments(a, core)}
+	msg, _, err := EncodeSegments(newsegs, []Segment{}, a.SrcIA(), core.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg) != EncodedSize(newsegs) {
+		t.Error("want encoded size", EncodedSize(newsegs), "have", len(msg))
+	}
+	_, accsegs, _, _, err := DecodeSegments(msg, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFingerprints(t, accsegs, newsegs)
+	if named, ok := accsegs[0].(namedPath); !ok || named.name != "core" {
+		t.Errorf("want named path %q, have %#v", "core", accsegs[0])
+	}
+	if sub := accsegs[1].(Composition).Segments[1]; reflect.TypeOf(sub) != reflect.TypeOf(core) {
+		t.Errorf("want named path as subsegment, have %#v", sub)
+	}
+	dump, _ := DumpWire(msg)
+	if !strings.Contains(dump, "(type 2, accepted: true)") || !strings.Contains(dump, fmt.Sprintf("body: %x", "core")) {
+		t.Errorf("dump lacks the named path:\n%s", dump)
+	}
+
+	// Decoding fails for unknown names and for unregistered types.
+	unknown, _, err := EncodeSegments([]Segment{namedPath{Literal: a.(Literal), name: "edge"}}, []Segment{}, a.SrcIA(), a.DstIA())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := DecodeSegments(unknown, []Segment{}); err == nil || !strings.Contains(err.Error(), "unknown path") {
+		t.Error("unknown name: want error, have", err)
+	}
+	// Version 2 does not verify the checksum, which the flipped bit breaks.
+	unregistered := append([]byte{}, unknown...)
+	unregistered[0] = version2
+	unregistered[int(unregistered[1])] |= SegmentType(4).flags() // type 6
+	if _, _, _, _, err := DecodeSegments(unregistered, []Segment{}); !errors.Is(err, ErrUnknownType) || !strings.Contains(err.Error(), "type 6") {
+		t.Error("unregistered type: want error, have", err)
+	}
+}
+
+func TestRegisterTypeConflict(t *testing.T) {
+	for name, register := range map[string]func(){
+		"type":    func() { RegisterType(typeNamedPath, Composition{}, TypeCodec{}) },
+		"go type": func() { RegisterType(3, namedPath{}, TypeCodec{}) },
+		"range":   func() { RegisterType(MaxSegmentType+1, namedPath{}, TypeCodec{}) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error(name, "conflict: want panic, have none")
+				}
+			}()
+			register()
+		}()
+	}
+}
+
+// unregisteredSegment is a segment implementation whose type is not
+// registered.
+type unregisteredSegment struct {
+	Literal
+}
+
+func TestEncodeUnregisteredType(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302").(Literal)
+	for _, newsegs := range [][]Segment{
+		{unregisteredSegment{a}},
+		{FromSegments(unregisteredSegment{a})},
+	} {
+		_, _, err := EncodeSegments(newsegs, []Segment{}, a.SrcIA(), a.DstIA())
+		if !errors.Is(err, ErrUnknownType) {
+			t.Errorf("%v: want %v, have %v", newsegs, ErrUnknownType, err)
+		}
+	}
+}
+
+func TestDecodeSkipUnknownTypes(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	core := namedPath{Literal: wellKnownPaths["core"], name: "core"}
+	// craft encodes the segments and turns the named path, which is the
+	// segment at the given offset after the header, into a segment of the
+	// unregistered type 6. Version 2 does not verify the checksum.
+	craft := func(newsegs []Segment, offset int) []byte {
+		msg, _, err := EncodeSegments(newsegs, []Segment{}, a.SrcIA(), b.DstIA())
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg[0] = version2
+		msg[int(msg[1])+offset] |= SegmentType(4).flags()
+		return msg
+	}
+	decode := func(msg []byte, skip bool) ([]Segment, []Segment, error) {
+		decoder := NewDecoder(bytes.NewReader(msg))
+		decoder.SkipUnknownTypes = skip
+		newsegs, accsegs, _, _, err := decoder.Decode([]Segment{})
+		return newsegs, accsegs, err
+	}
+
+	skipped := craft([]Segment{core, a, b}, 0)
+	if _, _, err := decode(skipped, false); !errors.Is(err, ErrUnknownType) {
+		t.Error("strict mode: want", ErrUnknownType, "have", err)
+	}
+	newsegs, accsegs, err := decode(skipped, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newsegs) != 3 || newsegs[0] != nil {
+		t.Error("want the skipped segment to be nil at id 0, have", newsegs)
+	}
+	assertFingerprints(t, accsegs, []Segment{a, b})
+
+	referenced := craft([]Segment{FromSegments(a, core)}, encodedSegmentLen(a, 16))
+	if _, _, err := decode(referenced, true); !errors.Is(err, ErrDanglingReference) {
+		t.Error("referenced skipped segment: want", ErrDanglingReference, "have", err)
+	}
+}
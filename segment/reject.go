@@ -0,0 +1,75 @@
+package segment
+
+import "fmt"
+
+// RejectReason explains why an agent did not accept any of the offered
+// segments. It is transmitted as a message option, so that it is available
+// even if the message contains no segments.
+type RejectReason uint8
+
+const (
+	// NotRejected means that no reason was given.
+	NotRejected RejectReason = iota
+	// NoPathToDestination means that no offered segment leads to the
+	// destination ISD-AS.
+	NoPathToDestination
+	// PolicyDenied means that the offered segments violate the policy of the
+	// agent.
+	PolicyDenied
+	// RateLimited means that the agent refused to process the offer because
+	// the peer sent too many offers.
+	RateLimited
+	// ResponseTooLarge means that the agent accepted segments, but even the
+	// smallest response that accepts any of them exceeds the maximum response
+	// size advertised by the peer.
+	ResponseTooLarge
+	// ReplayDetected means that the agent refused to process the offer
+	// because it carries a nonce that the agent has seen before, or a nonce
+	// whose time is outside of the accepted window.
+	ReplayDetected
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case NotRejected:
+		return "not rejected"
+	case NoPathToDestination:
+		return "no path to destination"
+	case PolicyDenied:
+		return "policy denied"
+	case RateLimited:
+		return "rate limited"
+	case ResponseTooLarge:
+		return "response too large"
+	case ReplayDetected:
+		return "replay detected"
+	default:
+		return fmt.Sprintf("unknown reject reason %d", uint8(r))
+	}
+}
+
+// DecodeRejectReason returns the reject reason of the message at the start of
+// the buffer without decoding its segments. It returns NotRejected if the
+// message carries no reject reason.
+func DecodeRejectReason(bytes []byte) (RejectReason, error) {
+	_, msgopts, err := decodeMessageHeader(bytes)
+	if err != nil {
+		return NotRejected, err
+	}
+	return rejectReasonOf(msgopts), nil
+}
+
+// RejectReason returns the reject reason of the message that was last decoded
+// by the Decoder, or NotRejected if the message carries no reject reason.
+func (d *Decoder) RejectReason() RejectReason {
+	return d.rejectReason
+}
+
+func rejectReasonOf(msgopts []Option) RejectReason {
+	for _, option := range msgopts {
+		if option.Type == msgOptRejectReason && len(option.Value) == 1 {
+			return RejectReason(option.Value[0])
+		}
+	}
+	return NotRejected
+}
@@ -0,0 +1,18 @@
+package segment
+
+import "encoding/binary"
+
+// RequestID returns the request id of the message that was last decoded by
+// the Decoder, or zero if the message carries no request id.
+func (d *Decoder) RequestID() uint64 {
+	return d.requestID
+}
+
+func requestIDOf(msgopts []Option) uint64 {
+	for _, option := range msgopts {
+		if option.Type == msgOptRequestID && len(option.Value) == 8 {
+			return binary.BigEndian.Uint64(option.Value)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,50 @@
+package segment
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// MaxResponseBytes returns the maximum response size in bytes that the sender
+// of the message that was last decoded by the Decoder advertised, or zero if
+// the message carries no such limit.
+func (d *Decoder) MaxResponseBytes() int {
+	return d.maxResponseBytes
+}
+
+// Fit returns the longest prefix of the new segments whose message, as
+// encoded by the Encoder, does not exceed maxBytes. The segments are expected
+// in the order of their priority, so that the lowest-priority segments are
+// dropped first. If maxBytes is zero, all segments are returned. If not even
+// the first segment fits, an empty slice is returned.
+func (e *Encoder) Fit(newsegs, oldsegs []Segment, srcIA, dstIA addr.IA, maxBytes int) ([]Segment, error) {
+	if maxBytes == 0 {
+		return newsegs, nil
+	}
+	var err error
+	// The message size grows with the number of segments, so the longest
+	// prefix that fits is found by binary search.
+	n := sort.Search(len(newsegs), func(n int) bool {
+		if err != nil {
+			return true
+		}
+		var bytes []byte
+		bytes, _, _, err = e.encode(newsegs[:n+1], oldsegs, srcIA, dstIA)
+		return len(bytes) > maxBytes
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newsegs[:n], nil
+}
+
+func maxResponseBytesOf(msgopts []Option) int {
+	for _, option := range msgopts {
+		if option.Type == msgOptMaxResponseBytes && len(option.Value) == 4 {
+			return int(binary.BigEndian.Uint32(option.Value))
+		}
+	}
+	return 0
+}
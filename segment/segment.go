@@ -9,16 +9,69 @@ import (
 
 // Segment is an abstraction for any type that represents a sequence of path
 // interfaces between a source AS and a destination AS.
+//
+// Segments are immutable after construction: the constructors of this package
+// copy the slices that they are passed, and methods such as PathInterfaces
+// return copies. The exported fields of Literal and Composition must therefore
+// not be modified in place, since other segments may share them. Use Clone or
+// WithOptions to derive modified segments.
+//
+// The one exception are the literals that a Decoder decodes with
+// ReuseInterfaces, and the segments composed of them: their interfaces alias
+// the scratch buffer of the Decoder, which the next message that it decodes
+// overwrites, also after Reset or after it is returned with PutDecoder and
+// handed out again. Such segments must be cloned to be kept beyond that.
 type Segment interface {
 	// PathInterfaces returns the sequence of path interfaces of which the
-	// segment consists.
+	// segment consists. For a segment composition, this is the concatenation
+	// of the path interfaces of its subsegments in traversal order. Interfaces
+	// at the joins are not deduplicated: the last interface of a subsegment is
+	// the ingress and the first interface of the next subsegment is the egress
+	// interface of the AS at which the subsegments are joined.
 	PathInterfaces() []snet.PathInterface
+	// IterInterfaces calls yield for every path interface of the segment in
+	// the order of PathInterfaces, until yield returns false. Unlike
+	// PathInterfaces, it does not allocate. Its method value is a range
+	// function, i.e., an iter.Seq[snet.PathInterface] in Go 1.23 and later.
+	IterInterfaces(yield func(snet.PathInterface) bool)
 	// SrcIA returns the segment's source ISD-AS address.
 	SrcIA() addr.IA
 	// DstIA returns the segment's destination ISD-AS address.
 	DstIA() addr.IA
-	// Fingerprint returns a string that uniquely identifies the segment.
+	// ASPath returns the sequence of distinct ISD-ASes that the segment
+	// traverses, in the order of its path interfaces.
+	ASPath() []addr.IA
+	// Contains reports whether the segment traverses the given interface.
+	Contains(snet.PathInterface) bool
+	// ContainsIA reports whether the segment traverses the given ISD-AS.
+	ContainsIA(addr.IA) bool
+	// Len returns the number of hops of the segment, i.e., the number of
+	// pairs of path interfaces. For a segment composition, this is the sum of
+	// the hops of its subsegments.
+	Len() int
+	// Depth returns the nesting depth of the segment, where a segment literal
+	// has depth 1 and a segment composition is one level deeper than its
+	// deepest subsegment.
+	Depth() int
+	// LeafCount returns the number of segment literals of which the segment
+	// consists, i.e., 1 for a segment literal and the sum over the
+	// subsegments for a segment composition.
+	LeafCount() int
+	// Fingerprint returns a string that uniquely identifies the segment's
+	// sequence of path interfaces, i.e., the hash over the CanonicalBytes of
+	// the equivalent segment literal (see path.InterfacesFingerprint).
 	Fingerprint() string
+	// Equal reports whether the segment is structurally equal to another
+	// segment, i.e., whether both are of the same type and consist of the
+	// same interfaces or (recursively) equal subsegments. Options are not
+	// taken into account.
+	Equal(Segment) bool
+	// Reverse returns the segment in the opposite direction, i.e., from the
+	// destination ISD-AS to the source ISD-AS.
+	Reverse() Segment
+	// Clone returns a deep copy of the segment that shares no interfaces,
+	// subsegments, or options with the original segment.
+	Clone() Segment
 	// Segment implements the fmt.Stringer interface.
 	fmt.Stringer
 }
@@ -37,3 +37,103 @@ func (ss SegmentSet) MatchingPaths(paths []snet.Path) []snet.Path {
 func (ss SegmentSet) EnumeratePaths() []Segment {
 	return SrcDstPaths(ss.Segments, ss.SrcIA, ss.DstIA)
 }
+
+// Diff compares two sets of segments by their fingerprints. It returns the
+// segments that are only in a, the segments that are only in b, and the
+// segments that are in both sets. The segments are returned in the order of
+// a, except for the segments that are only in b, which are returned in the
+// order of b. Segments with the same fingerprint as an earlier segment of the
+// same set are omitted.
+func Diff(a, b []Segment) ([]Segment, []Segment, []Segment) {
+	ina := fingerprintSet(a)
+	inb := fingerprintSet(b)
+	onlyA, onlyB, both := make([]Segment, 0), make([]Segment, 0), make([]Segment, 0)
+	seen := make(map[string]bool, len(a))
+	for _, segment := range a {
+		fingerprint := segment.Fingerprint()
+		if seen[fingerprint] {
+			continue
+		}
+		seen[fingerprint] = true
+		if inb[fingerprint] {
+			both = append(both, segment)
+		} else {
+			onlyA = append(onlyA, segment)
+		}
+	}
+	for _, segment := range b {
+		fingerprint := segment.Fingerprint()
+		if !ina[fingerprint] && !seen[fingerprint] {
+			seen[fingerprint] = true
+			onlyB = append(onlyB, segment)
+		}
+	}
+	return onlyA, onlyB, both
+}
+
+// DedupBy removes the segments with the same key as an earlier segment,
+// keeping the first occurrence. Passing Segment.Fingerprint as the key
+// removes duplicate paths, and passing UndirectedFingerprint additionally
+// removes the reverses of earlier paths.
+func DedupBy(segments []Segment, key func(Segment) string) []Segment {
+	seen := make(map[string]bool, len(segments))
+	deduped := make([]Segment, 0, len(segments))
+	for _, segment := range segments {
+		if k := key(segment); !seen[k] {
+			seen[k] = true
+			deduped = append(deduped, segment)
+		}
+	}
+	return deduped
+}
+
+// SelectDisjoint greedily selects up to k of the segments for redundancy, such
+// that they share as few path interfaces as possible. It repeatedly picks the
+// segment whose flattened path interfaces overlap the least with those of the
+// segments selected so far. Ties are broken by the fewest hops and then by the
+// order of the segments, so the shortest segment is selected first. The
+// segments are returned in the order of their selection.
+func SelectDisjoint(segs []Segment, k int) []Segment {
+	if k > len(segs) {
+		k = len(segs)
+	}
+	if k <= 0 {
+		return []Segment{}
+	}
+	used := make(map[snet.PathInterface]bool)
+	selected := make([]Segment, 0, k)
+	taken := make([]bool, len(segs))
+	for len(selected) < k {
+		best, bestShared := -1, 0
+		for i, segment := range segs {
+			if taken[i] {
+				continue
+			}
+			shared := 0
+			segment.IterInterfaces(func(iface snet.PathInterface) bool {
+				if used[NormalizeInterface(iface)] {
+					shared++
+				}
+				return true
+			})
+			if best < 0 || shared < bestShared || shared == bestShared && segment.Len() < segs[best].Len() {
+				best, bestShared = i, shared
+			}
+		}
+		taken[best] = true
+		selected = append(selected, segs[best])
+		segs[best].IterInterfaces(func(iface snet.PathInterface) bool {
+			used[NormalizeInterface(iface)] = true
+			return true
+		})
+	}
+	return selected
+}
+
+func fingerprintSet(segments []Segment) map[string]bool {
+	set := make(map[string]bool, len(segments))
+	for _, segment := range segments {
+		set[segment.Fingerprint()] = true
+	}
+	return set
+}
@@ -0,0 +1,859 @@
+package segment
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"strings"
+	"testing"
+
+	"github.com/mblarer/conpass/path"
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/common"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+func TestValidateCyclicComposition(t *testing.T) {
+	literal := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	cyclic := Composition{Segments: make([]Segment, 2)}
+	cyclic.Segments[0] = literal
+	cyclic.Segments[1] = cyclic // shares the subsegment slice with itself
+	if err := Validate(cyclic); err == nil {
+		t.Error("cyclic composition: want error, have nil")
+	}
+	wrapper := Composition{Segments: []Segment{literal, cyclic}}
+	if err := Validate(wrapper); err == nil {
+		t.Error("composition containing a cycle: want error, have nil")
+	}
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("19-ffaa:0:1302")
+	if _, _, err := EncodeSegments([]Segment{cyclic}, []Segment{}, srcIA, dstIA); err == nil {
+		t.Error("encoding cyclic composition: want error, have nil")
+	}
+}
+
+func TestValidateSharedSubsegment(t *testing.T) {
+	literal := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	shared := FromSegments(literal, literal)
+	dag := FromSegments(shared, shared)
+	if err := Validate(dag); err != nil {
+		t.Error("acyclic composition with shared subsegments:", err)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	ab := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	tests := []struct {
+		name  string
+		x, y  Segment
+		equal bool
+	}{
+		{"same literal", a, FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"), true},
+		{"different literals", a, b, false},
+		{"same composition", FromSegments(a, b), FromSegments(a, b), true},
+		{"reordered composition", FromSegments(a, b), FromSegments(b, a), false},
+		{"nested composition", FromSegments(FromSegments(a), b), FromSegments(a, b), false},
+		{"literal and composition", ab, FromSegments(a, b), false},
+	}
+	for _, test := range tests {
+		if test.x.Equal(test.y) != test.equal || test.y.Equal(test.x) != test.equal {
+			t.Error(test.name, "want equal:", test.equal, "have:", !test.equal)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108 2>1 17-ffaa:0:1102")
+	tests := []struct {
+		segment Segment
+		want    string
+	}{
+		{a, "19-ffaa:0:1303#1 > 19-ffaa:0:1302#1"},
+		{b, "19-ffaa:0:1302#2 > 17-ffaa:0:1108#1 > 17-ffaa:0:1108#2 > 17-ffaa:0:1102#1"},
+		{FromSegments(a, b), "[19-ffaa:0:1303#1 > 19-ffaa:0:1302#1 | 19-ffaa:0:1302#2 > 17-ffaa:0:1108#1 > 17-ffaa:0:1108#2 > 17-ffaa:0:1102#1]"},
+		{FromSegments(FromSegments(a), b), "[[19-ffaa:0:1303#1 > 19-ffaa:0:1302#1] | 19-ffaa:0:1302#2 > 17-ffaa:0:1108#1 > 17-ffaa:0:1108#2 > 17-ffaa:0:1102#1]"},
+		{FromInterfaces(), ""},
+		{FromSegments(), "[]"},
+	}
+	for _, test := range tests {
+		if have := test.segment.String(); have != test.want {
+			t.Error("want:", test.want, "have:", have)
+		}
+		if have := fmt.Sprint(test.segment); have != test.want {
+			t.Error("Sprint: want:", test.want, "have:", have)
+		}
+	}
+}
+
+func TestPathInterfaces(t *testing.T) {
+	literal := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108 2>1 17-ffaa:0:1102 2>1 17-ffaa:0:1107")
+	composition := FromSegments(
+		FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		FromSegments(
+			FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+			FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102 2>1 17-ffaa:0:1107"),
+		),
+	)
+	have, want := composition.PathInterfaces(), literal.PathInterfaces()
+	if len(have) != len(want) {
+		t.Fatal("interfaces have not right length, want:", len(want), ", have:", len(have))
+	}
+	for i := range have {
+		if have[i] != want[i] {
+			t.Error("interface", i, "want:", want[i], "have:", have[i])
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>2 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 3>4 17-ffaa:0:1108 5>6 17-ffaa:0:1102")
+	want := FromString("17-ffaa:0:1102 6>5 17-ffaa:0:1108 4>3 19-ffaa:0:1302 2>1 19-ffaa:0:1303")
+	for _, segment := range []Segment{FromSegments(a, b), FromSegments(FromSegments(a), b)} {
+		reversed := segment.Reverse()
+		if reversed.Fingerprint() != want.Fingerprint() {
+			t.Error("want:", want, "have:", reversed)
+		}
+		if reversed.Reverse().Fingerprint() != segment.Fingerprint() {
+			t.Error("want:", segment, "have:", reversed.Reverse())
+		}
+		if !reversed.Reverse().Equal(segment) {
+			t.Error("reversing twice does not preserve structure of", segment)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	// Naively concatenating the ISD-AS and interface ID strings yields
+	// "1-ff00:0:111" for both interfaces.
+	ia1, _ := addr.IAFromString("1-ff00:0:11")
+	ia2, _ := addr.IAFromString("1-ff00:0:1")
+	a := FromInterfaces(snet.PathInterface{IA: ia1, ID: common.IFIDType(1)})
+	b := FromInterfaces(snet.PathInterface{IA: ia2, ID: common.IFIDType(11)})
+	if a.Fingerprint() == b.Fingerprint() {
+		t.Error("distinct segments share fingerprint:", a, b)
+	}
+
+	literal := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	composition := FromSegments(
+		FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+	)
+	if literal.Fingerprint() != composition.Fingerprint() {
+		t.Error("equivalent segments have different fingerprints:", literal, composition)
+	}
+	spath := path.InterfacePath{Interfaces: literal.PathInterfaces()}
+	if path.Fingerprint(spath) != literal.Fingerprint() {
+		t.Error("path and equivalent segment have different fingerprints:", literal)
+	}
+}
+
+func TestFromSegmentsSharedSubsegments(t *testing.T) {
+	// Each level refers to the previous one 50 times, so the expanded form
+	// has more than 50^6 segments. Constructing it must not expand it.
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	var segment Segment = FromInterfaces()
+	for level := 0; level < 6; level++ {
+		subsegs := make([]Segment, 50)
+		for i := range subsegs {
+			subsegs[i] = segment
+		}
+		segment = FromSegments(subsegs...)
+	}
+	segment = FromSegments(segment, a, segment)
+	if have := segment.Depth(); have != 8 {
+		t.Error("want depth 8, have", have)
+	}
+	if have := segment.PathInterfaces(); len(have) != 2 || !SamePath(segment, a) {
+		t.Error("want interfaces of", a, "have", have)
+	}
+	if segment.Fingerprint() != a.Fingerprint() {
+		t.Error("want fingerprint of", a, "have", segment.Fingerprint())
+	}
+}
+
+func TestStructuralFingerprint(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("17-ffaa:0:1108 3>1 16-ffaa:0:1001")
+	// All of these traverse the same path and share the same Fingerprint,
+	// and concatenating the interfaces of their literals yields the same
+	// bytes for each of them.
+	segments := []Segment{
+		FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108 3>1 16-ffaa:0:1001"),
+		FromSegments(a, b, c),
+		FromSegments(FromSegments(a, b), c),
+		FromSegments(a, FromSegments(b, c)),
+		FromSegments(FromSegments(a, b, c)),
+		FromSegments(FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108"), c),
+	}
+	for i, x := range segments {
+		for j, y := range segments {
+			if x.Fingerprint() != y.Fingerprint() {
+				t.Error("equivalent segments have different fingerprints:", x, y)
+			}
+			if (StructuralFingerprint(x) == StructuralFingerprint(y)) != (i == j) {
+				t.Error("structural fingerprints of", x, "and", y, "disagree with Equal")
+			}
+		}
+	}
+	if StructuralFingerprint(FromSegments(a, b)) != StructuralFingerprint(FromSegments(a.Clone(), b.Clone())) {
+		t.Error("equal segments have different structural fingerprints")
+	}
+}
+
+func TestSetFingerprintHash(t *testing.T) {
+	defer path.SetFingerprintHash(nil)
+	literal := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	path.SetFingerprintHash(func() hash.Hash { return fnv.New64a() })
+	fnvLiteral := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	if len(fnvLiteral.Fingerprint()) != 16 {
+		t.Error("want 64-bit fingerprint, have:", fnvLiteral.Fingerprint())
+	}
+	if fnvLiteral.Fingerprint() == literal.Fingerprint() {
+		t.Error("fingerprint did not change with hash function")
+	}
+
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	composition := FromSegments(fnvLiteral, FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"))
+	bytes, _, err := EncodeSegments([]Segment{composition}, []Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path.SetFingerprintHash(nil)
+	_, accsegs, _, _, err := DecodeSegments(bytes, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accsegs[0].Fingerprint() != FromSegments(literal, FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")).Fingerprint() {
+		t.Error("want:", composition, "have:", accsegs[0])
+	}
+}
+
+func TestToPath(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	paths := []snet.Path{
+		path.InterfacePath{Interfaces: b.PathInterfaces()},
+		path.InterfacePath{Interfaces: FromSegments(a, b).PathInterfaces()},
+	}
+	spath, err := ToPath(FromSegments(a, b), paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Fingerprint(spath) != path.Fingerprint(paths[1]) {
+		t.Error("want:", paths[1], "have:", spath)
+	}
+	if _, err := ToPath(a, paths); err == nil {
+		t.Error("segment without matching path: want error, have nil")
+	}
+}
+
+func TestFromPath(t *testing.T) {
+	want := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	segment := FromPath(path.InterfacePath{Interfaces: want.PathInterfaces()})
+	if _, ok := segment.(Literal); !ok || segment.Fingerprint() != want.Fingerprint() {
+		t.Error("want:", want, "have:", segment)
+	}
+	empty := FromPath(path.InterfacePath{})
+	if len(empty.PathInterfaces()) != 0 || empty.Fingerprint() != FromInterfaces().Fingerprint() {
+		t.Error("want empty literal, have:", empty)
+	}
+}
+
+func TestValidateAdjacency(t *testing.T) {
+	valid := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108").(Literal)
+	if err := valid.ValidateAdjacency(); err != nil {
+		t.Error("well-formed literal:", err)
+	}
+	broken := FromInterfaces(
+		valid.Interfaces[0],
+		valid.Interfaces[1],
+		snet.PathInterface{ID: valid.Interfaces[2].ID, IA: valid.Interfaces[0].IA},
+		valid.Interfaces[3],
+	).(Literal)
+	if err := broken.ValidateAdjacency(); err == nil {
+		t.Error("literal with IA discontinuity: want error, have nil")
+	}
+	odd := FromInterfaces(valid.Interfaces[:3]...).(Literal)
+	if err := odd.ValidateAdjacency(); err == nil {
+		t.Error("literal with odd number of interfaces: want error, have nil")
+	}
+	// The path returns to 19-ffaa:0:1303 and leaves it again through #1.
+	loop := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>2 19-ffaa:0:1303 1>1 19-ffaa:0:1302").(Literal)
+	err := loop.ValidateAdjacency()
+	if err == nil || !strings.Contains(err.Error(), "19-ffaa:0:1303#1") {
+		t.Error("literal with repeated interface: want error naming it, have", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	ab := FromSegments(a, b)
+	gap := FromSegments(a, FromString("19-ffaa:0:1304 2>1 17-ffaa:0:1108"))
+	dangling := Composition{Segments: []Segment{a, nil}}
+	srcIA, dstIA := a.SrcIA(), b.DstIA()
+	tests := []struct {
+		name    string
+		newsegs []Segment
+		accsegs []Segment
+		opts    VerifyOptions
+		valid   bool
+	}{
+		{"no validations", []Segment{a, gap, dangling}, []Segment{a}, VerifyOptions{}, true},
+		{"all validations", []Segment{a, b, ab}, []Segment{ab}, VerifyOptions{
+			Structure: true, Adjacency: true, Endpoints: true, MaxSegments: 3, MaxDepth: 2, MaxInterfaces: 4,
+		}, true},
+		{"skipped segment", []Segment{a, nil}, nil, VerifyOptions{Structure: true, Adjacency: true}, true},
+		{"dangling subsegment", []Segment{a, dangling}, nil, VerifyOptions{Structure: true}, false},
+		{"broken adjacency", []Segment{a, gap}, nil, VerifyOptions{Adjacency: true}, false},
+		{"wrong endpoints", []Segment{a, b, ab}, []Segment{a}, VerifyOptions{Endpoints: true}, false},
+		{"too many segments", []Segment{a, b, ab}, nil, VerifyOptions{MaxSegments: 2}, false},
+		{"too deep", []Segment{a, b, FromSegments(ab)}, nil, VerifyOptions{MaxDepth: 2}, false},
+		{"too many interfaces", []Segment{a, b, ab}, nil, VerifyOptions{MaxInterfaces: 2}, false},
+	}
+	for _, test := range tests {
+		err := Verify(test.newsegs, test.accsegs, srcIA, dstIA, test.opts)
+		if test.valid && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: want error, have nil", test.name)
+		}
+	}
+	err := Verify([]Segment{a, b, ab}, nil, srcIA, dstIA, VerifyOptions{MaxSegments: 2})
+	if !errors.Is(err, ErrTooManySegments) {
+		t.Error("too many segments: want ErrTooManySegments, have", err)
+	}
+}
+
+func TestVerifyEndpoints(t *testing.T) {
+	srcIA, _ := addr.IAFromString("19-ffaa:0:1303")
+	dstIA, _ := addr.IAFromString("17-ffaa:0:1108")
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	if err := VerifyEndpoints([]Segment{FromSegments(a, b)}, srcIA, dstIA); err != nil {
+		t.Error("end-to-end segment:", err)
+	}
+	empty := FromInterfaces()
+	padded := FromSegments(empty, a, FromSegments(empty), b, empty)
+	if err := VerifyEndpoints([]Segment{padded}, srcIA, dstIA); err != nil {
+		t.Error("end-to-end segment with empty subsegments:", err)
+	}
+	for _, segment := range []Segment{a, b, empty, FromSegments(empty, a, empty)} {
+		if err := VerifyEndpoints([]Segment{FromSegments(a, b), segment}, srcIA, dstIA); err == nil {
+			t.Error("segment", segment, "does not connect endpoints: want error, have nil")
+		}
+	}
+}
+
+func TestFromInterfacesChecked(t *testing.T) {
+	valid := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302").(Literal).Interfaces
+	if literal, err := FromInterfacesChecked(valid...); err != nil || !literal.Equal(FromInterfaces(valid...)) {
+		t.Error("well-formed interfaces:", literal, err)
+	}
+	tests := []struct {
+		name       string
+		interfaces []snet.PathInterface
+	}{
+		{"empty", nil},
+		{"odd", valid[:1]},
+		{"zero IA", []snet.PathInterface{valid[0], {ID: valid[1].ID}}},
+		{"zero IFID", []snet.PathInterface{valid[0], {IA: valid[1].IA}}},
+	}
+	for _, test := range tests {
+		if _, err := FromInterfacesChecked(test.interfaces...); err == nil {
+			t.Error(test.name, "interfaces: want error, have nil")
+		}
+	}
+}
+
+func TestCanonicalBytes(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	ab := FromSegments(a, b)
+	segments := []Segment{a, b, ab, FromSegments(b, a), FromSegments(FromSegments(a), b),
+		FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")}
+	for _, x := range segments {
+		for _, y := range segments {
+			if bytes.Equal(CanonicalBytes(x), CanonicalBytes(y)) != x.Equal(y) {
+				t.Error("canonical bytes of", x, "and", y, "disagree with Equal")
+			}
+		}
+	}
+	// The same segment transmitted in different sessions, where it refers to
+	// its subsegments by different ids, has the same canonical bytes.
+	for _, oldsegs := range [][]Segment{{}, {a}, {b, FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108"), a}} {
+		msg, _, err := EncodeSegments([]Segment{ab}, oldsegs, a.SrcIA(), b.DstIA())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, accsegs, _, _, err := DecodeSegments(msg, oldsegs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(CanonicalBytes(accsegs[0]), CanonicalBytes(ab)) {
+			t.Error("canonical bytes depend on", len(oldsegs), "old segments")
+		}
+	}
+	// Fingerprints are backed by the canonical bytes of the equivalent
+	// literal.
+	for _, segment := range segments {
+		sum := sha256.Sum256(CanonicalBytes(FromInterfaces(segment.PathInterfaces()...)))
+		if segment.Fingerprint() != hex.EncodeToString(sum[:]) {
+			t.Error("fingerprint of", segment, "is not backed by canonical bytes")
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>2 19-ffaa:0:1302").(Literal)
+	a.Options = []Option{{Type: 7, Value: []byte{1}}}
+	b := FromString("19-ffaa:0:1302 3>4 17-ffaa:0:1108")
+	original := FromSegments(a, b).(Composition)
+	want := FromSegments(FromString("19-ffaa:0:1303 1>2 19-ffaa:0:1302"), b)
+
+	clone := original.Clone().(Composition)
+	if !clone.Equal(original) || clone.Fingerprint() != original.Fingerprint() {
+		t.Fatal("want:", original, "have:", clone)
+	}
+	literal := clone.Segments[0].(Literal)
+	literal.Interfaces[0].ID = 9
+	literal.Options[0].Value[0] = 9
+	clone.Segments[1] = a
+	if !original.Equal(want) {
+		t.Error("mutating the clone changed the original:", original)
+	}
+	if original.Segments[0].(Literal).Options[0].Value[0] != 1 {
+		t.Error("mutating the clone changed the options of the original")
+	}
+}
+
+func TestLen(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108 2>1 17-ffaa:0:1102")
+	literal := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108 2>1 17-ffaa:0:1102")
+	if a.Len() != 1 || b.Len() != 2 || literal.Len() != 3 {
+		t.Error("want 1, 2, 3 hops, have", a.Len(), b.Len(), literal.Len())
+	}
+	for _, composition := range []Segment{FromSegments(a, b), FromSegments(FromSegments(a), b)} {
+		if composition.Len() != literal.Len() {
+			t.Error(composition, "want", literal.Len(), "hops, have", composition.Len())
+		}
+	}
+}
+
+func TestContains(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302").(Literal)
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108").(Literal)
+	c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102").(Literal)
+	if !a.Contains(a.Interfaces[1]) || a.Contains(b.Interfaces[0]) {
+		t.Error("literal", a, "contains wrong interfaces")
+	}
+	if !a.ContainsIA(a.DstIA()) || a.ContainsIA(b.DstIA()) {
+		t.Error("literal", a, "contains wrong ISD-ASes")
+	}
+	nested := FromSegments(a, FromSegments(b, FromSegments(c)))
+	if !nested.Contains(c.Interfaces[1]) || !nested.ContainsIA(c.DstIA()) {
+		t.Error("composition", nested, "does not contain interface of deep child")
+	}
+	if nested.Contains(snet.PathInterface{ID: 9, IA: c.DstIA()}) {
+		t.Error("composition", nested, "contains interface that it does not traverse")
+	}
+}
+
+func TestWalk(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102")
+	bc := FromSegments(b, c)
+	root := FromSegments(a, bc)
+	visited := make([]Segment, 0)
+	completed := Walk(root, func(segment Segment) bool {
+		visited = append(visited, segment)
+		return true
+	})
+	want := []Segment{root, a, bc, b, c}
+	if !completed || len(visited) != len(want) {
+		t.Fatal("want", len(want), "visits, have", len(visited), "completed:", completed)
+	}
+	for i := range want {
+		if !visited[i].Equal(want[i]) {
+			t.Error("visit", i, "want", want[i], "have", visited[i])
+		}
+	}
+
+	visits := 0
+	completed = Walk(root, func(segment Segment) bool {
+		visits++
+		return !segment.Equal(bc)
+	})
+	if completed || visits != 3 {
+		t.Error("want traversal to stop after 3 visits, have", visits, "completed:", completed)
+	}
+}
+
+func TestIfaceEqual(t *testing.T) {
+	ia, _ := addr.IAFromString("19-ffaa:0:1303")
+	a := snet.PathInterface{ID: 1, IA: ia}
+	equivalent := []snet.PathInterface{
+		{ID: common.IFIDType(1), IA: addr.IA{I: 19, A: ia.A}},
+		{ID: 1, IA: ia.IAInt().IA()},
+		{ID: 1, IA: addr.IA{I: ia.I, A: ia.A | 1<<addr.ASBits}}, // excess AS bits
+	}
+	for _, b := range equivalent {
+		if !IfaceEqual(a, b) || NormalizeInterface(b) != a {
+			t.Error(a, "and", b, "are not equal")
+		}
+		if !FromInterfaces(a, a).Equal(FromInterfaces(b, b)) ||
+			FromInterfaces(a).Fingerprint() != FromInterfaces(b).Fingerprint() {
+			t.Error("Equal and Fingerprint disagree for", a, "and", b)
+		}
+		if !FromInterfaces(a, a).Contains(b) || !FromInterfaces(a, a).ContainsIA(b.IA) {
+			t.Error(a, "does not contain", b)
+		}
+	}
+	if IfaceEqual(a, snet.PathInterface{ID: 2, IA: ia}) {
+		t.Error("interfaces with different ids are equal")
+	}
+}
+
+func TestSelectDisjoint(t *testing.T) {
+	p1 := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	p2 := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 3>2 17-ffaa:0:1108") // shares 19-ffaa:0:1303#1 and 19-ffaa:0:1302#1 with p1
+	p3 := FromString("19-ffaa:0:1303 2>1 19-ffaa:0:1304 2>3 17-ffaa:0:1108")
+	p4 := FromString("19-ffaa:0:1303 3>4 17-ffaa:0:1108")
+	tests := []struct {
+		segs []Segment
+		k    int
+		want []Segment
+	}{
+		{[]Segment{p1, p2, p3}, 2, []Segment{p1, p3}},
+		{[]Segment{p1, p2, p3}, 3, []Segment{p1, p3, p2}},
+		{[]Segment{p1, p2, p3, p4}, 2, []Segment{p4, p1}},
+		{[]Segment{p2, p1}, 5, []Segment{p2, p1}},
+		{[]Segment{p1, p2, p3}, 0, []Segment{}},
+	}
+	for _, test := range tests {
+		have := SelectDisjoint(test.segs, test.k)
+		if len(have) != len(test.want) {
+			t.Errorf("k=%d: want %v, have %v", test.k, test.want, have)
+			continue
+		}
+		for i := range have {
+			if have[i].Fingerprint() != test.want[i].Fingerprint() {
+				t.Errorf("k=%d: want %v, have %v", test.k, test.want, have)
+				break
+			}
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	ab := FromSegments(a, b)
+	tests := []struct {
+		name               string
+		a, b               []Segment
+		onlyA, onlyB, both []Segment
+	}{
+		{"disjoint", []Segment{a, b}, []Segment{c}, []Segment{a, b}, []Segment{c}, nil},
+		{"identical", []Segment{a, ab}, []Segment{ab, a}, nil, nil, []Segment{a, ab}},
+		{"partial overlap", []Segment{a, b, c}, []Segment{c, ab, a}, []Segment{b}, []Segment{ab}, []Segment{a, c}},
+		{"duplicates", []Segment{a, a}, []Segment{b, b}, []Segment{a}, []Segment{b}, nil},
+		// A composition and a literal with the same interfaces share their
+		// fingerprint.
+		{"equivalent structure", []Segment{ab}, []Segment{FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")}, nil, nil, []Segment{ab}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			onlyA, onlyB, both := Diff(test.a, test.b)
+			assertFingerprints(t, onlyA, test.onlyA)
+			assertFingerprints(t, onlyB, test.onlyB)
+			assertFingerprints(t, both, test.both)
+		})
+	}
+}
+
+func TestFromSegmentIDs(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	oldsegs := []Segment{a, b, nil}
+	composition, err := FromSegmentIDs(oldsegs, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := FromSegments(a, b); !composition.Equal(want) || composition.Fingerprint() != want.Fingerprint() {
+		t.Error("want", want, "have", composition)
+	}
+	for _, ids := range [][]int{{0, 3}, {-1}, {2}} {
+		if _, err := FromSegmentIDs(oldsegs, ids...); err == nil {
+			t.Error("ids", ids, "want error, have nil")
+		}
+	}
+	if _, err := FromSegmentIDs(oldsegs, 2); !errors.Is(err, ErrDanglingReference) {
+		t.Error("nil old segment: want", ErrDanglingReference, "have", err)
+	}
+}
+
+func TestCompositionBuilder(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102 2>1 17-ffaa:0:1107")
+	var builder CompositionBuilder
+	if have, err := builder.Build(); err == nil {
+		t.Error("empty builder: want error, have", have)
+	}
+	for _, segment := range []Segment{a, FromSegments(b, c)} {
+		if err := builder.Add(segment); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if have, err := builder.Build(); err != nil || !have.Equal(FromSegments(a, FromSegments(b, c))) {
+		t.Error("want", FromSegments(a, FromSegments(b, c)), "have", have, err)
+	}
+
+	builder = CompositionBuilder{}
+	if err := builder.Add(a); err != nil {
+		t.Fatal(err)
+	}
+	err := builder.Add(c)
+	if err == nil {
+		t.Fatal("disconnected subsegment: want error, have nil")
+	}
+	for _, ia := range []string{"17-ffaa:0:1108", "19-ffaa:0:1302"} {
+		if !strings.Contains(err.Error(), ia) {
+			t.Errorf("error %q does not name %s", err, ia)
+		}
+	}
+	if err := builder.Add(FromInterfaces()); err == nil {
+		t.Error("empty subsegment: want error, have nil")
+	}
+	if have, err := builder.Build(); err != nil || !have.Equal(FromSegments(a)) {
+		t.Error("rejected subsegments were added:", have, err)
+	}
+}
+
+func TestFlatten(t *testing.T) {
+	a := FromString("1-ff00:0:1 1>2 1-ff00:0:2")
+	b := FromString("1-ff00:0:2 3>4 1-ff00:0:3")
+	c := FromString("1-ff00:0:3 5>6 1-ff00:0:4")
+	d := FromString("1-ff00:0:5 7>8 1-ff00:0:6") // does not join
+	tests := []struct {
+		name    string
+		segment Segment
+		want    Segment
+	}{
+		{"literal", a, a},
+		{"two literals", FromSegments(a, b), FromString("1-ff00:0:1 1>2 1-ff00:0:2 3>4 1-ff00:0:3")},
+		{"nested", FromSegments(FromSegments(a, b), c), FromString("1-ff00:0:1 1>2 1-ff00:0:2 3>4 1-ff00:0:3 5>6 1-ff00:0:4")},
+		{"gap", FromSegments(FromSegments(a, b), d), FromSegments(FromString("1-ff00:0:1 1>2 1-ff00:0:2 3>4 1-ff00:0:3"), d)},
+		{"empty", FromSegments(), FromSegments()},
+	}
+	for _, test := range tests {
+		have := Flatten(test.segment)
+		if have.Fingerprint() != test.segment.Fingerprint() {
+			t.Errorf("%s: flattened interfaces differ: want %v, have %v", test.name, test.segment, have)
+		}
+		if !have.Equal(test.want) {
+			t.Errorf("%s: want %v, have %v", test.name, test.want, have)
+		}
+	}
+}
+
+func TestUndirectedFingerprint(t *testing.T) {
+	forward := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	reverse := forward.Reverse()
+	composed := FromSegments(FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"), FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"))
+	other := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	if forward.Fingerprint() == reverse.Fingerprint() {
+		t.Error("forward and reverse literal share a fingerprint")
+	}
+	if UndirectedFingerprint(forward) != UndirectedFingerprint(reverse) {
+		t.Error("forward and reverse literal have different undirected fingerprints")
+	}
+	if UndirectedFingerprint(composed) != UndirectedFingerprint(reverse) {
+		t.Error("composition and reverse literal have different undirected fingerprints")
+	}
+	if UndirectedFingerprint(forward) == UndirectedFingerprint(other) {
+		t.Error("different paths share an undirected fingerprint")
+	}
+	segments := []Segment{forward, other, reverse, composed}
+	assertFingerprints(t, DedupBy(segments, Segment.Fingerprint), []Segment{forward, other, reverse})
+	assertFingerprints(t, DedupBy(segments, UndirectedFingerprint), []Segment{forward, other})
+}
+
+func TestIterInterfaces(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("17-ffaa:0:1108 2>1 17-ffaa:0:1102 2>1 17-ffaa:0:1107")
+	for _, segment := range []Segment{c, FromSegments(a, b), FromSegments(FromSegments(a, b), c)} {
+		var have []snet.PathInterface
+		segment.IterInterfaces(func(iface snet.PathInterface) bool {
+			have = append(have, iface)
+			return true
+		})
+		want := segment.PathInterfaces()
+		if len(have) != len(want) {
+			t.Fatal(segment, "want", len(want), "interfaces, have", len(have))
+		}
+		for i := range want {
+			if have[i] != want[i] {
+				t.Error(segment, "interface", i, "want", want[i], "have", have[i])
+			}
+		}
+		for n := 1; n <= len(want); n++ {
+			calls := 0
+			segment.IterInterfaces(func(snet.PathInterface) bool {
+				calls++
+				return calls < n
+			})
+			if calls != n {
+				t.Error(segment, "stop after", n, "interfaces, have", calls, "calls")
+			}
+		}
+	}
+}
+
+func TestSamePath(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	literal := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	composition := FromSegments(a, b)
+	nested := FromSegments(FromSegments(a), FromSegments(b))
+	for _, other := range []Segment{composition, nested} {
+		if !SamePath(literal, other) || !SamePath(other, literal) {
+			t.Error(literal, "and", other, "want same path")
+		}
+		if literal.Equal(other) {
+			t.Error(literal, "and", other, "want not equal")
+		}
+	}
+	if SamePath(literal, a) || SamePath(composition, literal.Reverse()) {
+		t.Error("want different paths for a prefix and the reverse")
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	ab := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	ac := FromSegments(a, FromString("19-ffaa:0:1302 3>1 17-ffaa:0:1107"))
+	other := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	tests := []struct {
+		name string
+		a, b Segment
+		want []snet.PathInterface
+	}{
+		{"none", ab, other, []snet.PathInterface{}},
+		{"partial", ab, ac, ab.PathInterfaces()[:2]},
+		{"full", ab, ab, ab.PathInterfaces()},
+		{"prefix", a, ab, a.PathInterfaces()},
+		{"composition", ac, FromSegments(a, FromString("19-ffaa:0:1302 3>2 17-ffaa:0:1107")), ac.PathInterfaces()[:3]},
+	}
+	for _, test := range tests {
+		for _, have := range []Literal{CommonPrefix(test.a, test.b), CommonPrefix(test.b, test.a)} {
+			if want := FromInterfaces(test.want...); !have.Equal(want) || have.Fingerprint() != want.Fingerprint() {
+				t.Errorf("%s: want %v, have %v", test.name, want, have)
+			}
+		}
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	segment := FromSegments(
+		FromString("19-ffaa:0:1303 45>46 19-ffaa:0:1302"),
+		FromString("19-ffaa:0:1302 56>65 17-ffaa:0:1108"),
+	)
+	redacted := Redacted(segment)
+	if want := "19-ffaa:0:1303 *>* 19-ffaa:0:1302 *>* 17-ffaa:0:1108"; redacted != want {
+		t.Errorf("want %q, have %q", want, redacted)
+	}
+	for _, ifid := range []string{"45", "46", "56", "65"} {
+		if strings.Contains(redacted, ifid) {
+			t.Errorf("redacted form %q contains interface id %s", redacted, ifid)
+		}
+	}
+}
+
+func TestASPath(t *testing.T) {
+	literal := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	composition := FromSegments(FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"), FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"))
+	want := []string{"19-ffaa:0:1303", "19-ffaa:0:1302", "17-ffaa:0:1108"}
+	for _, segment := range []Segment{literal, composition} {
+		have := segment.ASPath()
+		if len(have) != len(want) {
+			t.Fatal(segment, "want", want, "have", have)
+		}
+		for i := range want {
+			if have[i].String() != want[i] {
+				t.Error(segment, "want", want, "have", have)
+			}
+		}
+	}
+	if have := FromInterfaces().ASPath(); have == nil || len(have) != 0 {
+		t.Error("empty literal: want empty AS path, have", have)
+	}
+}
+
+func TestDepthAndLeafCount(t *testing.T) {
+	a := FromString("1-ff00:0:1 1>2 1-ff00:0:2")
+	b := FromString("1-ff00:0:2 3>4 1-ff00:0:3")
+	c := FromString("1-ff00:0:3 5>6 1-ff00:0:4")
+	tests := []struct {
+		segment Segment
+		depth   int
+		leaves  int
+	}{
+		{a, 1, 1},
+		{FromSegments(a, b), 2, 2},
+		{FromSegments(FromSegments(a, b), c), 3, 3},
+		{FromSegments(a, FromSegments(b, FromSegments(c))), 4, 3},
+		{Composition{}, 1, 0},
+	}
+	for _, test := range tests {
+		if depth := test.segment.Depth(); depth != test.depth {
+			t.Errorf("%v: want depth %d, have %d", test.segment, test.depth, depth)
+		}
+		if leaves := test.segment.LeafCount(); leaves != test.leaves {
+			t.Errorf("%v: want %d leaves, have %d", test.segment, test.leaves, leaves)
+		}
+	}
+}
+
+func TestConstructorsCopyInputs(t *testing.T) {
+	a := FromString("1-ff00:0:1 1>2 1-ff00:0:2")
+	b := FromString("1-ff00:0:2 3>4 1-ff00:0:3")
+	c := FromString("1-ff00:0:3 5>6 1-ff00:0:4")
+	interfaces := a.PathInterfaces()
+	literal := FromInterfaces(interfaces...)
+	checked, err := FromInterfacesChecked(interfaces...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsegs := []Segment{a, b}
+	composition := FromSegments(subsegs...)
+
+	interfaces[0] = b.PathInterfaces()[0]
+	subsegs[1] = c
+	literal.PathInterfaces()[1] = c.PathInterfaces()[1]
+	composition.PathInterfaces()[1] = c.PathInterfaces()[1]
+	for _, segment := range []Segment{literal, checked} {
+		if !segment.Equal(a) || segment.Fingerprint() != a.Fingerprint() {
+			t.Error("want", a, "have", segment)
+		}
+	}
+	if want := FromSegments(a, b); !composition.Equal(want) || composition.Fingerprint() != want.Fingerprint() {
+		t.Error("want", want, "have", composition)
+	}
+}
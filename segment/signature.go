@@ -0,0 +1,94 @@
+package segment
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+)
+
+// OptionTypeSignature is the type of the segment option that carries an
+// Ed25519 signature over the signed bytes of the segment (see signedBytes).
+const OptionTypeSignature uint8 = 1
+
+// Sign returns a copy of the segment with an Ed25519 signature over its
+// canonical bytes and its options attached as an option. The signature covers
+// the options other than signatures of the segment and its subsegments, e.g.,
+// their expiry times, so that they cannot be removed or altered without
+// invalidating it. An existing signature is replaced.
+// Segments other than literals and compositions are returned unchanged, since
+// they cannot carry options.
+func Sign(segment Segment, key ed25519.PrivateKey) Segment {
+	option := Option{Type: OptionTypeSignature, Value: ed25519.Sign(key, signedBytes(segment))}
+	switch s := segment.(type) {
+	case Literal:
+		s.Options = replaceOption(s.Options, option)
+		return s
+	case Composition:
+		s.Options = replaceOption(s.Options, option)
+		return s
+	default:
+		return segment
+	}
+}
+
+// Signature returns the signature that is attached to the segment, or nil if
+// the segment is not signed.
+func Signature(segment Segment) []byte {
+	for _, option := range optionsOf(segment) {
+		if option.Type == OptionTypeSignature {
+			return option.Value
+		}
+	}
+	return nil
+}
+
+// VerifySignature verifies that the signature attached to the segment was
+// created with the private key that belongs to the given public key, and that
+// neither the segment nor the options that the signature covers were modified
+// since.
+func VerifySignature(segment Segment, key ed25519.PublicKey) error {
+	signature := Signature(segment)
+	if signature == nil {
+		return errors.New("segment is not signed")
+	}
+	if !ed25519.Verify(key, signedBytes(segment), signature) {
+		return errors.New("segment signature is invalid")
+	}
+	return nil
+}
+
+// signedBytes returns the bytes that the signature of a segment covers: the
+// canonical bytes of the segment, followed by the options of the segment and
+// of its subsegments in the order of Walk. For every segment, there is its
+// 2-byte number of options and the options like on the wire, where signature
+// options are left out.
+func signedBytes(segment Segment) []byte {
+	bytes := CanonicalBytes(segment)
+	Walk(segment, func(segment Segment) bool {
+		options := make([]Option, 0, len(optionsOf(segment)))
+		for _, option := range optionsOf(segment) {
+			if option.Type != OptionTypeSignature {
+				options = append(options, option)
+			}
+		}
+		bytes = append(bytes, 0, 0)
+		binary.BigEndian.PutUint16(bytes[len(bytes)-2:], uint16(len(options)))
+		optbytes := make([]byte, encodedOptionsLen(options))
+		encodeOptions(optbytes, options)
+		bytes = append(bytes, optbytes...)
+		return true
+	})
+	return bytes
+}
+
+// replaceOption returns a copy of the options in which the options of the same
+// type as the given option are replaced by it.
+func replaceOption(options []Option, option Option) []Option {
+	replaced := make([]Option, 0, len(options)+1)
+	for _, o := range options {
+		if o.Type != option.Type {
+			replaced = append(replaced, o)
+		}
+	}
+	return append(replaced, option)
+}
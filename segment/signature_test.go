@@ -0,0 +1,81 @@
+package segment
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	c := FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108")
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf)
+	encoder.SigningKey = priv
+	if _, err := encoder.Encode([]Segment{FromSegments(a, b), c}, []Segment{}, a.SrcIA(), b.DstIA()); err != nil {
+		t.Fatal(err)
+	}
+	newsegs, accsegs, _, _, err := ReadSegments(&buf, []Segment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, accseg := range accsegs {
+		if err := VerifySignature(accseg, pub); err != nil {
+			t.Error(accseg, err)
+		}
+	}
+	if Signature(newsegs[0]) != nil {
+		t.Error("unaccepted subsegment", newsegs[0], "is signed")
+	}
+
+	tampered := accsegs[1].(Literal)
+	tampered.Interfaces = append(tampered.Interfaces[:0:0], tampered.Interfaces...)
+	tampered.Interfaces[0].ID++
+	if err := VerifySignature(tampered, pub); err == nil {
+		t.Error("tampered segment: want error, have nil")
+	}
+	otherpub, _, _ := ed25519.GenerateKey(nil)
+	if err := VerifySignature(accsegs[1], otherpub); err == nil {
+		t.Error("wrong public key: want error, have nil")
+	}
+	if err := VerifySignature(c, pub); err == nil {
+		t.Error("unsigned segment: want error, have nil")
+	}
+}
+
+func TestSignatureCoversOptions(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a := WithOptions(FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"), ExpiryOption(now.Add(time.Hour)))
+	b := FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	signed := Sign(FromSegments(a, b), priv)
+	if err := VerifySignature(signed, pub); err != nil {
+		t.Fatal(err)
+	}
+	extended := signed.(Composition)
+	extended.Segments = []Segment{WithOptions(FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"), ExpiryOption(now.Add(24*time.Hour))), b}
+	if err := VerifySignature(extended, pub); err == nil {
+		t.Error("extended expiry: want error, have nil")
+	}
+	removed := signed.(Composition)
+	removed.Segments = []Segment{FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"), b}
+	if err := VerifySignature(removed, pub); err == nil {
+		t.Error("removed expiry: want error, have nil")
+	}
+	added := WithOptions(signed, ExpiryOption(now))
+	if err := VerifySignature(added, pub); err == nil {
+		t.Error("added expiry: want error, have nil")
+	}
+	if err := VerifySignature(Sign(added, priv), pub); err != nil {
+		t.Error("re-signed segment:", err)
+	}
+}
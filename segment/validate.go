@@ -0,0 +1,165 @@
+package segment
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/scionproto/scion/go/lib/addr"
+	"github.com/scionproto/scion/go/lib/snet"
+)
+
+// Validate checks that a segment is well-formed. In particular, it verifies
+// that a segment composition does not (directly or indirectly) contain itself,
+// which would make any recursive traversal of the segment loop forever, and
+// that every subsegment of a composition is a segment rather than nil.
+func Validate(segment Segment) error {
+	return validateAcyclic(segment, "root", make(map[*Segment]string))
+}
+
+// validateAcyclic walks the composition DAG depth-first. Compositions are
+// identified by the backing array of their subsegment slice, because
+// Composition values that share this array are indistinguishable.
+func validateAcyclic(segment Segment, name string, onstack map[*Segment]string) error {
+	c, ok := segment.(Composition)
+	if !ok || len(c.Segments) == 0 {
+		return nil
+	}
+	key := &c.Segments[0]
+	if ancestor, ok := onstack[key]; ok {
+		return fmt.Errorf("segment contains a cycle: %s refers back to %s", name, ancestor)
+	}
+	onstack[key] = name
+	for i, subseg := range c.Segments {
+		if subseg == nil {
+			return fmt.Errorf("%w: %s.%d is nil", ErrDanglingReference, name, i)
+		}
+		if err := validateAcyclic(subseg, name+"."+strconv.Itoa(i), onstack); err != nil {
+			return err
+		}
+	}
+	delete(onstack, key)
+	return nil
+}
+
+// ValidateAdjacency checks that the interfaces of the literal describe a
+// walkable path: the first interface is the egress interface of the source
+// AS, the last interface is the ingress interface of the destination AS, and
+// every pair of interfaces in between consists of the ingress and egress
+// interface of the same transit AS. Moreover, no interface may occur more than
+// once, since the path would otherwise revisit it in a loop. The returned
+// error identifies the first broken hop or the first repeated interface.
+func (l Literal) ValidateAdjacency() error {
+	if len(l.Interfaces)%2 != 0 {
+		return fmt.Errorf("literal has an odd number of interfaces (%d)", len(l.Interfaces))
+	}
+	positions := make(map[snet.PathInterface]int, len(l.Interfaces))
+	for i, iface := range l.Interfaces {
+		iface = NormalizeInterface(iface)
+		if j, ok := positions[iface]; ok {
+			return fmt.Errorf("interface %s#%d occurs at positions %d and %d", iface.IA, iface.ID, j, i)
+		}
+		positions[iface] = i
+	}
+	for i := 1; i+1 < len(l.Interfaces); i += 2 {
+		ingress, egress := l.Interfaces[i], l.Interfaces[i+1]
+		if ingress.IA != egress.IA {
+			return fmt.Errorf("hop %d: ingress interface %s#%d and egress interface %s#%d are in different ASes",
+				(i+1)/2, ingress.IA, ingress.ID, egress.IA, egress.ID)
+		}
+	}
+	return nil
+}
+
+// VerifyEndpoints checks that every segment starts at the source ISD-AS and
+// ends at the destination ISD-AS, e.g., to verify that the accepted segments
+// of a decoded message connect the advertised endpoints. The source and
+// destination may be wildcards, which are matched as in MatchIA. Note that the
+// segments exchanged during a negotiation need not be end-to-end segments, so
+// this check is not performed by DecodeSegments itself.
+func VerifyEndpoints(segments []Segment, srcIA, dstIA addr.IA) error {
+	for i, segment := range segments {
+		// The endpoints are taken from the path interfaces rather than from
+		// SrcIA and DstIA, which fail on compositions with empty subsegments.
+		interfaces := segment.PathInterfaces()
+		if len(interfaces) == 0 {
+			return fmt.Errorf("segment %d has no interfaces", i)
+		}
+		first, last := interfaces[0].IA, interfaces[len(interfaces)-1].IA
+		if !MatchIA(srcIA, first) {
+			return fmt.Errorf("segment %d starts at %s instead of %s", i, first, srcIA)
+		}
+		if !MatchIA(dstIA, last) {
+			return fmt.Errorf("segment %d ends at %s instead of %s", i, last, dstIA)
+		}
+	}
+	return nil
+}
+
+// MatchIA reports whether the ISD-AS matches the pattern. A pattern with ISD 0
+// matches any ISD, and a pattern with AS 0 matches any AS, e.g., 2-0 matches
+// every AS in ISD 2. An offer towards "any AS in ISD 2" can thus use 2-0 as
+// its destination.
+func MatchIA(pattern, ia addr.IA) bool {
+	return (pattern.I == 0 || pattern.I == ia.I) && (pattern.A == 0 || pattern.A == ia.A)
+}
+
+// VerifyOptions selects the validations that Verify runs. The limits are only
+// checked if they are not zero.
+type VerifyOptions struct {
+	// Structure checks every new segment with Validate, i.e., that no
+	// composition contains itself or a nil subsegment. It is implied by
+	// Adjacency, MaxDepth, and MaxInterfaces, which could not traverse such
+	// segments otherwise.
+	Structure bool
+	// Adjacency checks that the flattened path interfaces of every new segment
+	// describe a walkable path, as in Literal.ValidateAdjacency.
+	Adjacency bool
+	// Endpoints checks that every accepted segment connects the source and
+	// destination ISD-AS, as in VerifyEndpoints.
+	Endpoints bool
+	// MaxSegments is the maximum number of new segments.
+	MaxSegments int
+	// MaxDepth is the maximum nesting depth of a new segment.
+	MaxDepth int
+	// MaxInterfaces is the maximum number of path interfaces of a new segment.
+	MaxInterfaces int
+}
+
+// Verify runs the validations that are selected by the options on the new and
+// accepted segments of a decoded message, e.g., to enforce a policy after
+// decoding, and it returns the first failure. Nil new segments, such as
+// segments skipped by the Decoder, are ignored. Forward references do not have
+// to be checked, since messages that contain them fail to decode.
+func Verify(newsegs, accsegs []Segment, srcIA, dstIA addr.IA, opts VerifyOptions) error {
+	if opts.MaxSegments != 0 && len(newsegs) > opts.MaxSegments {
+		return fmt.Errorf("%w: %d segments exceed limit of %d", ErrTooManySegments, len(newsegs), opts.MaxSegments)
+	}
+	structure := opts.Structure || opts.Adjacency || opts.MaxDepth != 0 || opts.MaxInterfaces != 0
+	for i, segment := range newsegs {
+		if segment == nil {
+			continue
+		}
+		if structure {
+			if err := Validate(segment); err != nil {
+				return fmt.Errorf("segment %d: %w", i, err)
+			}
+		}
+		if opts.MaxDepth != 0 && segment.Depth() > opts.MaxDepth {
+			return fmt.Errorf("segment %d: depth %d exceeds limit of %d", i, segment.Depth(), opts.MaxDepth)
+		}
+		if opts.MaxInterfaces != 0 && len(segment.PathInterfaces()) > opts.MaxInterfaces {
+			return fmt.Errorf("segment %d: %d interfaces exceed limit of %d", i, len(segment.PathInterfaces()), opts.MaxInterfaces)
+		}
+		if opts.Adjacency {
+			if err := (Literal{Interfaces: segment.PathInterfaces()}).ValidateAdjacency(); err != nil {
+				return fmt.Errorf("segment %d: %w", i, err)
+			}
+		}
+	}
+	if opts.Endpoints {
+		if err := VerifyEndpoints(accsegs, srcIA, dstIA); err != nil {
+			return fmt.Errorf("accepted %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package segment
+
+import "github.com/scionproto/scion/go/lib/snet"
+
+// Walk traverses a segment in pre-order, i.e., it visits a segment composition
+// before its subsegments, which are visited in order. The traversal stops as
+// soon as visit returns false. Walk reports whether the traversal completed.
+func Walk(segment Segment, visit func(Segment) bool) bool {
+	if !visit(segment) {
+		return false
+	}
+	if composition, ok := segment.(Composition); ok {
+		for _, subseg := range composition.Segments {
+			if !Walk(subseg, visit) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// iterInterfaces calls yield for every path interface of the segment until
+// yield returns false. It reports whether all interfaces were yielded.
+func iterInterfaces(segment Segment, yield func(snet.PathInterface) bool) bool {
+	switch s := segment.(type) {
+	case Literal:
+		for _, iface := range s.Interfaces {
+			if !yield(iface) {
+				return false
+			}
+		}
+	case Composition:
+		if s.interfaces != nil {
+			for _, iface := range s.interfaces {
+				if !yield(iface) {
+					return false
+				}
+			}
+			return true
+		}
+		for _, subseg := range s.Segments {
+			if !iterInterfaces(subseg, yield) {
+				return false
+			}
+		}
+	default:
+		for _, iface := range segment.PathInterfaces() {
+			if !yield(iface) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,368 @@
+package conpass
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// HandlerFunc decides which of the offered segments a Server accepts. It may
+// return any segments, including new compositions of the offered segments.
+type HandlerFunc func(offered segment.SegmentSet) segment.SegmentSet
+
+// Server responds to the offers of CONPASS clients.
+type Server struct {
+	// Filter is the segment filter according to which the Server gives consent
+	// to offered segments. If Filter is nil, all offered segments are accepted,
+	// as with filter.AcceptAll.
+	Filter segment.Filter
+	// Handler, if not nil, is called with the segments that passed Filter and
+	// returns the segments that the Server accepts. It allows for acceptance
+	// logic beyond a static filter.
+	Handler HandlerFunc
+	// ReplayGuard, if not nil, is checked with the nonce of every offer, and
+	// offers that it rejects are answered with the ReplayDetected reject
+	// reason. Clients have to enable Client.ReplayProtection.
+	ReplayGuard *ReplayGuard
+	// RateLimiter, if not nil, limits the rate of offers per source ISD-AS.
+	// Offers beyond the limit are answered with the RateLimited reject
+	// reason. The limit is applied after the offer is decoded. See
+	// RateLimiter for why the limit is advisory.
+	RateLimiter *RateLimiter
+	// Logger, if not nil, receives the events of the Server.
+	Logger Logger
+	// Timeout is the time that Serve allows for the negotiation over each
+	// connection, and ServePacket for each datagram (default:
+	// DefaultTimeout).
+	Timeout time.Duration
+	// MaxConns is the maximum number of connections that Serve handles
+	// concurrently, or of datagrams that ServePacket handles concurrently
+	// (default: DefaultMaxConns).
+	MaxConns int
+}
+
+const (
+	// DefaultTimeout is the default value for Server.Timeout.
+	DefaultTimeout = 10 * time.Second
+	// DefaultMaxConns is the default value for Server.MaxConns.
+	DefaultMaxConns = 64
+)
+
+// Serve accepts connections on the listener and serves each of them with
+// ServeConn in its own goroutine, until the context is done. The deadline of
+// every connection is derived from the Timeout of the Server, and at most
+// MaxConns connections are handled at once, further connections wait to be
+// accepted.
+//
+// Temporary errors of accepting a connection are reported to the Logger and
+// accepting is retried after a delay that grows with consecutive errors, like
+// net/http does.
+//
+// Once the context is done, Serve closes the listener, waits for the handlers
+// of the accepted connections to finish, and returns the error of the
+// context. If accepting a connection fails otherwise, Serve closes the
+// listener and returns the error after waiting for the handlers as well.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	logger := loggerOrNop(s.Logger)
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close() // unblock Accept
+		case <-stop:
+		}
+	}()
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	defer close(stop)
+	semaphore := make(chan struct{}, s.maxConns())
+	var delay time.Duration
+	for {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			if ctxerr := ctx.Err(); ctxerr != nil {
+				return ctxerr
+			}
+			if neterr, ok := err.(net.Error); ok && neterr.Temporary() {
+				<-semaphore
+				delay = retryDelay(delay)
+				logger.Warn("failed to accept connection", "error", err, "retry", delay)
+				if err := sleep(ctx, delay); err != nil {
+					return err
+				}
+				continue
+			}
+			l.Close()
+			return fmt.Errorf("failed to accept connection: %s", err.Error())
+		}
+		delay = 0
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			defer func() { <-semaphore }()
+			defer conn.Close()
+			// In-flight negotiations are not cancelled with the context of
+			// Serve, they are drained within their timeout.
+			connctx, cancel := context.WithTimeout(context.Background(), s.timeout())
+			defer cancel()
+			if _, err := s.ServeConn(connctx, conn); err != nil {
+				logger.Debug("connection failed", "remote", conn.RemoteAddr(), "error", err)
+			}
+		}()
+	}
+}
+
+// ServePacket serves the offers that arrive as datagrams on the connection,
+// e.g., on a SCION connection of ListenSCION, until the context is done. Every
+// datagram must contain one offer, which is answered like with ServeConn by a
+// datagram to its sender. Each offer is served in its own goroutine within
+// the Timeout of the Server, and at most MaxConns offers are served at once,
+// further datagrams wait to be received. The errors of individual offers are
+// only reported to the Logger.
+//
+// Receiving a datagram may fail for reasons that concern only that datagram,
+// e.g., snet reports SCMP errors this way, so such errors are reported to the
+// Logger and receiving is retried after a delay that grows with consecutive
+// errors. ServePacket returns the error of the context, or the error if the
+// connection is closed, once the handlers of the received offers are done.
+// Unlike with Serve, the handlers are cancelled with the context, since their
+// responses could not be sent over the connection anymore.
+func (s *Server) ServePacket(ctx context.Context, conn net.PacketConn) error {
+	defer watchContext(ctx, conn)()
+	logger := loggerOrNop(s.Logger)
+	var handlers sync.WaitGroup
+	defer handlers.Wait()
+	semaphore := make(chan struct{}, s.maxConns())
+	buffer := make([]byte, maxDatagramSize)
+	var delay time.Duration
+	for {
+		select {
+		case semaphore <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		n, remote, err := conn.ReadFrom(buffer)
+		if err != nil {
+			<-semaphore
+			if ctxerr := contextError(ctx, nil); ctxerr != nil {
+				return ctxerr
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("failed to receive offer: %s", err.Error())
+			}
+			delay = retryDelay(delay)
+			logger.Warn("failed to receive offer", "error", err, "retry", delay)
+			if err := sleep(ctx, delay); err != nil {
+				return err
+			}
+			continue
+		}
+		delay = 0
+		// The buffer is reused for the next datagram.
+		offer := append([]byte(nil), buffer[:n]...)
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			defer func() { <-semaphore }()
+			datagram := &datagramConn{PacketConn: conn, offer: bytes.NewReader(offer), remote: remote}
+			offerctx, cancel := context.WithTimeout(ctx, s.timeout())
+			defer cancel()
+			if _, err := s.ServeConn(offerctx, datagram); err != nil {
+				logger.Debug("datagram failed", "remote", remote, "error", err)
+			}
+			if err := datagram.flush(); err != nil {
+				logger.Warn("failed to send response", "remote", remote, "error", err)
+			}
+		}()
+	}
+}
+
+// retryDelay returns the delay before retrying an operation that failed after
+// the given delay, starting at 5ms and doubling up to 1s like the accept loop
+// of net/http.
+func retryDelay(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		return time.Second
+	}
+	return delay
+}
+
+// sleep waits for the given duration, or returns the error of the context if
+// it is done first.
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// datagramConn is the net.Conn over which ServePacket serves one offer. It
+// reads the offer from a received datagram and collects the response, which
+// the Encoder writes piecewise, until it is flushed as one datagram to the
+// sender of the offer. Its deadlines are those of the underlying connection,
+// which ServePacket manages, so they cannot be set.
+type datagramConn struct {
+	net.PacketConn
+	offer    *bytes.Reader
+	response bytes.Buffer
+	remote   net.Addr
+}
+
+func (c *datagramConn) Read(buffer []byte) (int, error) {
+	return c.offer.Read(buffer)
+}
+
+func (c *datagramConn) Write(buffer []byte) (int, error) {
+	return c.response.Write(buffer)
+}
+
+// flush sends the collected response, if any, as one datagram.
+func (c *datagramConn) flush() error {
+	if c.response.Len() == 0 {
+		return nil
+	}
+	_, err := c.WriteTo(c.response.Bytes(), c.remote)
+	return err
+}
+
+func (c *datagramConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *datagramConn) Close() error {
+	return nil
+}
+
+func (c *datagramConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *datagramConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *datagramConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// ServeConn reads one offer from the connection, decides on the segments to
+// accept, and writes the response. It returns the accepted segments. The
+// response echoes the request id of the offer, if any.
+//
+// If the client advertises a maximum response size, the accepted segments are
+// trimmed from the end until the response fits. If none of them fits, the
+// response accepts no segments and carries the ResponseTooLarge reject reason.
+//
+// If the offer is rejected by the RateLimiter or the ReplayGuard, ServeConn
+// returns an error that wraps ErrRateLimited or ErrReplay after responding.
+//
+// The deadline and cancellation of the context are applied to the connection.
+func (s *Server) ServeConn(ctx context.Context, conn net.Conn) (segment.SegmentSet, error) {
+	defer watchContext(ctx, conn)()
+	logger := loggerOrNop(s.Logger)
+	decoder := segment.NewDecoder(conn)
+	segsin, accsegs, srcIA, dstIA, err := decoder.Decode([]segment.Segment{})
+	if err != nil {
+		err = contextError(ctx, fmt.Errorf("failed to decode offer: %s", err.Error()))
+		logger.Warn("failed to decode offer", "src", srcIA, "dst", dstIA, "error", err)
+		return segment.SegmentSet{}, err
+	}
+	logger.Debug("offer received", "src", srcIA, "dst", dstIA, "segments", len(segsin), "offered", len(accsegs))
+	if s.RateLimiter != nil && !s.RateLimiter.Allow(srcIA) {
+		return s.reject(ctx, conn, decoder, segsin, srcIA, dstIA, segment.RateLimited, ErrRateLimited)
+	}
+	if s.ReplayGuard != nil {
+		if err := s.ReplayGuard.Check(decoder.Nonce()); err != nil {
+			return s.reject(ctx, conn, decoder, segsin, srcIA, dstIA, segment.ReplayDetected, err)
+		}
+	}
+	segsetout := s.accept(segment.SegmentSet{
+		Segments: accsegs,
+		SrcIA:    srcIA,
+		DstIA:    dstIA,
+	})
+	// The decoded segments are passed as oldsegs such that the response may
+	// refer to them by their ids.
+	encoder := segment.NewEncoder(conn)
+	encoder.RequestID = decoder.RequestID()
+	if maxBytes := decoder.MaxResponseBytes(); maxBytes != 0 {
+		fitted, err := encoder.Fit(segsetout.Segments, segsin, srcIA, dstIA, maxBytes)
+		if err != nil {
+			err = fmt.Errorf("failed to fit response: %s", err.Error())
+			logger.Warn("failed to fit response", "src", srcIA, "dst", dstIA, "error", err)
+			return segment.SegmentSet{}, err
+		}
+		if len(fitted) == 0 && len(segsetout.Segments) != 0 {
+			logger.Info("offer rejected", "src", srcIA, "dst", dstIA, "reason", segment.ResponseTooLarge)
+			encoder.RejectReason = segment.ResponseTooLarge
+		}
+		segsetout.Segments = fitted
+	}
+	_, err = encoder.Encode(segsetout.Segments, segsin, srcIA, dstIA)
+	if err != nil {
+		err = contextError(ctx, fmt.Errorf("failed to send response: %s", err.Error()))
+		logger.Warn("failed to send response", "src", srcIA, "dst", dstIA, "error", err)
+		return segment.SegmentSet{}, err
+	}
+	logger.Info("segments accepted", "src", srcIA, "dst", dstIA, "offered", len(accsegs), "accepted", len(segsetout.Segments))
+	return segsetout, nil
+}
+
+// reject responds to an offer without accepting any segments, and it returns
+// the given error, which explains the reject reason.
+func (s *Server) reject(ctx context.Context, conn net.Conn, decoder *segment.Decoder, segsin []segment.Segment, srcIA, dstIA addr.IA, reason segment.RejectReason, err error) (segment.SegmentSet, error) {
+	logger := loggerOrNop(s.Logger)
+	logger.Warn("offer rejected", "src", srcIA, "dst", dstIA, "reason", reason, "error", err)
+	encoder := segment.NewEncoder(conn)
+	encoder.RequestID = decoder.RequestID()
+	encoder.RejectReason = reason
+	if _, err := encoder.Encode([]segment.Segment{}, segsin, srcIA, dstIA); err != nil {
+		err = contextError(ctx, fmt.Errorf("failed to send response: %s", err.Error()))
+		logger.Warn("failed to send response", "src", srcIA, "dst", dstIA, "error", err)
+		return segment.SegmentSet{}, err
+	}
+	return segment.SegmentSet{}, err
+}
+
+func (s *Server) accept(segset segment.SegmentSet) segment.SegmentSet {
+	if s.Filter != nil {
+		segset = s.Filter.Filter(segset)
+	}
+	if s.Handler != nil {
+		segset = s.Handler(segset)
+	}
+	return segset
+}
+
+func (s *Server) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return DefaultTimeout
+	}
+	return s.Timeout
+}
+
+func (s *Server) maxConns() int {
+	if s.MaxConns == 0 {
+		return DefaultMaxConns
+	}
+	return s.MaxConns
+}
@@ -0,0 +1,694 @@
+package conpass
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mblarer/conpass/filter"
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+func TestClientServer(t *testing.T) {
+	segments := []segment.Segment{
+		segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		segment.FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+		segment.FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108"),
+	}
+	srcIA, dstIA := segments[0].SrcIA(), segments[2].DstIA()
+	shortest := func(offered segment.SegmentSet) segment.SegmentSet {
+		accepted := offered
+		accepted.Segments = nil
+		for _, segment := range offered.Segments {
+			if len(segment.PathInterfaces()) == 2 {
+				accepted.Segments = append(accepted.Segments, segment)
+			}
+		}
+		return accepted
+	}
+	tests := []struct {
+		name   string
+		server Server
+		want   []segment.Segment
+	}{
+		{"no filter", Server{}, segments},
+		{"filter", Server{Filter: filter.SrcDstPathEnumerator()}, []segment.Segment{
+			segment.FromSegments(segments[0], segments[1]),
+			segments[2],
+		}},
+		{"handler", Server{Filter: filter.SrcDstPathEnumerator(), Handler: shortest}, segments[2:]},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		cconn, sconn := net.Pipe()
+		channel := make(chan segment.SegmentSet, 1)
+		go func(server Server) {
+			segset, err := server.ServeConn(ctx, sconn)
+			if err != nil {
+				t.Error(test.name, err)
+			}
+			channel <- segset
+		}(test.server)
+		accepted, err := NewClient(cconn).Negotiate(ctx, segments, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		segset := <-channel
+		assertEqual(accepted, test.want, t)
+		assertEqual(segset.Segments, test.want, t)
+		cancel()
+		cconn.Close()
+		sconn.Close()
+	}
+}
+
+func TestServerMaxResponseBytes(t *testing.T) {
+	segments := []segment.Segment{
+		segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		segment.FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+		segment.FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108"),
+	}
+	srcIA, dstIA := segments[0].SrcIA(), segments[2].DstIA()
+	// The response refers to the offered segments by their ids.
+	reply, _, err := segment.EncodeSegments(segments[:2], segments, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	channel := make(chan segment.SegmentSet, 1)
+	go func() {
+		segset, err := new(Server).ServeConn(ctx, sconn)
+		if err != nil {
+			t.Error(err)
+		}
+		channel <- segset
+	}()
+	client := NewClient(cconn)
+	client.MaxResponseBytes = len(reply) + 1
+	accepted, err := client.Negotiate(ctx, segments, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(accepted, segments[:2], t)
+	assertEqual((<-channel).Segments, segments[:2], t)
+
+	// If not even one segment fits, the server rejects the offer.
+	cconn, sconn = net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	go func() {
+		segset, err := new(Server).ServeConn(ctx, sconn)
+		if err != nil {
+			t.Error(err)
+		}
+		channel <- segset
+	}()
+	encoder := segment.NewEncoder(cconn)
+	encoder.MaxResponseBytes = segment.HeaderLen
+	sentsegs, err := encoder.Encode(segments, []segment.Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder := segment.NewDecoder(cconn)
+	_, accepted, _, _, err = decoder.Decode(sentsegs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accepted) != 0 || decoder.RejectReason() != segment.ResponseTooLarge {
+		t.Error("want no accepted segments and", segment.ResponseTooLarge, "have", accepted, decoder.RejectReason())
+	}
+	if segset := <-channel; len(segset.Segments) != 0 {
+		t.Error("want no accepted segments at the server, have", segset.Segments)
+	}
+}
+
+func TestServerReplayGuard(t *testing.T) {
+	segments := []segment.Segment{segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	srcIA, dstIA := segments[0].SrcIA(), segments[0].DstIA()
+	offer := func() []byte {
+		var buffer bytes.Buffer
+		encoder := segment.NewEncoder(&buffer)
+		encoder.ReplayProtection = true
+		if _, err := encoder.Encode(segments, []segment.Segment{}, srcIA, dstIA); err != nil {
+			t.Fatal(err)
+		}
+		return buffer.Bytes()
+	}
+	server := Server{ReplayGuard: NewReplayGuard(time.Minute)}
+	serve := func(msg []byte) (segment.RejectReason, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cconn, sconn := net.Pipe()
+		defer cconn.Close()
+		defer sconn.Close()
+		errs := make(chan error, 1)
+		go func() {
+			_, err := server.ServeConn(ctx, sconn)
+			errs <- err
+		}()
+		if _, err := cconn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		decoder := segment.NewDecoder(cconn)
+		if _, _, _, _, err := decoder.Decode(segments); err != nil {
+			t.Fatal(err)
+		}
+		return decoder.RejectReason(), <-errs
+	}
+
+	msg := offer()
+	if reason, err := serve(msg); err != nil || reason != segment.NotRejected {
+		t.Error("fresh offer: want no rejection, have", reason, err)
+	}
+	if reason, err := serve(msg); !errors.Is(err, ErrReplay) || reason != segment.ReplayDetected {
+		t.Error("replayed offer: want", segment.ReplayDetected, "have", reason, err)
+	}
+	if reason, err := serve(offer()); err != nil || reason != segment.NotRejected {
+		t.Error("second fresh offer: want no rejection, have", reason, err)
+	}
+	stale := offer()
+	server.ReplayGuard.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if reason, err := serve(stale); !errors.Is(err, ErrReplay) || reason != segment.ReplayDetected {
+		t.Error("stale offer: want", segment.ReplayDetected, "have", reason, err)
+	}
+	plain, _, err := segment.EncodeSegments(segments, []segment.Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := serve(plain); !errors.Is(err, ErrReplay) || reason != segment.ReplayDetected {
+		t.Error("offer without nonce: want", segment.ReplayDetected, "have", reason, err)
+	}
+}
+
+func TestReplayGuardForgetsExpiredNonces(t *testing.T) {
+	guard := NewReplayGuard(time.Minute)
+	now := time.Now()
+	guard.now = func() time.Time { return now }
+	for i := 0; i < 100; i++ {
+		nonce := segment.Nonce{Time: now.Add(time.Duration(i-50) * time.Second / 2)}
+		nonce.Value[0] = byte(i)
+		if err := guard.Check(nonce, true); err != nil {
+			t.Fatal("fresh nonce", i, "was rejected:", err)
+		}
+	}
+	now = now.Add(time.Minute)
+	if err := guard.Check(segment.Nonce{Time: now, Value: [8]byte{0xff}}, true); err != nil {
+		t.Fatal("fresh nonce was rejected:", err)
+	}
+	// Only the nonces from the old time onwards are still within the window,
+	// as is the fresh one.
+	if want := 51; len(guard.seen) != want || len(guard.expiry) != want {
+		t.Error("nonces after a window: want", want, "have", len(guard.seen), len(guard.expiry))
+	}
+}
+
+// logEvent is an event that a captureLogger received.
+type logEvent struct {
+	level, msg string
+	keyvals    []interface{}
+}
+
+// captureLogger is a Logger that records all events.
+type captureLogger struct {
+	mutex  sync.Mutex
+	events []logEvent
+}
+
+func (l *captureLogger) Debug(msg string, keyvals ...interface{}) { l.log("debug", msg, keyvals) }
+func (l *captureLogger) Info(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals) }
+func (l *captureLogger) Warn(msg string, keyvals ...interface{})  { l.log("warn", msg, keyvals) }
+
+func (l *captureLogger) log(level, msg string, keyvals []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, logEvent{level, msg, keyvals})
+}
+
+// find returns the first event with the given level and message.
+func (l *captureLogger) find(level, msg string) (logEvent, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, event := range l.events {
+		if event.level == level && event.msg == msg {
+			return event, true
+		}
+	}
+	return logEvent{}, false
+}
+
+func TestServerLogger(t *testing.T) {
+	segments := []segment.Segment{segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	srcIA, dstIA := segments[0].SrcIA(), segments[0].DstIA()
+	msg, _, err := segment.EncodeSegments(segments, []segment.Segment{}, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	logger := new(captureLogger)
+	server := Server{Logger: logger}
+
+	// A corrupted offer is logged as a decode error with the IAs as fields.
+	corrupted := append([]byte(nil), msg...)
+	corrupted[len(corrupted)-1] ^= 0x10
+	cconn, sconn := net.Pipe()
+	go cconn.Write(corrupted)
+	if _, err := server.ServeConn(ctx, sconn); err == nil {
+		t.Fatal("corrupted offer: want error, have nil")
+	}
+	cconn.Close()
+	sconn.Close()
+	event, ok := logger.find("warn", "failed to decode offer")
+	if !ok {
+		t.Fatal("want decode error to be logged, have", logger.events)
+	}
+	want := []interface{}{"src", srcIA, "dst", dstIA, "error"}
+	if len(event.keyvals) != len(want)+1 {
+		t.Fatal("want fields", want, "and the error, have", event.keyvals)
+	}
+	for i := range want {
+		if event.keyvals[i] != want[i] {
+			t.Error("field", i, "want", want[i], "have", event.keyvals[i])
+		}
+	}
+
+	// A successful negotiation is logged by both sides.
+	cconn, sconn = net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	go server.ServeConn(ctx, sconn)
+	client := NewClient(cconn)
+	client.Logger = logger
+	if _, err := client.Negotiate(ctx, segments, srcIA, dstIA); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []string{"offer received", "sending offer"} {
+		if _, ok := logger.find("debug", msg); !ok {
+			t.Error("want", msg, "to be logged, have", logger.events)
+		}
+	}
+	if _, ok := logger.find("info", "segments accepted"); !ok {
+		t.Error("want accepted segments to be logged, have", logger.events)
+	}
+}
+
+func TestServerRateLimiter(t *testing.T) {
+	a := segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")
+	b := segment.FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108")
+	server := Server{RateLimiter: NewRateLimiter(1, 3)}
+	now := time.Now()
+	server.RateLimiter.now = func() time.Time { return now }
+	negotiate := func(offered segment.Segment) (segment.RejectReason, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		cconn, sconn := net.Pipe()
+		defer cconn.Close()
+		defer sconn.Close()
+		errs := make(chan error, 1)
+		go func() {
+			_, err := server.ServeConn(ctx, sconn)
+			errs <- err
+		}()
+		srcIA, dstIA := offered.SrcIA(), offered.DstIA()
+		sentsegs, err := segment.NewEncoder(cconn).Encode([]segment.Segment{offered}, []segment.Segment{}, srcIA, dstIA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoder := segment.NewDecoder(cconn)
+		if _, _, _, _, err := decoder.Decode(sentsegs); err != nil {
+			t.Fatal(err)
+		}
+		return decoder.RejectReason(), <-errs
+	}
+
+	for i := 0; i < 3; i++ {
+		if reason, err := negotiate(a); err != nil || reason != segment.NotRejected {
+			t.Error("request", i, "within burst: want no rejection, have", reason, err)
+		}
+	}
+	if reason, err := negotiate(a); !errors.Is(err, ErrRateLimited) || reason != segment.RateLimited {
+		t.Error("request beyond burst: want", segment.RateLimited, "have", reason, err)
+	}
+	if reason, err := negotiate(b); err != nil || reason != segment.NotRejected {
+		t.Error("request from another IA: want no rejection, have", reason, err)
+	}
+	now = now.Add(time.Second)
+	if reason, err := negotiate(a); err != nil || reason != segment.NotRejected {
+		t.Error("request after refill: want no rejection, have", reason, err)
+	}
+	if reason, err := negotiate(a); !errors.Is(err, ErrRateLimited) {
+		t.Error("second request after refill of one token: want", segment.RateLimited, "have", reason, err)
+	}
+}
+
+func TestRateLimiterBoundsBuckets(t *testing.T) {
+	limiter := NewRateLimiter(1, 2)
+	limiter.MaxSources = 8
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	for i := 0; i < 100; i++ {
+		if !limiter.Allow(addr.IA{I: 1, A: addr.AS(i + 1)}) {
+			t.Error("request from new IA", i, "was rate limited")
+		}
+	}
+	if len(limiter.buckets) != limiter.MaxSources || limiter.lru.Len() != limiter.MaxSources {
+		t.Error("buckets after many IAs: want", limiter.MaxSources, "have", len(limiter.buckets), limiter.lru.Len())
+	}
+
+	now = now.Add(2 * time.Second)
+	limiter.Allow(addr.IA{I: 1, A: 1})
+	if len(limiter.buckets) != 1 {
+		t.Error("buckets after refill: want 1, have", len(limiter.buckets))
+	}
+
+	limiter.Allow(addr.IA{I: 1, A: 1})
+	if limiter.Allow(addr.IA{I: 1, A: 1}) {
+		t.Error("request beyond burst was allowed")
+	}
+	now = now.Add(time.Second)
+	if !limiter.Allow(addr.IA{I: 1, A: 1}) {
+		t.Error("request after refill of one token was rate limited")
+	}
+}
+
+func TestServerServe(t *testing.T) {
+	segments := []segment.Segment{
+		segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		segment.FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+	}
+	srcIA, dstIA := segments[0].SrcIA(), segments[1].DstIA()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &Server{Timeout: 5 * time.Second, MaxConns: 2}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx, listener) }()
+
+	var clients sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			clientctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			accepted, err := NewClient(conn).Negotiate(clientctx, segments, srcIA, dstIA)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(accepted) != len(segments) {
+				t.Errorf("want %d accepted segments, have %d", len(segments), len(accepted))
+			}
+		}()
+	}
+	clients.Wait()
+
+	cancel()
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Error("want context.Canceled, have", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the context was cancelled")
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("want the listener to be closed, have nil")
+	}
+}
+
+func TestServerServeMaxConns(t *testing.T) {
+	segments := []segment.Segment{segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	srcIA, dstIA := segments[0].SrcIA(), segments[0].DstIA()
+	listener, err := newNotifyListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := &Server{Timeout: 5 * time.Second, MaxConns: 2}
+	go server.Serve(ctx, listener)
+
+	// Two idle connections occupy the handlers.
+	var held []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		held = append(held, conn)
+		<-listener.accepted
+	}
+	negotiated := make(chan error, 1)
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			negotiated <- err
+			return
+		}
+		defer conn.Close()
+		clientctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = NewClient(conn).Negotiate(clientctx, segments, srcIA, dstIA)
+		negotiated <- err
+	}()
+	select {
+	case <-listener.accepted:
+		t.Fatal("third connection was accepted while two were handled")
+	case err := <-negotiated:
+		t.Fatal("third connection was served while two were handled:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	held[0].Close()
+	select {
+	case err := <-negotiated:
+		if err != nil {
+			t.Error("third connection after a handler finished:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("third connection was not served after a handler finished")
+	}
+}
+
+func TestServerServeDrainsHandlers(t *testing.T) {
+	segments := []segment.Segment{segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	srcIA, dstIA := segments[0].SrcIA(), segments[0].DstIA()
+	listener, err := newNotifyListener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A temporary error does not stop Serve.
+	listener.errs <- temporaryError{}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- (&Server{Timeout: 5 * time.Second}).Serve(ctx, listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	<-listener.accepted
+	cancel()
+	select {
+	case err := <-served:
+		t.Fatal("Serve returned before the in-flight handler finished:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The in-flight negotiation is completed although Serve was cancelled.
+	clientctx, clientcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer clientcancel()
+	accepted, err := NewClient(conn).Negotiate(clientctx, segments, srcIA, dstIA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(accepted, segments, t)
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Error("want context.Canceled, have", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the handler finished")
+	}
+}
+
+// notifyListener is a TCP listener that reports every accepted connection on
+// the accepted channel and that returns the errors queued on errs first.
+type notifyListener struct {
+	net.Listener
+	accepted chan struct{}
+	errs     chan error
+}
+
+func newNotifyListener() (*notifyListener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	return &notifyListener{Listener: listener, accepted: make(chan struct{}, 8), errs: make(chan error, 1)}, nil
+}
+
+func (l *notifyListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+	}
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted <- struct{}{}
+	}
+	return conn, err
+}
+
+// temporaryError is a temporary net.Error like the errors of accepting a
+// connection when the process runs out of file descriptors.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+func TestServerServePacket(t *testing.T) {
+	segments := []segment.Segment{
+		segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		segment.FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+	}
+	srcIA, dstIA := segments[0].SrcIA(), segments[1].DstIA()
+	sconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	// Errors of individual datagrams do not stop the server.
+	flaky := &failingPacketConn{PacketConn: sconn, failures: 2}
+	go func() { served <- (&Server{}).ServePacket(ctx, flaky) }()
+
+	for i := 0; i < 3; i++ {
+		cconn, err := net.Dial("udp", sconn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientctx, clientcancel := context.WithTimeout(context.Background(), 5*time.Second)
+		accepted, err := NewClient(cconn).Negotiate(clientctx, segments, srcIA, dstIA)
+		clientcancel()
+		cconn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(accepted, segments, t)
+	}
+
+	cancel()
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.Canceled) {
+			t.Error("want context.Canceled, have", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServePacket did not return after the context was cancelled")
+	}
+
+	sconn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { served <- (&Server{}).ServePacket(context.Background(), sconn) }()
+	sconn.Close()
+	select {
+	case err := <-served:
+		if err == nil {
+			t.Error("closed connection: want error, have nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServePacket did not return after the connection was closed")
+	}
+}
+
+func TestServerServePacketConcurrent(t *testing.T) {
+	segments := []segment.Segment{segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	srcIA, dstIA := segments[0].SrcIA(), segments[0].DstIA()
+	sconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sconn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The first offer is only answered once the second one is handled, which
+	// requires that the offers are served concurrently.
+	var calls sync.Mutex
+	first, release := true, make(chan struct{})
+	handler := func(offered segment.SegmentSet) segment.SegmentSet {
+		calls.Lock()
+		wait := first
+		first = false
+		calls.Unlock()
+		if wait {
+			<-release
+		} else {
+			close(release)
+		}
+		return offered
+	}
+	go (&Server{Handler: handler, MaxConns: 2}).ServePacket(ctx, sconn)
+
+	var clients sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			cconn, err := net.Dial("udp", sconn.LocalAddr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer cconn.Close()
+			clientctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := NewClient(cconn).Negotiate(clientctx, segments, srcIA, dstIA); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	clients.Wait()
+}
+
+// failingPacketConn is a net.PacketConn whose first reads fail like reads of
+// snet connections that receive SCMP errors.
+type failingPacketConn struct {
+	net.PacketConn
+	failures int
+}
+
+func (c *failingPacketConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, nil, errors.New("scmp error")
+	}
+	return c.PacketConn.ReadFrom(buffer)
+}
@@ -0,0 +1,79 @@
+package conpass
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/mblarer/conpass/segment"
+	"github.com/scionproto/scion/go/lib/addr"
+)
+
+// DefaultMaxRounds is the default value for Session.MaxRounds.
+const DefaultMaxRounds = 8
+
+// Session is one side of a multi-round negotiation over a connection. Each
+// side sends one message per round, and a Session keeps track of all segments
+// exchanged so far, such that every message may refer to segments of earlier
+// rounds by their ids. Both sides must send and receive every message through
+// their Session for the segment ids to stay in sync.
+type Session struct {
+	// MaxRounds is the maximum number of rounds that the Session sends a
+	// message in (default: DefaultMaxRounds). It prevents infinite ping-pong
+	// between two agents that do not converge.
+	MaxRounds int
+	conn      net.Conn
+	oldsegs   []segment.Segment
+	round     int
+}
+
+// NewSession creates a new Session that negotiates over the given connection.
+func NewSession(conn net.Conn) *Session {
+	return &Session{conn: conn, oldsegs: []segment.Segment{}}
+}
+
+// Send sends the given segments to the other agent, which starts a new round.
+// Segments that were exchanged in earlier rounds are referred to by their ids.
+func (s *Session) Send(ctx context.Context, segments []segment.Segment, srcIA, dstIA addr.IA) error {
+	if s.round >= s.maxRounds() {
+		return fmt.Errorf("negotiation exceeds the maximum of %d rounds", s.maxRounds())
+	}
+	defer watchContext(ctx, s.conn)()
+	sentsegs, err := segment.NewEncoder(s.conn).Encode(segments, s.oldsegs, srcIA, dstIA)
+	if err != nil {
+		return contextError(ctx, fmt.Errorf("failed to send segments: %s", err.Error()))
+	}
+	s.oldsegs = append(s.oldsegs, sentsegs...)
+	s.round++
+	return nil
+}
+
+// Receive receives the next message of the other agent. It returns the new
+// segments of the message and the segments that the other agent accepted.
+func (s *Session) Receive(ctx context.Context) ([]segment.Segment, []segment.Segment, addr.IA, addr.IA, error) {
+	defer watchContext(ctx, s.conn)()
+	newsegs, accsegs, srcIA, dstIA, err := segment.NewDecoder(s.conn).Decode(s.oldsegs)
+	if err != nil {
+		return nil, nil, srcIA, dstIA, contextError(ctx, fmt.Errorf("failed to decode segments: %s", err.Error()))
+	}
+	s.oldsegs = append(s.oldsegs, newsegs...)
+	return newsegs, accsegs, srcIA, dstIA, nil
+}
+
+// Round returns the number of rounds in which the Session has sent a message.
+func (s *Session) Round() int {
+	return s.round
+}
+
+// Segments returns all segments exchanged in the Session so far, indexed by
+// their segment ids.
+func (s *Session) Segments() []segment.Segment {
+	return s.oldsegs
+}
+
+func (s *Session) maxRounds() int {
+	if s.MaxRounds == 0 {
+		return DefaultMaxRounds
+	}
+	return s.MaxRounds
+}
@@ -0,0 +1,93 @@
+package conpass
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mblarer/conpass/segment"
+)
+
+func TestSessionTwoRounds(t *testing.T) {
+	segments := []segment.Segment{
+		segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302"),
+		segment.FromString("19-ffaa:0:1302 2>1 17-ffaa:0:1108"),
+		segment.FromString("19-ffaa:0:1303 3>2 17-ffaa:0:1108"),
+	}
+	srcIA, dstIA := segments[0].SrcIA(), segments[2].DstIA()
+	composed := segment.FromSegments(segments[0], segments[1])
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	client, server := NewSession(cconn), NewSession(sconn)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Round 1: the server counter-offers a composition of two offered
+		// segments as well as the third offered segment.
+		_, accsegs, srcIA, dstIA, err := server.Receive(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		counter := []segment.Segment{segment.FromSegments(accsegs[0], accsegs[1]), accsegs[2]}
+		if err := server.Send(ctx, counter, srcIA, dstIA); err != nil {
+			t.Error(err)
+			return
+		}
+		// Round 2: the server confirms what the client accepted.
+		_, accsegs, srcIA, dstIA, err = server.Receive(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := server.Send(ctx, accsegs, srcIA, dstIA); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := client.Send(ctx, segments, srcIA, dstIA); err != nil {
+		t.Fatal(err)
+	}
+	_, accsegs, _, _, err := client.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(accsegs, []segment.Segment{composed, segments[2]}, t)
+	if err := client.Send(ctx, accsegs[:1], srcIA, dstIA); err != nil {
+		t.Fatal(err)
+	}
+	_, accsegs, _, _, err = client.Receive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(accsegs, []segment.Segment{composed}, t)
+	<-done
+	if client.Round() != 2 {
+		t.Error("want 2 rounds, have", client.Round())
+	}
+	if len(client.Segments()) != len(server.Segments()) {
+		t.Error("sessions out of sync:", len(client.Segments()), "vs", len(server.Segments()), "segments")
+	}
+}
+
+func TestSessionMaxRounds(t *testing.T) {
+	segments := []segment.Segment{segment.FromString("19-ffaa:0:1303 1>1 19-ffaa:0:1302")}
+	srcIA, dstIA := segments[0].SrcIA(), segments[0].DstIA()
+	cconn, sconn := net.Pipe()
+	defer cconn.Close()
+	defer sconn.Close()
+	go NewSession(sconn).Receive(context.Background())
+	session := NewSession(cconn)
+	session.MaxRounds = 1
+	if err := session.Send(context.Background(), segments, srcIA, dstIA); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Send(context.Background(), segments, srcIA, dstIA); err == nil {
+		t.Error("want error after exceeding the maximum rounds, have nil")
+	}
+}